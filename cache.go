@@ -0,0 +1,354 @@
+package ninep
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+// CacheOptions configures the attribute and name lookup cache of a
+// Client. A zero TTL disables caching of the respective entries.
+type CacheOptions struct {
+	// AttrTTL is the time the attributes of a file are cached.
+	AttrTTL time.Duration
+
+	// EntryTTL is the time the Qid of a name found in a directory is
+	// cached.
+	EntryTTL time.Duration
+
+	// NegativeTTL is the time a name not found in a directory is
+	// cached.
+	NegativeTTL time.Duration
+
+	// Strict validates cached attributes against the Qid version
+	// returned by the server. Names are always walked on the server
+	// and the attributes of a fid are always requested from the
+	// server, only the attributes requested after a walk are taken
+	// from the cache if the version of the Qid did not change.
+	Strict bool
+}
+
+// WithCache makes a Client cache the attributes of files and the
+// results of name lookups. Cached entries are used by Walk, Stat and
+// the methods of Root, and dropped on mutations issued by the client
+// itself. Changes made by other clients are visible once the entries
+// expired, unless the cache is strict.
+//
+// Attributes are shared by all file trees attached by the client. Name
+// lookups are cached per attaching user, as they depend on the search
+// permissions of the user.
+func WithCache(opts CacheOptions) Option {
+	return func(v interface{}) error {
+		c, ok := v.(*Client)
+		if !ok {
+			return fmt.Errorf("unknown ninep option type: %T", v)
+		}
+		c.cache = newCache(opts)
+		return nil
+	}
+}
+
+// maxCacheEntries is the number of entries of a cache map which
+// triggers the removal of expired entries. If the map is still full,
+// the entries expiring first are evicted until a quarter of the map is
+// free.
+const maxCacheEntries = 1 << 16
+
+type attrEntry struct {
+	attr    *proto.Rgetattr
+	expires time.Time
+}
+
+// nameKey identifies name in the directory whose Qid path is dir.
+type nameKey struct {
+	dir  uint64
+	name string
+}
+
+type nameEntry struct {
+	qid     proto.Qid
+	found   bool
+	expires time.Time
+}
+
+// nameEntries holds the lookups of a name by the uid of the attaching
+// user.
+type nameEntries map[uint32]nameEntry
+
+// cache caches attributes by Qid path and name lookups by directory
+// Qid path, name and user. Files whose Qid path is not stable are not
+// cached. All methods are no-ops on a nil cache.
+type cache struct {
+	opts CacheOptions
+	now  func() time.Time
+	max  int // maximal number of entries per map
+
+	mu    sync.Mutex // protects following
+	attrs map[uint64]attrEntry
+	names map[nameKey]nameEntries
+}
+
+func newCache(opts CacheOptions) *cache {
+	return &cache{
+		opts:  opts,
+		now:   time.Now,
+		max:   maxCacheEntries,
+		attrs: make(map[uint64]attrEntry),
+		names: make(map[nameKey]nameEntries),
+	}
+}
+
+// attr returns the cached attributes of the file identified by qid,
+// or nil. If fresh is set, qid was just returned by the server and
+// the attributes are only returned if the version matches.
+func (c *cache) attr(qid proto.Qid, fresh bool) *proto.Rgetattr {
+	if c == nil || (c.opts.Strict && !fresh) {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, found := c.attrs[qid.Path]
+	if !found {
+		return nil
+	}
+	if !c.now().Before(e.expires) || (fresh && e.attr.Qid.Version != qid.Version) {
+		delete(c.attrs, qid.Path)
+		return nil
+	}
+	return e.attr
+}
+
+// setAttr caches attr, which must not be modified afterwards.
+func (c *cache) setAttr(attr *proto.Rgetattr) {
+	if c == nil || c.opts.AttrTTL <= 0 || !stablePath(attr.Qid.Path) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if len(c.attrs) >= c.max {
+		c.evictAttrs(now)
+	}
+	c.attrs[attr.Qid.Path] = attrEntry{attr: attr, expires: now.Add(c.opts.AttrTTL)}
+}
+
+// resolve looks up names relative to the directory identified by dir
+// on behalf of the user uid. If ok is set, the lookup was answered by
+// the cache: either all names were found and qid identifies the file,
+// or found is not set.
+func (c *cache) resolve(uid uint32, dir proto.Qid, names []string) (qid proto.Qid, found, ok bool) {
+	if c == nil || c.opts.Strict {
+		return qid, false, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	qid = dir
+	for _, name := range names {
+		key := nameKey{dir: qid.Path, name: name}
+		e, found := c.names[key][uid]
+		if !found {
+			return qid, false, false
+		}
+		if !now.Before(e.expires) {
+			delete(c.names[key], uid)
+			if len(c.names[key]) == 0 {
+				delete(c.names, key)
+			}
+			return qid, false, false
+		}
+		if !e.found {
+			return qid, false, true
+		}
+		qid = e.qid
+	}
+	return qid, true, true
+}
+
+// walked records the result of walking names relative to the directory
+// identified by dir on behalf of the user uid. The server returned
+// qids, if there are less qids than names, the next name was not
+// found.
+func (c *cache) walked(uid uint32, dir proto.Qid, names []string, qids []proto.Qid) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if len(c.names) >= c.max {
+		c.evictNames(now)
+	}
+	for i, name := range names {
+		if name == ".." {
+			break // the parent changes if dir is renamed
+		}
+		if !stablePath(dir.Path) || (i < len(qids) && !stablePath(qids[i].Path)) {
+			break // the path may be assigned anew
+		}
+		key := nameKey{dir: dir.Path, name: name}
+		if i == len(qids) {
+			if c.opts.NegativeTTL > 0 && dir.IsDir() {
+				c.set(key, uid, nameEntry{expires: now.Add(c.opts.NegativeTTL)})
+			}
+			break
+		}
+		if c.opts.EntryTTL > 0 {
+			c.set(key, uid, nameEntry{qid: qids[i], found: true, expires: now.Add(c.opts.EntryTTL)})
+		}
+		dir = qids[i]
+	}
+}
+
+// evictAttrs drops expired attributes and, if c.attrs is still full,
+// the attributes expiring first. The caller must hold c.mu.
+func (c *cache) evictAttrs(now time.Time) {
+	for qpath, e := range c.attrs {
+		if !now.Before(e.expires) {
+			delete(c.attrs, qpath)
+		}
+	}
+	if len(c.attrs) < c.max {
+		return
+	}
+
+	qpaths := make([]uint64, 0, len(c.attrs))
+	for qpath := range c.attrs {
+		qpaths = append(qpaths, qpath)
+	}
+	sort.Slice(qpaths, func(i, j int) bool {
+		return c.attrs[qpaths[i]].expires.Before(c.attrs[qpaths[j]].expires)
+	})
+	for _, qpath := range qpaths[:len(qpaths)-c.max*3/4] {
+		delete(c.attrs, qpath)
+	}
+}
+
+// evictNames drops expired name lookups and, if c.names is still full,
+// the names whose lookups expire first. The caller must hold c.mu.
+func (c *cache) evictNames(now time.Time) {
+	expires := make(map[nameKey]time.Time, len(c.names))
+	for key, entries := range c.names {
+		for uid, e := range entries {
+			if !now.Before(e.expires) {
+				delete(entries, uid)
+			} else if e.expires.After(expires[key]) {
+				expires[key] = e.expires
+			}
+		}
+		if len(entries) == 0 {
+			delete(c.names, key)
+		}
+	}
+	if len(c.names) < c.max {
+		return
+	}
+
+	keys := make([]nameKey, 0, len(c.names))
+	for key := range c.names {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return expires[keys[i]].Before(expires[keys[j]])
+	})
+	for _, key := range keys[:len(keys)-c.max*3/4] {
+		delete(c.names, key)
+	}
+}
+
+// set caches the lookup of key by the user uid. The caller must hold
+// c.mu.
+func (c *cache) set(key nameKey, uid uint32, e nameEntry) {
+	entries, found := c.names[key]
+	if !found {
+		entries = make(nameEntries)
+		c.names[key] = entries
+	}
+	entries[uid] = e
+}
+
+// refer returns whether a lookup found the file whose Qid path is
+// qpath.
+func (m nameEntries) refer(qpath uint64) bool {
+	for _, e := range m {
+		if e.found && e.qid.Path == qpath {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidate drops name in the directory identified by dir and the
+// attributes of the directory and of the file name referred to.
+func (c *cache) invalidate(dir uint64, name string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := nameKey{dir: dir, name: name}
+	for _, e := range c.names[key] {
+		if e.found {
+			delete(c.attrs, e.qid.Path)
+		}
+	}
+	delete(c.names, key)
+	delete(c.attrs, dir)
+}
+
+// invalidateAttr drops the attributes of the file whose Qid path is
+// qpath.
+func (c *cache) invalidateAttr(qpath uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	delete(c.attrs, qpath)
+	c.mu.Unlock()
+}
+
+// forget drops all entries of the removed file whose Qid path is
+// qpath.
+func (c *cache) forget(qpath uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.attrs, qpath)
+	for key, entries := range c.names {
+		if key.dir == qpath || entries.refer(qpath) {
+			delete(c.names, key)
+		}
+	}
+}
+
+// cachedLstat returns the attributes of the file reached by walking
+// names relative to fid if they are cached, without asking the server.
+// If ok is not set, the cache could not answer.
+func (f *Fid) cachedLstat(names []string) (fi *fileInfo, ok bool, err error) {
+	qid, found, ok := f.c.cache.resolve(f.fi.uid, f.fi.Qid, names)
+	if !ok {
+		return nil, false, nil
+	}
+	if !found {
+		return nil, true, unix.ENOENT
+	}
+	attr := f.c.cache.attr(qid, false)
+	if attr == nil {
+		return nil, false, nil
+	}
+	path := path.Join(f.fi.path, path.Join(names...))
+	return &fileInfo{Rgetattr: attr, path: path, uid: f.fi.uid}, true, nil
+}
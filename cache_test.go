@@ -0,0 +1,271 @@
+package ninep
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+// countCalls returns the number of requests of the given types the
+// mock tree has served.
+func countCalls(m *mockTree, mtypes ...proto.MessageType) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for _, mtype := range mtypes {
+		n += m.calls[mtype]
+	}
+	return n
+}
+
+func TestClientCache(t *testing.T) {
+	m := newMockTree(false, map[string]bool{
+		"dir": true, "dir/file": false,
+	})
+	c := newMockClient(t, m.handle, WithCache(CacheOptions{
+		AttrTTL:     time.Minute,
+		EntryTTL:    time.Minute,
+		NegativeTTL: time.Minute,
+	}))
+	defer c.Close()
+	now := time.Now()
+	c.cache.now = func() time.Time { return now }
+
+	r, err := c.AttachRoot("/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	calls := countCalls(m, proto.MessageTwalk, proto.MessageTgetattr)
+	for i := 0; i < 2; i++ {
+		if _, err = r.Lstat("dir/file"); err != nil {
+			t.Fatalf("lstat: unexpected error: %v", err)
+		}
+		if _, err = r.Lstat("dir/missing"); !os.IsNotExist(err) {
+			t.Fatalf("lstat: expected error %v, got %v", unix.ENOENT, err)
+		}
+	}
+	if n := countCalls(m, proto.MessageTwalk, proto.MessageTgetattr) - calls; n != 3 {
+		t.Fatalf("cache: expected 3 walk and getattr requests, got %d", n)
+	}
+
+	// local mutations invalidate entries
+	if err = r.WriteFile("dir/missing", []byte("hello"), 0644); err != nil {
+		t.Fatalf("writefile: unexpected error: %v", err)
+	}
+	if fi, err := r.Lstat("dir/missing"); err != nil || fi.Size() != 5 {
+		t.Fatalf("lstat: unexpected result %v, %v", fi, err)
+	}
+	if err = r.Rename("dir/file", "dir/moved"); err != nil {
+		t.Fatalf("rename: unexpected error: %v", err)
+	}
+	if _, err = r.Lstat("dir/file"); !os.IsNotExist(err) {
+		t.Fatalf("lstat: expected error %v, got %v", unix.ENOENT, err)
+	}
+	if err = r.Remove("dir/missing"); err != nil {
+		t.Fatalf("remove: unexpected error: %v", err)
+	}
+	if _, err = r.Lstat("dir/missing"); !os.IsNotExist(err) {
+		t.Fatalf("lstat: expected error %v, got %v", unix.ENOENT, err)
+	}
+
+	// changes of other clients are visible once entries expired
+	if _, err = r.Lstat("dir/moved"); err != nil {
+		t.Fatalf("lstat: unexpected error: %v", err)
+	}
+	if _, err = r.Lstat("dir/other"); !os.IsNotExist(err) {
+		t.Fatalf("lstat: expected error %v, got %v", unix.ENOENT, err)
+	}
+	m.mu.Lock()
+	m.files["dir/other"] = false
+	m.data["dir/moved"] = []byte("hello")
+	m.mu.Unlock()
+	if fi, err := r.Lstat("dir/moved"); err != nil || fi.Size() != 0 {
+		t.Fatalf("lstat: unexpected result %v, %v", fi, err)
+	}
+	if _, err = r.Lstat("dir/other"); !os.IsNotExist(err) {
+		t.Fatalf("lstat: expected error %v, got %v", unix.ENOENT, err)
+	}
+	now = now.Add(time.Minute)
+	if fi, err := r.Lstat("dir/moved"); err != nil || fi.Size() != 5 {
+		t.Fatalf("lstat: unexpected result %v, %v", fi, err)
+	}
+	if _, err = r.Lstat("dir/other"); err != nil {
+		t.Fatalf("lstat: unexpected error: %v", err)
+	}
+}
+
+func TestClientCacheStrict(t *testing.T) {
+	m := newMockTree(false, map[string]bool{"file": false})
+	var version uint32
+	handle := func(tx, rx proto.Message) error {
+		err := m.handle(tx, rx)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		switch rx := rx.(type) {
+		case *proto.Rwalk:
+			for i := range *rx {
+				(*rx)[i].Version = version
+			}
+		case *proto.Rgetattr:
+			rx.Qid.Version = version
+		}
+		return err
+	}
+	c := newMockClient(t, handle, WithCache(CacheOptions{
+		AttrTTL:     time.Minute,
+		EntryTTL:    time.Minute,
+		NegativeTTL: time.Minute,
+		Strict:      true,
+	}))
+	defer c.Close()
+
+	r, err := c.AttachRoot("/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	walks := countCalls(m, proto.MessageTwalk)
+	stats := countCalls(m, proto.MessageTgetattr)
+	for i := 0; i < 2; i++ {
+		if _, err = r.Lstat("file"); err != nil {
+			t.Fatalf("lstat: unexpected error: %v", err)
+		}
+	}
+	if n := countCalls(m, proto.MessageTwalk) - walks; n != 2 {
+		t.Fatalf("cache: expected 2 walk requests, got %d", n)
+	}
+	if n := countCalls(m, proto.MessageTgetattr) - stats; n != 1 {
+		t.Fatalf("cache: expected 1 getattr request, got %d", n)
+	}
+
+	m.mu.Lock()
+	m.data["file"] = []byte("hello")
+	version++
+	m.mu.Unlock()
+	if fi, err := r.Lstat("file"); err != nil || fi.Size() != 5 {
+		t.Fatalf("lstat: unexpected result %v, %v", fi, err)
+	}
+}
+
+func TestClientCacheUsers(t *testing.T) {
+	m := newMockTree(false, map[string]bool{
+		"dir": true, "dir/file": false,
+	})
+	uids := make(map[uint32]uint32) // by fid
+	handle := func(tx, rx proto.Message) error {
+		switch tx := tx.(type) {
+		case *proto.Tlattach:
+			uids[tx.Fid] = tx.Uid
+		case *proto.Twalk:
+			uids[tx.NewFid] = uids[tx.Fid]
+			if uids[tx.Fid] != 0 && len(tx.Names) > 1 {
+				return unix.EACCES // dir is not searchable
+			}
+		}
+		return m.handle(tx, rx)
+	}
+	c := newMockClient(t, handle, WithCache(CacheOptions{
+		AttrTTL:     time.Minute,
+		EntryTTL:    time.Minute,
+		NegativeTTL: time.Minute,
+	}))
+	defer c.Close()
+
+	root, err := c.AttachRoot("/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	defer root.Close()
+	user, err := c.AttachRoot("/", "user", 1000)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	defer user.Close()
+
+	if _, err = root.Lstat("dir/file"); err != nil {
+		t.Fatalf("lstat: unexpected error: %v", err)
+	}
+	_, err = user.Lstat("dir/file")
+	checkPathError(t, "lstat", err, unix.EACCES)
+	if _, err = root.Lstat("dir/file"); err != nil {
+		t.Fatalf("lstat: unexpected error: %v", err)
+	}
+
+	dir, err := root.Fid().Walk("dir")
+	if err != nil {
+		t.Fatalf("walk: unexpected error: %v", err)
+	}
+	defer dir.Close()
+	if err = dir.Create("new", os.O_RDWR, 0644); err != nil {
+		t.Fatalf("create: unexpected error: %v", err)
+	}
+	fi, err := dir.Stat()
+	if err != nil || fi.Name() != "new" || fi.IsDir() {
+		t.Fatalf("stat: unexpected result %v, %v", fi, err)
+	}
+	if qid := fi.Sys().(*proto.Rgetattr).Qid; qid != dir.fi.Qid || qid == root.Fid().fi.Qid {
+		t.Fatalf("create: unexpected qid %v", qid)
+	}
+}
+
+func TestCacheUnstablePath(t *testing.T) {
+	c := newCache(CacheOptions{AttrTTL: time.Minute, EntryTTL: time.Minute, NegativeTTL: time.Minute})
+
+	m := newQidmap()
+	dir := proto.Qid{Type: proto.TypeDirectory, Path: m.path(1, 2)}
+	unstable := proto.Qid{Path: m.path(1, 1<<60)}
+	if !stablePath(dir.Path) || stablePath(unstable.Path) {
+		t.Fatalf("cache: unexpected stability of paths %x, %x", dir.Path, unstable.Path)
+	}
+
+	c.setAttr(&proto.Rgetattr{Qid: unstable})
+	if attr := c.attr(unstable, false); attr != nil {
+		t.Fatalf("cache: expected attributes of unstable path %x not to be cached", unstable.Path)
+	}
+
+	c.walked(0, dir, []string{"file", "missing"}, []proto.Qid{unstable})
+	if _, _, ok := c.resolve(0, dir, []string{"file"}); ok {
+		t.Fatalf("cache: expected lookup of unstable path not to be cached")
+	}
+	if _, _, ok := c.resolve(0, unstable, []string{"missing"}); ok {
+		t.Fatalf("cache: expected lookup in unstable directory not to be cached")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := newCache(CacheOptions{AttrTTL: time.Minute, EntryTTL: time.Minute})
+	c.max = 4
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	dir := proto.Qid{Type: proto.TypeDirectory, Path: 1}
+	for i := uint64(2); i < 12; i++ {
+		now = now.Add(time.Second)
+		qid := proto.Qid{Path: i}
+		c.setAttr(&proto.Rgetattr{Qid: qid})
+		c.walked(0, dir, []string{strconv.FormatUint(i, 10)}, []proto.Qid{qid})
+		if len(c.attrs) > c.max || len(c.names) > c.max {
+			t.Fatalf("cache: %d attributes and %d names exceed the maximum %d", len(c.attrs), len(c.names), c.max)
+		}
+	}
+	if attr := c.attr(proto.Qid{Path: 11}, false); attr == nil {
+		t.Fatalf("cache: expected latest attributes to be cached")
+	}
+	if attr := c.attr(proto.Qid{Path: 2}, false); attr != nil {
+		t.Fatalf("cache: expected oldest attributes to be evicted")
+	}
+	if _, found, ok := c.resolve(0, dir, []string{"11"}); !ok || !found {
+		t.Fatalf("cache: expected latest lookup to be cached")
+	}
+	if _, _, ok := c.resolve(0, dir, []string{"2"}); ok {
+		t.Fatalf("cache: expected oldest lookup to be evicted")
+	}
+}
@@ -2,10 +2,12 @@ package ninep
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net"
+	"os"
 	"path"
 	"sync"
 
@@ -22,19 +24,53 @@ type Client struct {
 	writer sync.Mutex // exclusive stream encoder
 	enc    *proto.Encoder
 
-	dec *proto.Decoder
-	c   io.Closer
-
 	tag *pool.Generator
 	fid *pool.Generator
 
 	maxMessageSize uint32
 	maxDataSize    uint32
 
+	// noRenameat and noUnlinkat are set if the server does not
+	// support Trenameat and Tunlinkat. Both are accessed atomically.
+	noRenameat uint32
+	noUnlinkat uint32
+
+	// procID and clientID identify the client as owner of POSIX
+	// record locks.
+	procID   uint32
+	clientID string
+
+	// dial opens the connections of the pool and re-establishes a
+	// broken connection if reconnect is set. Otherwise the client is
+	// shut down if the connection breaks.
+	dial      Dialer
+	reconnect bool
+
+	// pool holds all connections of a client created WithConnections,
+	// conns is the number of connections to open.
+	pool  *connPool
+	conns int
+
+	// cache caches attributes and name lookups if set.
+	cache *cache
+
 	mu       sync.Mutex // protects following
+	c        io.Closer
 	pending  map[uint16]*proto.Fcall
+	orphans  map[uint16]uint32 // fids of flushed requests, by tag
 	closing  bool
 	shutdown bool
+
+	// The following are used if the client reconnects. While broken,
+	// new requests wait until ready is closed. Requests in flight
+	// when the connection broke which are safe to retry are kept in
+	// retry and resent once the fids are recovered.
+	fids   map[uint32]*fidState
+	retry  map[uint16]*proto.Fcall
+	broken bool
+	ready  chan struct{}
+	gen    uint64        // connection generation
+	closed chan struct{} // closed by Close, aborts redialing
 }
 
 // Option sets Server or Client options such as logging, max message
@@ -63,12 +99,18 @@ func WithMaxMessageSize(size uint32) Option {
 // the connection is complete, an error is returned. Once successfully
 // connected, any expiration of the context will not affect the
 // connection.
+//
+// If the client is created WithReconnect or WithConnections and a nil
+// Dialer, the network address is dialed to open new connections.
 func Dial(ctx context.Context, network, address string, opts ...Option) (*Client, error) {
 	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(conn, opts...)
+	dial := func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+	return NewClient(conn, append(opts, withDefaultDialer(dial))...)
 }
 
 // NewClient returns a new client to handle requests to the set of
@@ -83,6 +125,12 @@ func NewClient(rwc io.ReadWriteCloser, opts ...Option) (*Client, error) {
 		c.Close()
 		return nil, err
 	}
+	if c.conns > 1 {
+		if err := c.dialPool(opts); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
 
 	return c, nil
 }
@@ -92,8 +140,14 @@ func newClient(rwc io.ReadWriteCloser, opts ...Option) (*Client, error) {
 		maxMessageSize: proto.DefaultMaxMessageSize,
 		maxDataSize:    proto.DefaultMaxDataSize,
 		c:              rwc,
+		procID:         uint32(os.Getpid()),
+		clientID:       newClientID(),
 
 		pending: make(map[uint16]*proto.Fcall),
+		orphans: make(map[uint16]uint32),
+		fids:    make(map[uint32]*fidState),
+		retry:   make(map[uint16]*proto.Fcall),
+		closed:  make(chan struct{}),
 		tag:     pool.NewGenerator(1, math.MaxUint16),
 		fid:     pool.NewGenerator(1, math.MaxUint32),
 	}
@@ -102,10 +156,16 @@ func newClient(rwc io.ReadWriteCloser, opts ...Option) (*Client, error) {
 			return nil, err
 		}
 	}
+	if c.reconnect && c.dial == nil {
+		return nil, errors.New("reconnect requires a dialer")
+	}
+	if c.conns > 1 && c.dial == nil {
+		return nil, errors.New("multiple connections require a dialer")
+	}
 	c.enc = proto.NewEncoder(rwc, c.maxMessageSize)
-	c.dec = proto.NewDecoder(rwc, c.maxMessageSize)
+	dec := proto.NewDecoder(rwc, c.maxMessageSize)
 
-	go c.recv()
+	go c.recv(dec, 0)
 	return c, nil
 }
 
@@ -141,59 +201,203 @@ func (c *Client) Close() error {
 		return errConnectionShutdown
 	}
 	c.closing = true
+	close(c.closed)
+	conn := c.c
+	if c.broken {
+		close(c.ready) // wake up requests waiting for the connection
+		c.broken = false
+		for tag, f := range c.retry {
+			delete(c.retry, tag)
+			c.tag.Put(int64(tag))
+			done(f, errConnectionShutdown)
+		}
+	}
 	c.mu.Unlock()
-	return c.c.Close()
+	if c.pool != nil && c.pool.conns[0] == c {
+		for _, peer := range c.pool.conns[1:] {
+			peer.Close()
+		}
+	}
+	return conn.Close()
 }
 
-func (c *Client) send(f *proto.Fcall) {
+// register allocates a tag for f and adds f to the pending requests.
+// If f cannot be sent, f is done with the error and false is returned.
+// While the client reconnects, register waits until the connection is
+// recovered unless force is set.
+func (c *Client) register(ctx context.Context, f *proto.Fcall, force bool) (uint16, bool) {
 	c.mu.Lock()
+	for c.broken && !force && !c.closing {
+		ready := c.ready
+		c.mu.Unlock()
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			done(f, ctx.Err())
+			return 0, false
+		}
+		c.mu.Lock()
+	}
 	if c.shutdown || c.closing {
 		c.mu.Unlock()
 		done(f, errConnectionShutdown)
-		return
+		return 0, false
 	}
 	v, ok := c.tag.Get()
 	if !ok {
 		c.mu.Unlock()
 		done(f, errTagOverflow)
+		return 0, false
 	}
 	tag := uint16(v)
 	c.pending[tag] = f
 	c.mu.Unlock()
+	return tag, true
+}
 
+func (c *Client) send(tag uint16, f *proto.Fcall) {
 	//log.Debugf("<- %s tag:%d %s", f.Tx.MessageType(), tag, f.Tx)
 	c.writer.Lock()
 	if err := c.enc.Encode(tag, f.Tx); err != nil {
 		c.mu.Lock()
-		delete(c.pending, tag)
-		c.tag.Put(int64(tag))
+		if c.pending[tag] == f {
+			delete(c.pending, tag)
+			c.tag.Put(int64(tag))
+		}
 		c.mu.Unlock()
 		done(f, err)
 	}
 	c.writer.Unlock()
 }
 
-func (c *Client) rpc(f *proto.Fcall) error {
+// rpc sends the request f and waits for the response. If ctx is done
+// before the response arrives, the request is flushed and ctx.Err() is
+// returned.
+func (c *Client) rpc(ctx context.Context, f *proto.Fcall) error {
+	return c.call(ctx, f, false)
+}
+
+func (c *Client) call(ctx context.Context, f *proto.Fcall, force bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	f.C = make(chan *proto.Fcall, 1)
-	go c.send(f)
-	f = <-f.C
-	return f.Err
+	tag, ok := c.register(ctx, f, force)
+	if ok {
+		c.send(tag, f)
+	}
+
+	select {
+	case f = <-f.C:
+		return f.Err
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	if c.retry[tag] == f {
+		// The request was lost with the broken connection.
+		delete(c.retry, tag)
+		c.tag.Put(int64(tag))
+		c.mu.Unlock()
+		return ctx.Err()
+	}
+	if c.pending[tag] != f {
+		// The response is already being decoded into f.
+		c.mu.Unlock()
+		f = <-f.C
+		return f.Err
+	}
+	// Keep the tag reserved and discard a late response, f may be
+	// reused by the caller as soon as rpc returns.
+	c.pending[tag] = nil
+	if num, ok := fidOf(f.Tx); ok {
+		c.orphans[tag] = num
+	}
+	c.mu.Unlock()
+
+	go c.flush(tag)
+	return ctx.Err()
 }
 
-func (c *Client) recv() (err error) {
+// flush asks the server to abort the request identified by tag. The
+// tag is released once the server answered the Tflush request, as
+// required by the protocol. See:
+//      http://9p.io/magic/man2html/5/flush
+func (c *Client) flush(tag uint16) {
+	f := mustAlloc(proto.MessageTflush)
+	tx := f.Tx.(*proto.Tflush)
+	tx.OldTag = tag
+	c.rpc(context.Background(), f)
+	proto.Release(f)
+
+	c.mu.Lock()
+	// The server answered the flushed request, if at all, before the
+	// Tflush request.
+	delete(c.orphans, tag)
+	if v, found := c.pending[tag]; found && v == nil {
+		delete(c.pending, tag)
+		if !c.shutdown {
+			c.tag.Put(int64(tag))
+		}
+	}
+	c.mu.Unlock()
+}
+
+// fidOf returns the fid a successful reply to tx leaves attached,
+// opened or walked to on the server.
+func fidOf(tx proto.Message) (uint32, bool) {
+	switch tx := tx.(type) {
+	case *proto.Tlattach:
+		return tx.Fid, true
+	case *proto.Twalk:
+		return tx.NewFid, true
+	case *proto.Tlopen:
+		return tx.Fid, true
+	case *proto.Tlcreate:
+		return tx.Fid, true
+	}
+	return 0, false
+}
+
+// clunkOrphan clunks the fid of a flushed request the server answered
+// successfully nonetheless. The caller already got an error and does
+// not use the fid any longer.
+func (c *Client) clunkOrphan(num uint32) {
+	f := mustAlloc(proto.MessageTclunk)
+	f.Tx.(*proto.Tclunk).Fid = num
+	c.rpc(context.Background(), f)
+	proto.Release(f)
+	c.untrack(num)
+}
+
+func (c *Client) recv(dec *proto.Decoder, gen uint64) (err error) {
 	rlerror := proto.Rlerror{}
 
 	for err == nil {
-		mtype, tag, decErr := c.dec.DecodeHeader()
+		mtype, tag, decErr := dec.DecodeHeader()
 		if decErr != nil {
 			err = decErr
 			break
 		}
 
 		c.mu.Lock()
-		f := c.pending[tag]
-		delete(c.pending, tag)
-		c.tag.Put(int64(tag))
+		if gen != c.gen {
+			c.mu.Unlock()
+			break
+		}
+		f, found := c.pending[tag]
+		if f != nil || !found {
+			// Tags of flushed requests are released by flush.
+			delete(c.pending, tag)
+			c.tag.Put(int64(tag))
+		}
+		orphan, isOrphan := c.orphans[tag]
+		if f == nil && isOrphan && mtype != proto.MessageRlerror && mtype != proto.MessageRflush {
+			// The flushed request succeeded nonetheless.
+			delete(c.orphans, tag)
+			go c.clunkOrphan(orphan)
+		}
 		c.mu.Unlock()
 
 		switch {
@@ -201,10 +405,10 @@ func (c *Client) recv() (err error) {
 			// We've got no pending fcall. That usually means that
 			// enc.Encode partially failed, and fcall was already
 			// removed.
-			err = c.dec.Decode(nil)
+			err = dec.Decode(nil)
 		case mtype == proto.MessageRlerror:
 			rlerror = proto.Rlerror{}
-			if err = c.dec.Decode(&rlerror); err != nil {
+			if err = dec.Decode(&rlerror); err != nil {
 				done(f, err)
 			} else {
 				done(f, unix.Errno(rlerror.Errno))
@@ -215,7 +419,7 @@ func (c *Client) recv() (err error) {
 			if f.Tx.MessageType() == proto.MessageTgetattr {
 				f.Rx.(*proto.Rgetattr).Stat_t = &unix.Stat_t{}
 			}
-			err = c.dec.Decode(f.Rx)
+			err = dec.Decode(f.Rx)
 			done(f, err)
 			//if f.Rx == nil {
 			//log.Debugf("-> %s tag:%d", mtype, tag)
@@ -227,6 +431,22 @@ func (c *Client) recv() (err error) {
 
 	c.writer.Lock()
 	c.mu.Lock()
+	switch {
+	case gen != c.gen:
+		// superseded by a new connection
+	case c.reconnect && !c.closing:
+		c.broke(err)
+	default:
+		c.fail(err)
+	}
+	c.mu.Unlock()
+	c.writer.Unlock()
+	return err
+}
+
+// fail shuts the client down and fails all pending requests with err.
+// The caller must hold c.writer and c.mu.
+func (c *Client) fail(err error) {
 	c.shutdown = true
 	if err == io.EOF {
 		if c.closing {
@@ -240,9 +460,21 @@ func (c *Client) recv() (err error) {
 		c.tag.Put(int64(tag))
 		done(f, err)
 	}
-	c.mu.Unlock()
-	c.writer.Unlock()
-	return err
+	for tag, f := range c.retry {
+		delete(c.retry, tag)
+		c.tag.Put(int64(tag))
+		done(f, err)
+	}
+}
+
+// errNotSupported is returned by Linux servers if an operation is not
+// supported (ENOTSUPP).
+const errNotSupported = unix.Errno(524)
+
+// isNotSupported returns whether err indicates that the server does
+// not support the request.
+func isNotSupported(err error) bool {
+	return err == unix.ENOTSUP || err == unix.ENOSYS || err == errNotSupported
 }
 
 func mustAlloc(mtype proto.MessageType) *proto.Fcall {
@@ -260,7 +492,7 @@ func (c *Client) handshake(version string) error {
 	tx := f.Tx.(*proto.Tversion)
 	tx.MessageSize = c.maxMessageSize
 	tx.Version = version
-	if err := c.rpc(f); err != nil {
+	if err := c.call(context.Background(), f, true); err != nil {
 		return err
 	}
 
@@ -291,6 +523,19 @@ func (c *Client) Auth(export, username string, uid int) (*Fid, error) {
 // Attach introduces a new user to the server, and establishes Fid as the
 // root for that user on the file tree selected by export.
 func (c *Client) Attach(auth *Fid, export, username string, uid int) (*Fid, error) {
+	return c.AttachContext(context.Background(), auth, export, username, uid)
+}
+
+// AttachContext is like Attach but aborts the request if ctx is done
+// before the server answered.
+func (c *Client) AttachContext(ctx context.Context, auth *Fid, export, username string, uid int) (*Fid, error) {
+	if c.pool != nil {
+		c = c.pool.pick()
+	}
+	return c.attachFid(ctx, auth, export, username, uid)
+}
+
+func (c *Client) attachFid(ctx context.Context, auth *Fid, export, username string, uid int) (*Fid, error) {
 	if export = path.Clean(export); !path.IsAbs(export) || isReserved(export) {
 		return nil, errInvalildName
 	}
@@ -317,29 +562,60 @@ func (c *Client) Attach(auth *Fid, export, username string, uid int) (*Fid, erro
 	tx.Path = export
 	tx.UserName = username
 	tx.Uid = uint32(uid)
-	if err := c.rpc(f); err != nil {
+	if err := c.rpc(ctx, f); err != nil {
 		return nil, err
 	}
 
-	attr, err := c.stat(tx.Fid, proto.GetAttrBasic)
+	attr, err := c.stat(ctx, tx.Fid, proto.GetAttrBasic)
 	if err != nil {
+		(&Fid{c: c, num: tx.Fid}).clunk(context.Background())
 		return nil, err
 	}
+	c.cache.setAttr(attr)
 
-	fid := &Fid{c: c, num: tx.Fid, fi: &fileInfo{path: export}}
+	c.track(tx.Fid, &attachInfo{export: export, username: username, uid: tx.Uid})
+	fid := &Fid{c: c, num: tx.Fid, fi: &fileInfo{path: export, uid: tx.Uid}}
 	fid.fi.Rgetattr = attr
 	fid.fi.iounit = 0
 	return fid, nil
 }
 
-func (c *Client) stat(num uint32, mask uint64) (*proto.Rgetattr, error) {
+// twalk walks at most proto.MaxNames path elements names relative to
+// fid and returns the number of the new fid and the Qids of the walked
+// elements. If a name was not found, the Qids of the preceding names
+// are returned with unix.ENOENT.
+func (c *Client) twalk(ctx context.Context, fid uint32, names []string) (uint32, []proto.Qid, error) {
+	fidnum, ok := c.fid.Get()
+	if !ok {
+		return 0, nil, errFidOverflow
+	}
+
+	f := mustAlloc(proto.MessageTwalk)
+	defer proto.Release(f)
+
+	tx := f.Tx.(*proto.Twalk)
+	tx.Fid = fid
+	tx.NewFid = uint32(fidnum)
+	tx.Names = names
+	if err := c.rpc(ctx, f); err != nil {
+		return 0, nil, err
+	}
+	qids := append([]proto.Qid(nil), *f.Rx.(*proto.Rwalk)...)
+	if len(qids) != len(names) {
+		return 0, qids, unix.ENOENT
+	}
+	c.trackWalk(fid, tx.NewFid, names)
+	return tx.NewFid, qids, nil
+}
+
+func (c *Client) stat(ctx context.Context, num uint32, mask uint64) (*proto.Rgetattr, error) {
 	f := mustAlloc(proto.MessageTgetattr)
 	defer proto.Release(f)
 
 	tx := f.Tx.(*proto.Tgetattr)
 	tx.Fid = num
 	tx.RequestMask = mask
-	if err := c.rpc(f); err != nil {
+	if err := c.rpc(ctx, f); err != nil {
 		return nil, err
 	}
 
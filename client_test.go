@@ -0,0 +1,193 @@
+package ninep
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+// mockHandler answers a single client request. A returned error is sent
+// back to the client as Rlerror, unless it is errMockNoReply.
+type mockHandler func(tx, rx proto.Message) error
+
+// errMockNoReply is returned by a mockHandler to leave the request
+// unanswered.
+var errMockNoReply = errors.New("no reply")
+
+// serveMock answers client requests on conn with handle. Version
+// requests are answered by serveMock itself.
+func serveMock(conn net.Conn, handle mockHandler) {
+	defer conn.Close()
+
+	enc := proto.NewEncoder(conn, proto.MaxMessageSize)
+	dec := proto.NewDecoder(conn, proto.MaxMessageSize)
+	for {
+		mtype, tag, err := dec.DecodeHeader()
+		if err != nil {
+			return
+		}
+		f, ok := proto.Alloc(mtype)
+		if !ok {
+			return
+		}
+		if err = dec.Decode(f.Tx); err != nil {
+			return
+		}
+
+		var rx proto.Message = f.Rx
+		if tx, ok := f.Tx.(*proto.Tversion); ok {
+			rx := f.Rx.(*proto.Rversion)
+			rx.MessageSize = tx.MessageSize
+			rx.Version = tx.Version
+		} else if err = handle(f.Tx, f.Rx); err != nil {
+			rx = &proto.Rlerror{Errno: uint32(newErrno(err))}
+		}
+		if err != errMockNoReply {
+			err = enc.Encode(tag, rx)
+		} else {
+			err = nil
+		}
+		proto.Release(f)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func newMockClient(t *testing.T, handle mockHandler, opts ...Option) *Client {
+	t.Helper()
+
+	server, client := net.Pipe()
+	go serveMock(server, handle)
+
+	c, err := NewClient(client, opts...)
+	if err != nil {
+		t.Fatalf("client: cannot initialize connection: %v", err)
+	}
+	return c
+}
+
+func TestClientFlush(t *testing.T) {
+	flushed := make(chan uint16, 1)
+	release := make(chan struct{})
+	var reads int
+	handle := func(tx, rx proto.Message) error {
+		switch tx := tx.(type) {
+		case *proto.Tlattach, *proto.Tlopen:
+		case *proto.Tgetattr:
+			rx.(*proto.Rgetattr).Stat_t = &unix.Stat_t{Mode: unix.S_IFREG | 0644}
+		case *proto.Tread:
+			reads++
+			return errMockNoReply // server is stuck
+		case *proto.Tflush:
+			flushed <- tx.OldTag
+			<-release
+		default:
+			return unix.ENOTSUP
+		}
+		return nil
+	}
+
+	c := newMockClient(t, handle)
+	defer c.Close()
+	f, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	if err = f.Open(os.O_RDONLY); err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = f.ReadAtContext(ctx, make([]byte, 1), 0); err != context.Canceled {
+		t.Fatalf("read: expected error %v, got %v", context.Canceled, err)
+	}
+	if reads != 0 {
+		t.Fatalf("read: request sent with done context")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = f.ReadAtContext(ctx, make([]byte, 1), 0); err != context.DeadlineExceeded {
+		t.Fatalf("read: expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	tag := <-flushed
+	c.mu.Lock()
+	v, found := c.pending[tag]
+	c.mu.Unlock()
+	if !found || v != nil {
+		t.Fatalf("flush: tag %d released before Rflush", tag)
+	}
+
+	close(release)
+	for i := 0; ; i++ {
+		c.mu.Lock()
+		_, found = c.pending[tag]
+		c.mu.Unlock()
+		if !found {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("flush: tag %d not released after Rflush", tag)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err = f.Stat(); err != nil {
+		t.Fatalf("stat: unexpected error after flush: %v", err)
+	}
+}
+
+func TestClientFlushLateReply(t *testing.T) {
+	release := make(chan struct{})
+	walked := make(chan uint32, 1)
+	clunked := make(chan uint32, 1)
+	handle := func(tx, rx proto.Message) error {
+		switch tx := tx.(type) {
+		case *proto.Tlattach, *proto.Tflush:
+		case *proto.Tgetattr:
+			rx.(*proto.Rgetattr).Stat_t = &unix.Stat_t{Mode: unix.S_IFDIR | 0755}
+		case *proto.Twalk:
+			walked <- tx.NewFid
+			<-release // answer after the client gave up
+			*rx.(*proto.Rwalk) = append(*rx.(*proto.Rwalk), proto.Qid{})
+		case *proto.Tclunk:
+			clunked <- tx.Fid
+		default:
+			return unix.ENOTSUP
+		}
+		return nil
+	}
+
+	c := newMockClient(t, handle)
+	defer c.Close()
+	f, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = f.WalkContext(ctx, "dir"); err != context.DeadlineExceeded {
+		t.Fatalf("walk: expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+	newfid := <-walked
+	close(release)
+
+	select {
+	case fid := <-clunked:
+		if fid != newfid {
+			t.Fatalf("walk: expected fid %d to be clunked, got %d", newfid, fid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("walk: fid %d of late reply not clunked", newfid)
+	}
+}
@@ -53,7 +53,10 @@ func newTestServer(t *testing.T, addr string) net.Listener {
 	if err != nil {
 		t.Fatalf("listener: %v", err)
 	}
-	s := NewServer(newTestPosixFS(t))
+	s, err := NewServer(newTestPosixFS(t))
+	if err != nil {
+		t.Fatalf("server: unexpected error: %v", err)
+	}
 	go func() {
 		if err := s.Listen(listener); err != nil {
 			//t.Fatalf("fileserver: %v", err) // TODO(mason)
@@ -0,0 +1,115 @@
+package ninep
+
+import (
+	"fmt"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/azmodb/ninep/posix"
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+// Export describes a file tree served by a Server under a name.
+type Export struct {
+	// FileSystem serves the file tree of the export.
+	FileSystem posix.FileSystem
+
+	// ReadOnly rejects every modification with unix.EROFS.
+	ReadOnly bool
+
+	// Users lists the uids allowed to attach. If empty, every user is
+	// allowed to attach.
+	Users []int
+
+	// Uids maps the uids of attaching users to uids on the file
+	// system. Users which are not listed keep their uid.
+	Uids map[int]int
+}
+
+// WithExport adds the named export to a Server. Clients select the
+// export by the first element of the attach name, the remaining
+// elements select a directory within the export.
+//
+// A Server created with a FileSystem serves it as the default export.
+// If the Server has named exports, the default export is selected by
+// an empty attach name or "/" only, other attach names must name an
+// export. Otherwise the attach name selects a directory within the
+// default export.
+func WithExport(name string, export Export) Option {
+	return func(v interface{}) error {
+		s, ok := v.(*Server)
+		if !ok {
+			return fmt.Errorf("unknown ninep option type: %T", v)
+		}
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid export name %q", name)
+		}
+		if export.FileSystem == nil {
+			return fmt.Errorf("export %q: missing file system", name)
+		}
+		s.exports[name] = newExport(export)
+		return nil
+	}
+}
+
+func newExport(e Export) Export {
+	if e.ReadOnly {
+		e.FileSystem = posix.ReadOnly(e.FileSystem)
+	}
+	return e
+}
+
+// lookup returns the export and the path within the export selected
+// by aname. If aname does not select an export, unix.ENXIO is
+// returned.
+func lookup(exports map[string]Export, aname string) (Export, string, error) {
+	aname = path.Clean("/" + aname)
+	names := strings.SplitN(strings.TrimPrefix(aname, "/"), "/", 2)
+	if e, found := exports[names[0]]; found && names[0] != "" {
+		if len(names) == 1 {
+			return e, "/", nil
+		}
+		return e, "/" + names[1], nil
+	}
+	e, found := exports[""]
+	if !found || (aname != "/" && len(exports) > 1) {
+		return Export{}, "", unix.ENXIO
+	}
+	return e, aname, nil
+}
+
+// identify returns the uid of the attaching user on the file system of
+// the export. If the user is not allowed to attach unix.EACCES is
+// returned.
+func (e Export) identify(username string, uid int) (int, error) {
+	if len(e.Users) == 0 && len(e.Uids) == 0 {
+		return uid, nil
+	}
+
+	if uid < 0 || uid >= proto.NoUid {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return uid, unix.EACCES
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return uid, unix.EACCES
+		}
+	}
+
+	if len(e.Users) > 0 {
+		allowed := false
+		for _, u := range e.Users {
+			allowed = allowed || u == uid
+		}
+		if !allowed {
+			return uid, unix.EACCES
+		}
+	}
+	if mapped, found := e.Uids[uid]; found {
+		uid = mapped
+	}
+	return uid, nil
+}
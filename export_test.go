@@ -0,0 +1,135 @@
+package ninep
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/azmodb/ninep/posix"
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+func TestExportLookup(t *testing.T) {
+	exports := map[string]Export{
+		"":     {},
+		"data": {ReadOnly: true},
+	}
+	for num, test := range []struct {
+		aname    string
+		path     string
+		readonly bool
+	}{
+		{"/", "/", false},
+		{"", "/", false},
+		{"/data", "/", true},
+		{"/data/dir/sub", "/dir/sub", true},
+		{"/data/..", "/", false},
+	} {
+		e, path, err := lookup(exports, test.aname)
+		if err != nil {
+			t.Fatalf("lookup(%d): unexpected error: %v", num, err)
+		}
+		if path != test.path || e.ReadOnly != test.readonly {
+			t.Fatalf("lookup(%d): unexpected export %+v, path %q", num, e, path)
+		}
+	}
+
+	// unknown exports do not fall back to the default export
+	for _, aname := range []string{"/typo/x", "typo", "/data/../dir"} {
+		if _, _, err := lookup(exports, aname); err != unix.ENXIO {
+			t.Fatalf("lookup(%q): expected error %v, got %v", aname, unix.ENXIO, err)
+		}
+	}
+	delete(exports, "")
+	if _, _, err := lookup(exports, "/unknown"); err != unix.ENXIO {
+		t.Fatalf("lookup: expected error %v, got %v", unix.ENXIO, err)
+	}
+
+	// without named exports, the default export is selected by path
+	e, path, err := lookup(map[string]Export{"": {}}, "/tmp")
+	if err != nil || path != "/tmp" || e.ReadOnly {
+		t.Fatalf("lookup: unexpected export %+v, path %q, %v", e, path, err)
+	}
+}
+
+func TestExportInvalid(t *testing.T) {
+	fs := posix.ReadOnly(nil)
+	for _, test := range []struct {
+		name   string
+		export Export
+	}{
+		{"", Export{FileSystem: fs}},
+		{"a/b", Export{FileSystem: fs}},
+		{"..", Export{FileSystem: fs}},
+		{"data", Export{}},
+	} {
+		if s, err := NewServer(nil, WithExport(test.name, test.export)); err == nil || s != nil {
+			t.Fatalf("server(%q): expected error, got %v", test.name, err)
+		}
+	}
+}
+
+func TestExportIdentify(t *testing.T) {
+	e := Export{Users: []int{1000, 1001}, Uids: map[int]int{1001: 2000}}
+	for num, test := range []struct {
+		uid  int
+		want int
+		err  error
+	}{
+		{1000, 1000, nil},
+		{1001, 2000, nil},
+		{1002, 1002, unix.EACCES},
+	} {
+		uid, err := e.identify("", test.uid)
+		if err != test.err || (err == nil && uid != test.want) {
+			t.Fatalf("identify(%d): unexpected uid %d, %v", num, uid, err)
+		}
+	}
+}
+
+func TestExportAttach(t *testing.T) {
+	root, err := ioutil.TempDir("", "ninep-export-test")
+	if err != nil {
+		t.Fatalf("cannot create export directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+	if err = os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatalf("cannot create export directory: %v", err)
+	}
+	fs, err := posix.Open(root, -1, -1)
+	if err != nil {
+		t.Fatalf("cannot init export filesystem: %v", err)
+	}
+
+	s, err := NewServer(nil, WithExport("data", Export{FileSystem: fs}))
+	if err != nil {
+		t.Fatalf("server: unexpected error: %v", err)
+	}
+	server, client := net.Pipe()
+	sess := newSession(s.exports, s.qids, server, proto.MaxMessageSize, proto.MaxDataSize)
+	go sess.serve()
+	defer sess.Close()
+
+	c, err := newClient(client)
+	if err != nil {
+		t.Fatalf("client: cannot initialize connection: %v", err)
+	}
+	defer c.Close()
+	if err = c.handshake(proto.Version); err != nil {
+		t.Fatalf("client: handshake failed: %v", err)
+	}
+
+	f, err := c.Attach(nil, "/data/dir", "root", proto.NoUid)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	checkFidIsDir(t, f)
+	f.Close()
+
+	if _, err = c.Attach(nil, "/unknown", "root", proto.NoUid); err != unix.ENXIO {
+		t.Fatalf("attach: expected error %v, got %v", unix.ENXIO, err)
+	}
+}
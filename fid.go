@@ -1,10 +1,15 @@
 package ninep
 
 import (
+	"context"
 	"errors"
+	"io"
+	"math"
 	"os"
 	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/azmodb/ninep/proto"
@@ -17,6 +22,7 @@ type fileInfo struct {
 	*proto.Rgetattr
 	path   string
 	iounit uint32
+	uid    uint32 // of the user who attached the file tree
 }
 
 func (fi fileInfo) Size() int64      { return int64(fi.Rgetattr.Size) }
@@ -50,8 +56,16 @@ type Fid struct {
 
 	mu      sync.Mutex // protects following
 	fi      *fileInfo
+	dir     *dirReader
 	opened  bool
 	closing bool
+
+	// clones of the opened fid on the other connections of the pool,
+	// created by stripes. Cloning is closed once the clones being
+	// opened have been published.
+	clones  []*Fid
+	striped bool
+	cloning chan struct{}
 }
 
 // Num returns the numerical fid identifier.
@@ -60,16 +74,27 @@ func (f *Fid) Num() uint32 { return f.num }
 // Close informs the file server that the current file represented by
 // fid is no longer needed by the client.
 func (f *Fid) Close() error {
+	return f.CloseContext(context.Background())
+}
+
+// CloseContext is like Close but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) CloseContext(ctx context.Context) error {
 	f.mu.Lock()
-	err := f.clunk()
+	err := f.clunk(ctx)
 	f.mu.Unlock()
 	return err
 }
 
-func (f *Fid) clunk() error {
+func (f *Fid) clunk(ctx context.Context) error {
 	if f.closing {
 		return errFidNotOpened
 	}
+	if f.dir != nil {
+		f.dir.fid.clunk(ctx)
+		f.dir = nil
+	}
+	f.clunkClones(ctx)
 
 	f.opened = false
 	f.closing = true
@@ -77,8 +102,9 @@ func (f *Fid) clunk() error {
 	fcall := mustAlloc(proto.MessageTclunk)
 	tx := fcall.Tx.(*proto.Tclunk)
 	tx.Fid = f.num
-	err := f.c.rpc(fcall)
+	err := f.c.rpc(ctx, fcall)
 	proto.Release(fcall)
+	f.c.untrack(f.num)
 	return err
 }
 
@@ -86,55 +112,286 @@ func (f *Fid) clunk() error {
 // (search) permission is required on all of the directories in path
 // that lead to the file.
 func (f *Fid) Stat() (os.FileInfo, error) {
+	return f.StatContext(context.Background())
+}
+
+// StatContext is like Stat but aborts the request if ctx is done before
+// the server answered.
+func (f *Fid) StatContext(ctx context.Context) (os.FileInfo, error) {
 	f.mu.Lock()
-	attr, err := f.c.stat(f.num, proto.GetAttrBasic)
-	if err != nil {
-		f.mu.Unlock()
-		return nil, err
+	attr := f.c.cache.attr(f.fi.Qid, false)
+	if attr == nil {
+		var err error
+		if attr, err = f.c.stat(ctx, f.num, proto.GetAttrBasic); err != nil {
+			f.mu.Unlock()
+			return nil, err
+		}
+		f.c.cache.setAttr(attr)
 	}
 
-	fi := fileInfo{Rgetattr: attr, path: f.fi.path, iounit: f.fi.iounit}
+	fi := fileInfo{Rgetattr: attr, path: f.fi.path, iounit: f.fi.iounit, uid: f.fi.uid}
 	f.mu.Unlock()
 	return fi, nil
 }
 
-func (f *Fid) walk(names ...string) (uint32, *fileInfo, error) {
-	if len(names) > proto.MaxNames {
-		return 0, nil, unix.EINVAL
+// Statfs describes a file system and mirrors proto.Rstatfs. Sizes are
+// given in blocks of BlockSize bytes.
+type Statfs struct {
+	Type            uint32 // type of file system
+	BlockSize       uint32 // optimal transfer block size
+	Blocks          uint64 // total data blocks in file system
+	BlocksFree      uint64 // free blocks in file system
+	BlocksAvailable uint64 // free blocks available to unprivileged users
+	Files           uint64 // total file nodes in file system
+	FilesFree       uint64 // free file nodes in file system
+	FsID            uint64 // file system id
+	NameLength      uint32 // maximum length of filenames
+}
+
+// Total returns the size of the file system in bytes.
+func (s Statfs) Total() uint64 { return s.Blocks * uint64(s.BlockSize) }
+
+// Free returns the number of free bytes in the file system.
+func (s Statfs) Free() uint64 { return s.BlocksFree * uint64(s.BlockSize) }
+
+// Available returns the number of bytes available to unprivileged
+// users.
+func (s Statfs) Available() uint64 {
+	return s.BlocksAvailable * uint64(s.BlockSize)
+}
+
+// Used returns the number of used bytes in the file system.
+func (s Statfs) Used() uint64 { return s.Total() - s.Free() }
+
+// Inodes returns the total number of file nodes in the file system.
+func (s Statfs) Inodes() uint64 { return s.Files }
+
+// FreeInodes returns the number of free file nodes in the file system.
+func (s Statfs) FreeInodes() uint64 { return s.FilesFree }
+
+// Statfs returns information about the file system containing the file
+// represented by fid.
+func (f *Fid) Statfs() (Statfs, error) {
+	return f.StatfsContext(context.Background())
+}
+
+// StatfsContext is like Statfs but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) StatfsContext(ctx context.Context) (Statfs, error) {
+	fcall := mustAlloc(proto.MessageTstatfs)
+	defer proto.Release(fcall)
+
+	tx := fcall.Tx.(*proto.Tstatfs)
+	tx.Fid = f.num
+	if err := f.c.rpc(ctx, fcall); err != nil {
+		return Statfs{}, err
 	}
+	return Statfs(*fcall.Rx.(*proto.Rstatfs)), nil
+}
+
+// Attr describes file attributes changed by SetAttr. Valid is a bitmask
+// of proto.SetAttr* values selecting the fields to set.
+//
+// If Valid includes proto.SetAttrAtime but not proto.SetAttrAtimeSet
+// the server sets the access time to its current time and Atime is
+// ignored. The same applies to proto.SetAttrMtime,
+// proto.SetAttrMtimeSet and Mtime. proto.SetAttrAtimeSet and
+// proto.SetAttrMtimeSet imply proto.SetAttrAtime and
+// proto.SetAttrMtime.
+type Attr struct {
+	Valid uint32
+
+	Mode os.FileMode
+	Uid  int
+	Gid  int
+	Size int64
+
+	Atime time.Time
+	Mtime time.Time
+}
+
+// SetAttr changes the attributes of the file represented by fid
+// selected by attr.Valid.
+func (f *Fid) SetAttr(attr Attr) error {
+	return f.SetAttrContext(context.Background(), attr)
+}
+
+// SetAttrContext is like SetAttr but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) SetAttrContext(ctx context.Context, attr Attr) error {
+	f.mu.Lock()
+	err := f.setattr(ctx, attr)
+	f.mu.Unlock()
+	return err
+}
+
+// Chmod changes the mode of the file represented by fid to mode.
+func (f *Fid) Chmod(mode os.FileMode) error {
+	return f.ChmodContext(context.Background(), mode)
+}
+
+// ChmodContext is like Chmod but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) ChmodContext(ctx context.Context, mode os.FileMode) error {
+	return f.SetAttrContext(ctx, Attr{Valid: proto.SetAttrMode, Mode: mode})
+}
+
+// Chown changes the numeric uid and gid of the file represented by
+// fid. A uid or gid of -1 means to not change that value.
+func (f *Fid) Chown(uid, gid int) error {
+	return f.ChownContext(context.Background(), uid, gid)
+}
 
-	fidnum, ok := f.c.fid.Get()
-	if !ok {
-		return 0, nil, errFidOverflow
+// ChownContext is like Chown but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) ChownContext(ctx context.Context, uid, gid int) error {
+	attr := Attr{Uid: uid, Gid: gid}
+	if uid != -1 {
+		attr.Valid |= proto.SetAttrUid
+	}
+	if gid != -1 {
+		attr.Valid |= proto.SetAttrGid
 	}
+	return f.SetAttrContext(ctx, attr)
+}
 
-	fcall := mustAlloc(proto.MessageTwalk)
+// Truncate changes the size of the file represented by fid.
+func (f *Fid) Truncate(size int64) error {
+	return f.TruncateContext(context.Background(), size)
+}
+
+// TruncateContext is like Truncate but aborts the request if ctx is
+// done before the server answered.
+func (f *Fid) TruncateContext(ctx context.Context, size int64) error {
+	return f.SetAttrContext(ctx, Attr{Valid: proto.SetAttrSize, Size: size})
+}
+
+// Chtimes changes the access and modification times of the file
+// represented by fid.
+func (f *Fid) Chtimes(atime, mtime time.Time) error {
+	return f.ChtimesContext(context.Background(), atime, mtime)
+}
+
+// ChtimesContext is like Chtimes but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) ChtimesContext(ctx context.Context, atime, mtime time.Time) error {
+	return f.SetAttrContext(ctx, Attr{
+		Valid: proto.SetAttrAtimeSet | proto.SetAttrMtimeSet,
+		Atime: atime,
+		Mtime: mtime,
+	})
+}
+
+func (f *Fid) setattr(ctx context.Context, attr Attr) error {
+	valid := attr.Valid
+	if valid&proto.SetAttrAtimeSet != 0 {
+		valid |= proto.SetAttrAtime
+	}
+	if valid&proto.SetAttrMtimeSet != 0 {
+		valid |= proto.SetAttrMtime
+	}
+	if valid&proto.SetAttrUid != 0 && (attr.Uid < 0 || attr.Uid > math.MaxUint32) {
+		return errInvalidUid
+	}
+	if valid&proto.SetAttrGid != 0 && (attr.Gid < 0 || attr.Gid > math.MaxUint32) {
+		return errInvalidUid
+	}
+	if valid&proto.SetAttrSize != 0 && attr.Size < 0 {
+		return unix.EINVAL
+	}
+
+	fcall := mustAlloc(proto.MessageTsetattr)
 	defer proto.Release(fcall)
 
-	tx := fcall.Tx.(*proto.Twalk)
+	tx := fcall.Tx.(*proto.Tsetattr)
 	tx.Fid = f.num
-	tx.NewFid = uint32(fidnum)
-	tx.Names = names
-	if err := f.c.rpc(fcall); err != nil {
-		return 0, nil, err
+	tx.Valid = valid
+	tx.Mode = proto.NewMode(attr.Mode) &^ proto.ModeMask
+	tx.Uid = uint32(attr.Uid)
+	tx.Gid = uint32(attr.Gid)
+	tx.Size = uint64(attr.Size)
+	if valid&proto.SetAttrAtimeSet != 0 {
+		tx.Atime = unix.NsecToTimespec(attr.Atime.UnixNano())
 	}
-	rx := fcall.Rx.(*proto.Rwalk)
-	if len(*rx) != len(names) {
-		return 0, nil, unix.ENOENT
+	if valid&proto.SetAttrMtimeSet != 0 {
+		tx.Mtime = unix.NsecToTimespec(attr.Mtime.UnixNano())
 	}
+	if err := f.c.rpc(ctx, fcall); err != nil {
+		return err
+	}
+	f.c.cache.invalidateAttr(f.fi.Qid.Path)
 
-	attr, err := f.c.stat(tx.NewFid, proto.GetAttrBasic)
+	// refresh cached file attributes
+	stat, err := f.c.stat(ctx, f.num, proto.GetAttrBasic)
 	if err != nil {
-		return 0, nil, err
+		return err
+	}
+	f.c.cache.setAttr(stat)
+	f.fi.Rgetattr = stat
+	return nil
+}
+
+// walk walks the path elements names relative to fid and returns the
+// number and the attributes of the new fid. Paths with more than
+// proto.MaxNames elements are walked in several Twalk requests, the
+// intermediate fids are clunked.
+func (f *Fid) walk(ctx context.Context, names ...string) (uint32, *fileInfo, error) {
+	if _, found, ok := f.c.cache.resolve(f.fi.uid, f.fi.Qid, names); ok && !found {
+		return 0, nil, unix.ENOENT
+	}
+
+	num, elems := f.num, names
+	qid, fresh := f.fi.Qid, false
+	for {
+		batch := elems
+		if len(batch) > proto.MaxNames {
+			batch = batch[:proto.MaxNames]
+		}
+		newnum, qids, err := f.c.twalk(ctx, num, batch)
+		if num != f.num {
+			(&Fid{c: f.c, num: num}).clunk(context.Background())
+		}
+		if err == nil || err == unix.ENOENT {
+			f.c.cache.walked(f.fi.uid, qid, batch, qids)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		num, elems = newnum, elems[len(batch):]
+		if len(qids) > 0 {
+			qid, fresh = qids[len(qids)-1], true
+		}
+		if len(elems) == 0 {
+			break
+		}
+	}
+
+	attr := f.c.cache.attr(qid, fresh)
+	if attr == nil {
+		var err error
+		if attr, err = f.c.stat(ctx, num, proto.GetAttrBasic); err != nil {
+			(&Fid{c: f.c, num: num}).clunk(context.Background())
+			return 0, nil, err
+		}
+		f.c.cache.setAttr(attr)
 	}
 
 	path := path.Join(f.fi.path, path.Join(names...))
-	return tx.NewFid, &fileInfo{Rgetattr: attr, path: path}, nil
+	return num, &fileInfo{Rgetattr: attr, path: path, uid: f.fi.uid}, nil
 }
 
+// Walk returns a new fid representing the file reached by walking the
+// path elements names relative to the file represented by fid. If names
+// is empty, the new fid represents the same file as fid.
 func (f *Fid) Walk(names ...string) (*Fid, error) {
+	return f.WalkContext(context.Background(), names...)
+}
+
+// WalkContext is like Walk but aborts the request if ctx is done before
+// the server answered.
+func (f *Fid) WalkContext(ctx context.Context, names ...string) (*Fid, error) {
 	f.mu.Lock()
-	fidnum, fi, err := f.walk(names...)
+	fidnum, fi, err := f.walk(ctx, names...)
 	if err != nil {
 		f.mu.Unlock()
 		return nil, err
@@ -145,94 +402,204 @@ func (f *Fid) Walk(names ...string) (*Fid, error) {
 	return fid, nil
 }
 
-func (f *Fid) clone() (*Fid, error) {
-	fidnum, fi, err := f.walk()
+func (f *Fid) clone(ctx context.Context) (*Fid, error) {
+	fidnum, fi, err := f.walk(ctx)
 	if err != nil {
 		return nil, err
 	}
 	return &Fid{c: f.c, num: fidnum, fi: fi}, nil
 }
 
-/*
-func (f *Fid) parse(data []byte) ([]proto.Dirent, uint64, error) {
-	var ents []proto.Dirent
-	var offset uint64
-	var err error
+// maxPendingStats is the maximal number of concurrent attribute
+// requests issued by ReadDir.
+const maxPendingStats = 16
+
+// dirReader holds the state of a directory read by ReadDir.
+type dirReader struct {
+	fid    *Fid
+	offset uint64
+	ents   []proto.Dirent
+	eof    bool
+}
+
+func (d *dirReader) fill(ctx context.Context) error {
+	size, err := d.fid.iosize()
+	if err != nil {
+		return err
+	}
+
+	fcall := mustAlloc(proto.MessageTreaddir)
+	defer proto.Release(fcall)
+
+	tx := fcall.Tx.(*proto.Treaddir)
+	tx.Fid = d.fid.num
+	tx.Offset = d.offset
+	tx.Count = uint32(size)
+	if err = d.fid.c.rpc(ctx, fcall); err != nil {
+		return err
+	}
 
+	data := fcall.Rx.(*proto.Rreaddir).Data
+	if len(data) == 0 {
+		d.eof = true
+		return nil
+	}
 	for len(data) > 0 {
 		dirent := proto.Dirent{}
 		if data, err = dirent.Unmarshal(data); err != nil {
-			return ents, offset, err
+			return err
 		}
+		d.offset = dirent.Offset
 		if isReserved(dirent.Name) {
 			continue
 		}
-
-		ents = append(ents, dirent)
-		offset = dirent.Offset
+		d.ents = append(d.ents, dirent)
 	}
-	return ents, offset, err
+	return nil
 }
 
-func (f *Fid) readDirent(n int) (ents []proto.Dirent, err error) {
-	tx := &proto.Treaddir{Fid: f.num, Offset: 0, Count: f.c.maxDataSize}
-	rx := &proto.Rreaddir{}
-
-	for {
-		rx.Reset()
-		if err = f.c.rpc(tx, rx); err != nil {
-			if err == unix.EIO {
+// next returns up to n directory entries. If n <= 0, next returns all
+// remaining directory entries.
+func (d *dirReader) next(ctx context.Context, n int) ([]proto.Dirent, error) {
+	var ents []proto.Dirent
+	for n <= 0 || len(ents) < n {
+		if len(d.ents) == 0 {
+			if d.eof {
 				break
 			}
-			return nil, err
+			if err := d.fill(ctx); err != nil {
+				return ents, err
+			}
+			continue
 		}
-		if len(rx.Data) < proto.FixedDirentSize {
-			break
+
+		count := len(d.ents)
+		if n > 0 && count > n-len(ents) {
+			count = n - len(ents)
 		}
+		ents = append(ents, d.ents[:count]...)
+		d.ents = d.ents[count:]
+	}
+	return ents, nil
+}
+
+// ReadDir reads the contents of the directory represented by fid and
+// returns a slice of up to n FileInfo values, in directory order.
+// Subsequent calls on the same fid will yield further FileInfos.
+//
+// If n > 0, ReadDir returns at most n FileInfo structures. In this
+// case, if ReadDir returns an empty slice, it will return a non-nil
+// error explaining why. At the end of a directory, the error is io.EOF.
+//
+// If n <= 0, ReadDir returns all the FileInfo from the directory in a
+// single slice. In this case, if ReadDir succeeds (reads all the way to
+// the end of the directory), it returns the slice and a nil error.
+//
+// The attributes of the directory entries are requested concurrently.
+func (f *Fid) ReadDir(n int) ([]os.FileInfo, error) {
+	return f.ReadDirContext(context.Background(), n)
+}
+
+// ReadDirContext is like ReadDir but aborts the requests if ctx is done
+// before the server answered.
+func (f *Fid) ReadDirContext(ctx context.Context, n int) ([]os.FileInfo, error) {
+	f.mu.Lock()
+	info, err := f.readDir(ctx, n)
+	f.mu.Unlock()
+	return info, err
+}
 
-		entries, offset, err := f.parse(rx.Data)
+// readDirents returns up to n entries of the directory represented by
+// fid, without their attributes. See ReadDir for the meaning of n.
+func (f *Fid) readDirents(ctx context.Context, n int) ([]proto.Dirent, error) {
+	if f.dir == nil {
+		clone, err := f.clone(ctx)
 		if err != nil {
 			return nil, err
 		}
-		tx.Offset = offset
-		ents = append(ents, entries...)
+		if err = clone.open(ctx, os.O_RDONLY); err != nil {
+			clone.clunk(context.Background())
+			return nil, err
+		}
+		f.dir = &dirReader{fid: clone}
 	}
-	return ents, nil
-}
 
-func (f *Fid) readDir(n int) (info []os.FileInfo, err error) {
-	clone, err := f.clone()
-	if err != nil {
-		return nil, err
+	ents, err := f.dir.next(ctx, n)
+	if err == nil && n > 0 && len(ents) == 0 {
+		err = io.EOF
 	}
-	defer clone.clunk()
+	return ents, err
+}
 
-	if err = clone.open(os.O_RDONLY); err != nil {
-		return nil, err
+func (f *Fid) readDir(ctx context.Context, n int) ([]os.FileInfo, error) {
+	var info []os.FileInfo
+	for {
+		ents, err := f.readDirents(ctx, n)
+		if err != nil && len(ents) == 0 {
+			return info, err
+		}
+
+		fi, statErr := f.statDirents(ctx, ents)
+		info = append(info, fi...)
+		if statErr != nil {
+			return info, statErr
+		}
+		if err != nil {
+			return info, err
+		}
+
+		// Entries may have been removed meanwhile, continue until
+		// at least one entry was found or the end of the directory
+		// was reached.
+		if n <= 0 || len(info) > 0 {
+			return info, nil
+		}
 	}
+}
 
-	ents, err := clone.readDirent(n)
-	if err != nil {
-		return nil, err
+func (f *Fid) statDirents(ctx context.Context, ents []proto.Dirent) ([]os.FileInfo, error) {
+	infos := make([]*fileInfo, len(ents))
+	errs := make([]error, len(ents))
+
+	var wg sync.WaitGroup
+	pending := make(chan struct{}, maxPendingStats)
+	for i := range ents {
+		wg.Add(1)
+		pending <- struct{}{}
+		go func(i int) {
+			infos[i], errs[i] = f.lstat(ctx, ents[i].Name)
+			<-pending
+			wg.Done()
+		}(i)
 	}
+	wg.Wait()
 
-	for _, dirent := range ents {
-		_, fi, err := f.walk(dirent.Name)
-		if err != nil {
-			return nil, err
+	info := make([]os.FileInfo, 0, len(ents))
+	for i, fi := range infos {
+		switch errs[i] {
+		case nil:
+			info = append(info, *fi)
+		case unix.ENOENT: // removed meanwhile
+		default:
+			return info, errs[i]
 		}
-		info = append(info, fi)
 	}
-	return info, err
+	return info, nil
 }
 
-func (f *Fid) ReadDir(n int) ([]os.FileInfo, error) {
-	f.mu.Lock()
-	info, err := f.readDir(n)
-	f.mu.Unlock()
-	return info, err
+// lstat returns the attributes of the named file in the directory
+// represented by fid.
+func (f *Fid) lstat(ctx context.Context, name string) (*fileInfo, error) {
+	if fi, ok, err := f.cachedLstat([]string{name}); ok {
+		return fi, err
+	}
+	fidnum, fi, err := f.walk(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	(&Fid{c: f.c, num: fidnum}).clunk(context.Background())
+	return fi, nil
 }
-*/
 
 // Create asks the file server to create a new file with the name
 // supplied, in the directory represented by fid, and requires write
@@ -241,17 +608,24 @@ func (f *Fid) ReadDir(n int) ([]os.FileInfo, error) {
 // Finally, the newly created file is opened according to perm, and fid
 // will represent the newly opened file.
 func (f *Fid) Create(name string, flags int, perm os.FileMode) error {
+	return f.CreateContext(context.Background(), name, flags, perm)
+}
+
+// CreateContext is like Create but aborts the request if ctx is done
+// before the server answered. If the server created the file
+// nonetheless, fid is clunked.
+func (f *Fid) CreateContext(ctx context.Context, name string, flags int, perm os.FileMode) error {
 	if isReserved(name) {
 		return errInvalildName
 	}
 
 	f.mu.Lock()
-	err := f.create(name, flags, perm)
+	err := f.create(ctx, name, flags, perm)
 	f.mu.Unlock()
 	return err
 }
 
-func (f *Fid) create(name string, flags int, perm os.FileMode) error {
+func (f *Fid) create(ctx context.Context, name string, flags int, perm os.FileMode) error {
 	fcall := mustAlloc(proto.MessageTlcreate)
 	defer proto.Release(fcall)
 
@@ -261,13 +635,21 @@ func (f *Fid) create(name string, flags int, perm os.FileMode) error {
 	tx.Flags = proto.NewFlag(flags)
 	tx.Perm = proto.NewMode(perm)
 	tx.Gid = f.fi.Gid
-	if err := f.c.rpc(fcall); err != nil {
+	if err := f.c.rpc(ctx, fcall); err != nil {
 		return err
 	}
+	f.c.cache.invalidate(f.fi.Qid.Path, name)
 
+	// fid represents the new file now, whose attributes are unknown
 	rx := fcall.Rx.(*proto.Rlcreate)
-	f.fi.iounit = rx.Iounit
+	f.fi = &fileInfo{
+		Rgetattr: &proto.Rgetattr{Qid: rx.Qid, Stat_t: &unix.Stat_t{}},
+		path:     path.Join(f.fi.path, name),
+		iounit:   rx.Iounit,
+		uid:      f.fi.uid,
+	}
 	f.opened = true
+	f.c.trackOpen(f.num, name, flags)
 	return nil
 }
 
@@ -275,13 +657,19 @@ func (f *Fid) create(name string, flags int, perm os.FileMode) error {
 // supplied, in the directory represented by fid, and requires write
 // permission in the directory.
 func (f *Fid) Mkdir(name string, perm os.FileMode) error {
+	return f.MkdirContext(context.Background(), name, perm)
+}
+
+// MkdirContext is like Mkdir but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) MkdirContext(ctx context.Context, name string, perm os.FileMode) error {
 	f.mu.Lock()
-	err := f.mkdir(name, perm)
+	err := f.mkdir(ctx, name, perm)
 	f.mu.Unlock()
 	return err
 }
 
-func (f *Fid) mkdir(name string, perm os.FileMode) error {
+func (f *Fid) mkdir(ctx context.Context, name string, perm os.FileMode) error {
 	if isReserved(name) {
 		return errInvalildName
 	}
@@ -292,21 +680,31 @@ func (f *Fid) mkdir(name string, perm os.FileMode) error {
 	tx.Name = name
 	tx.Perm = proto.NewMode(perm)
 	tx.Gid = f.fi.Gid
-	err := f.c.rpc(fcall)
+	err := f.c.rpc(ctx, fcall)
 	proto.Release(fcall)
+	if err == nil {
+		f.c.cache.invalidate(f.fi.Qid.Path, name)
+	}
 	return err
 }
 
 // Open opens the file represented by fid with specified flags
 // (os.O_RDONLY etc.). If successful, it can be used for I/O.
 func (f *Fid) Open(flags int) error {
+	return f.OpenContext(context.Background(), flags)
+}
+
+// OpenContext is like Open but aborts the request if ctx is done
+// before the server answered. If the server opened the file
+// nonetheless, fid is clunked.
+func (f *Fid) OpenContext(ctx context.Context, flags int) error {
 	f.mu.Lock()
-	err := f.open(flags)
+	err := f.open(ctx, flags)
 	f.mu.Unlock()
 	return err
 }
 
-func (f *Fid) open(flags int) error {
+func (f *Fid) open(ctx context.Context, flags int) error {
 	if f.opened {
 		return errFidOpened
 	}
@@ -317,13 +715,18 @@ func (f *Fid) open(flags int) error {
 	tx := fcall.Tx.(*proto.Tlopen)
 	tx.Fid = f.num
 	tx.Flags = proto.NewFlag(flags)
-	if err := f.c.rpc(fcall); err != nil {
+	if err := f.c.rpc(ctx, fcall); err != nil {
 		return err
 	}
 
+	if flags&os.O_TRUNC != 0 {
+		f.c.cache.invalidateAttr(f.fi.Qid.Path)
+	}
+
 	rx := fcall.Rx.(*proto.Rlopen)
 	f.fi.iounit = rx.Iounit
 	f.opened = true
+	f.c.trackOpen(f.num, "", flags)
 	return nil
 }
 
@@ -335,16 +738,23 @@ func (f *Fid) open(flags int) error {
 // It is correct to consider remove to be a clunk with the side effect
 // of removing the file if permissions allow.
 func (f *Fid) Remove() error {
+	return f.RemoveContext(context.Background())
+}
+
+// RemoveContext is like Remove but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) RemoveContext(ctx context.Context) error {
 	f.mu.Lock()
-	err := f.remove()
+	err := f.remove(ctx)
 	f.mu.Unlock()
 	return err
 }
 
-func (f *Fid) remove() error {
+func (f *Fid) remove(ctx context.Context) error {
 	if !f.opened {
 		return errFidNotOpened
 	}
+	f.clunkClones(ctx)
 
 	f.opened = false
 	f.closing = true
@@ -352,36 +762,559 @@ func (f *Fid) remove() error {
 	fcall := mustAlloc(proto.MessageTremove)
 	tx := fcall.Tx.(*proto.Tremove)
 	tx.Fid = f.num
-	err := f.c.rpc(fcall)
+	err := f.c.rpc(ctx, fcall)
 	proto.Release(fcall)
+	f.c.untrack(f.num)
+	if err == nil {
+		f.c.cache.forget(f.fi.Qid.Path)
+	}
 	return err
 }
 
+// ReadAt reads len(p) bytes from the file represented by fid starting
+// at byte offset. It returns the number of bytes read and the error, if
+// any. ReadAt always returns a non-nil error when n < len(p). At end of
+// file, that error is io.EOF.
+//
+// Requests are split at the iounit returned by the server or at the
+// maximal data size of the connection. The fid must have been opened.
+// If the client uses several connections, the requests are striped
+// across them.
 func (f *Fid) ReadAt(p []byte, offset int64) (int, error) {
-	return 0, unix.ENOTSUP
+	return f.ReadAtContext(context.Background(), p, offset)
+}
+
+// ReadAtContext is like ReadAt but aborts the requests if ctx is done
+// before the server answered.
+func (f *Fid) ReadAtContext(ctx context.Context, p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, unix.EINVAL
+	}
+
+	size, err := f.iosize()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	if len(p) > size {
+		if fids, ssize := f.stripes(ctx, size); len(fids) > 1 {
+			if n, err = stripe(ctx, fids, p, offset, ssize, (*Fid).read); err != nil {
+				return n, err
+			}
+		}
+	}
+	for n < len(p) {
+		count := len(p) - n
+		if count > size {
+			count = size
+		}
+
+		m, err := f.read(ctx, p[n:n+count], offset+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+func (f *Fid) read(ctx context.Context, p []byte, offset int64) (int, error) {
+	fcall := mustAlloc(proto.MessageTread)
+	defer proto.Release(fcall)
+
+	tx := fcall.Tx.(*proto.Tread)
+	tx.Fid = f.num
+	tx.Offset = uint64(offset)
+	tx.Count = uint32(len(p))
+	if err := f.c.rpc(ctx, fcall); err != nil {
+		return 0, err
+	}
+
+	rx := fcall.Rx.(*proto.Rread)
+	if len(rx.Data) > len(p) {
+		return 0, unix.EIO
+	}
+	return copy(p, rx.Data), nil
 }
 
+// WriteAt writes len(p) bytes to the file represented by fid starting
+// at byte offset. It returns the number of bytes written and the error,
+// if any. WriteAt returns a non-nil error when n != len(p).
+//
+// Requests are split at the iounit returned by the server or at the
+// maximal data size of the connection. The fid must have been opened.
+// If the client uses several connections, the requests are striped
+// across them.
 func (f *Fid) WriteAt(p []byte, offset int64) (int, error) {
-	return 0, unix.ENOTSUP
+	return f.WriteAtContext(context.Background(), p, offset)
 }
 
-func (f *Fid) Link(oldname, newname string) error {
-	return unix.ENOTSUP
+// WriteAtContext is like WriteAt but aborts the requests if ctx is done
+// before the server answered.
+func (f *Fid) WriteAtContext(ctx context.Context, p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, unix.EINVAL
+	}
+
+	size, err := f.iosize()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	if len(p) > size {
+		if fids, ssize := f.stripes(ctx, size); len(fids) > 1 {
+			if n, err = stripe(ctx, fids, p, offset, ssize, (*Fid).write); err != nil {
+				return n, err
+			}
+		}
+	}
+	for n < len(p) {
+		count := len(p) - n
+		if count > size {
+			count = size
+		}
+
+		m, err := f.write(ctx, p[n:n+count], offset+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
 }
 
-func (f *Fid) Mknod(name string, perm os.FileMode, major, minor uint32) error {
-	return unix.ENOTSUP
+func (f *Fid) write(ctx context.Context, p []byte, offset int64) (int, error) {
+	fcall := mustAlloc(proto.MessageTwrite)
+	defer proto.Release(fcall)
+
+	tx := fcall.Tx.(*proto.Twrite)
+	tx.Fid = f.num
+	tx.Offset = uint64(offset)
+	tx.Data = p
+	err := f.c.rpc(ctx, fcall)
+	if f.c.cache != nil {
+		f.mu.Lock()
+		f.c.cache.invalidateAttr(f.fi.Qid.Path)
+		f.mu.Unlock()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	rx := fcall.Rx.(*proto.Rwrite)
+	if int(rx.Count) > len(p) {
+		return 0, unix.EIO
+	}
+	return int(rx.Count), nil
 }
 
+// iosize returns the maximal number of bytes transferred by a single
+// read or write request.
+func (f *Fid) iosize() (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.opened {
+		return 0, errFidNotOpened
+	}
+	size := f.c.maxDataSize
+	if f.fi.iounit > 0 && f.fi.iounit < size {
+		size = f.fi.iounit
+	}
+	return int(size), nil
+}
+
+// Symlink creates a symbolic link with the name supplied, in the
+// directory represented by fid, pointing to target. It returns the Qid
+// of the new symbolic link.
+func (f *Fid) Symlink(name, target string) (proto.Qid, error) {
+	return f.SymlinkContext(context.Background(), name, target)
+}
+
+// SymlinkContext is like Symlink but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) SymlinkContext(ctx context.Context, name, target string) (proto.Qid, error) {
+	if isReserved(name) || target == "" {
+		return proto.Qid{}, errInvalildName
+	}
+
+	f.mu.Lock()
+	qid, err := f.symlink(ctx, name, target)
+	f.mu.Unlock()
+	return qid, err
+}
+
+func (f *Fid) symlink(ctx context.Context, name, target string) (proto.Qid, error) {
+	fcall := mustAlloc(proto.MessageTsymlink)
+	defer proto.Release(fcall)
+
+	tx := fcall.Tx.(*proto.Tsymlink)
+	tx.DirectoryFid = f.num
+	tx.Name = name
+	tx.Target = target
+	tx.Gid = f.fi.Gid
+	if err := f.c.rpc(ctx, fcall); err != nil {
+		return proto.Qid{}, err
+	}
+	f.c.cache.invalidate(f.fi.Qid.Path, name)
+	return fcall.Rx.(*proto.Rsymlink).Qid, nil
+}
+
+// Mknod creates a device node, named pipe or socket with the name
+// supplied, in the directory represented by fid. The type of the file
+// is taken from mode, major and minor are the device numbers of
+// character and block devices. It returns the Qid of the new file.
+func (f *Fid) Mknod(name string, mode os.FileMode, major, minor uint32) (proto.Qid, error) {
+	return f.MknodContext(context.Background(), name, mode, major, minor)
+}
+
+// MknodContext is like Mknod but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) MknodContext(ctx context.Context, name string, mode os.FileMode, major, minor uint32) (proto.Qid, error) {
+	if isReserved(name) {
+		return proto.Qid{}, errInvalildName
+	}
+	if mode&(os.ModeDir|os.ModeSymlink) != 0 {
+		return proto.Qid{}, unix.EINVAL
+	}
+
+	f.mu.Lock()
+	qid, err := f.mknod(ctx, name, mode, major, minor)
+	f.mu.Unlock()
+	return qid, err
+}
+
+func (f *Fid) mknod(ctx context.Context, name string, mode os.FileMode, major, minor uint32) (proto.Qid, error) {
+	fcall := mustAlloc(proto.MessageTmknod)
+	defer proto.Release(fcall)
+
+	tx := fcall.Tx.(*proto.Tmknod)
+	tx.DirectoryFid = f.num
+	tx.Name = name
+	tx.Perm = proto.NewMode(mode)
+	tx.Major = major
+	tx.Minor = minor
+	tx.Gid = f.fi.Gid
+	if err := f.c.rpc(ctx, fcall); err != nil {
+		return proto.Qid{}, err
+	}
+	f.c.cache.invalidate(f.fi.Qid.Path, name)
+	return fcall.Rx.(*proto.Rmknod).Qid, nil
+}
+
+// Link creates a hard link with the name supplied, in the directory
+// represented by fid, to the file represented by target. It returns the
+// Qid of the linked file.
+func (f *Fid) Link(target *Fid, name string) (proto.Qid, error) {
+	return f.LinkContext(context.Background(), target, name)
+}
+
+// LinkContext is like Link but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) LinkContext(ctx context.Context, target *Fid, name string) (proto.Qid, error) {
+	if isReserved(name) {
+		return proto.Qid{}, errInvalildName
+	}
+
+	f.mu.Lock()
+	qid, err := f.link(ctx, target, name)
+	f.mu.Unlock()
+	return qid, err
+}
+
+func (f *Fid) link(ctx context.Context, target *Fid, name string) (proto.Qid, error) {
+	fcall := mustAlloc(proto.MessageTlink)
+	tx := fcall.Tx.(*proto.Tlink)
+	tx.DirectoryFid = f.num
+	tx.Target = target.num
+	tx.Name = name
+	err := f.c.rpc(ctx, fcall)
+	proto.Release(fcall)
+	if err != nil {
+		return proto.Qid{}, err
+	}
+	f.c.cache.invalidate(f.fi.Qid.Path, name)
+	f.c.cache.invalidateAttr(target.fi.Qid.Path)
+
+	// Rlink does not carry a Qid, ask for the attributes of the link.
+	fi, err := f.lstat(ctx, name)
+	if err != nil {
+		return proto.Qid{}, err
+	}
+	return fi.Qid, nil
+}
+
+// Rename renames (moves) oldpath to newpath. Both paths are relative to
+// the directory represented by fid.
 func (f *Fid) Rename(oldpath, newpath string) error {
-	return unix.ENOTSUP
+	return f.RenameContext(context.Background(), oldpath, newpath)
+}
+
+// RenameContext is like Rename but aborts the requests if ctx is done
+// before the server answered.
+func (f *Fid) RenameContext(ctx context.Context, oldpath, newpath string) error {
+	olddir, oldname := path.Split(path.Clean(oldpath))
+	newdir, newname := path.Split(path.Clean(newpath))
+	if isReserved(oldname) || isReserved(newname) || path.IsAbs(oldpath) || path.IsAbs(newpath) {
+		return errInvalildName
+	}
+
+	f.mu.Lock()
+	err := f.rename(ctx, olddir, oldname, newdir, newname)
+	f.mu.Unlock()
+	return err
 }
 
+func (f *Fid) rename(ctx context.Context, olddir, oldname, newdir, newname string) error {
+	oldfid, err := f.walkDir(ctx, olddir)
+	if err != nil {
+		return err
+	}
+	defer oldfid.release(f)
+
+	newfid, err := f.walkDir(ctx, newdir)
+	if err != nil {
+		return err
+	}
+	defer newfid.release(f)
+
+	return oldfid.renameat(ctx, oldname, newfid, newname)
+}
+
+// walkDir returns a fid representing the directory dir relative to
+// fid. If dir is empty, fid itself is returned.
+func (f *Fid) walkDir(ctx context.Context, dir string) (*Fid, error) {
+	names := splitPath(dir)
+	if len(names) == 0 {
+		return f, nil
+	}
+	fidnum, fi, err := f.walk(ctx, names...)
+	if err != nil {
+		return nil, err
+	}
+	return &Fid{c: f.c, num: fidnum, fi: fi}, nil
+}
+
+// release clunks fid unless it is parent.
+func (f *Fid) release(parent *Fid) {
+	if f != parent {
+		f.clunk(context.Background())
+	}
+}
+
+// Renameat renames oldname in the directory represented by fid to
+// newname in the directory represented by newdir.
+//
+// If the server does not support Trenameat, Renameat falls back to
+// Trename for this and all subsequent requests of the client.
+func (f *Fid) Renameat(oldname string, newdir *Fid, newname string) error {
+	return f.RenameatContext(context.Background(), oldname, newdir, newname)
+}
+
+// RenameatContext is like Renameat but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) RenameatContext(ctx context.Context, oldname string, newdir *Fid, newname string) error {
+	if isReserved(oldname) || isReserved(newname) {
+		return errInvalildName
+	}
+
+	f.mu.Lock()
+	err := f.renameat(ctx, oldname, newdir, newname)
+	f.mu.Unlock()
+	return err
+}
+
+func (f *Fid) renameat(ctx context.Context, oldname string, newdir *Fid, newname string) error {
+	if atomic.LoadUint32(&f.c.noRenameat) == 0 {
+		fcall := mustAlloc(proto.MessageTrenameat)
+		tx := fcall.Tx.(*proto.Trenameat)
+		tx.OldDirectoryFid = f.num
+		tx.OldName = oldname
+		tx.NewDirectoryFid = newdir.num
+		tx.NewName = newname
+		err := f.c.rpc(ctx, fcall)
+		proto.Release(fcall)
+		if err == nil {
+			f.renamed(oldname, newdir, newname)
+		}
+		if !isNotSupported(err) {
+			return err
+		}
+		atomic.StoreUint32(&f.c.noRenameat, 1)
+	}
+
+	fidnum, _, err := f.walk(ctx, oldname)
+	if err != nil {
+		return err
+	}
+	defer (&Fid{c: f.c, num: fidnum}).clunk(context.Background())
+
+	fcall := mustAlloc(proto.MessageTrename)
+	tx := fcall.Tx.(*proto.Trename)
+	tx.Fid = fidnum
+	tx.DirectoryFid = newdir.num
+	tx.Name = newname
+	err = f.c.rpc(ctx, fcall)
+	proto.Release(fcall)
+	if err == nil {
+		f.renamed(oldname, newdir, newname)
+	}
+	return err
+}
+
+// renamed updates the state of the client after oldname in the
+// directory represented by fid was renamed to newname in newdir.
+func (f *Fid) renamed(oldname string, newdir *Fid, newname string) {
+	f.c.trackRename(f.num, oldname, newdir.num, newname)
+	f.c.cache.invalidate(f.fi.Qid.Path, oldname)
+	f.c.cache.invalidate(newdir.fi.Qid.Path, newname)
+}
+
+// Unlinkat removes name from the directory represented by fid. If flags
+// contains unix.AT_REMOVEDIR, name must be an empty directory,
+// otherwise name must not be a directory.
+//
+// If the server does not support Tunlinkat, Unlinkat falls back to
+// Tremove for this and all subsequent requests of the client.
+func (f *Fid) Unlinkat(name string, flags int) error {
+	return f.UnlinkatContext(context.Background(), name, flags)
+}
+
+// UnlinkatContext is like Unlinkat but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) UnlinkatContext(ctx context.Context, name string, flags int) error {
+	if isReserved(name) {
+		return errInvalildName
+	}
+	if flags&^unix.AT_REMOVEDIR != 0 {
+		return unix.EINVAL
+	}
+
+	f.mu.Lock()
+	err := f.unlinkat(ctx, name, flags&unix.AT_REMOVEDIR != 0)
+	f.mu.Unlock()
+	return err
+}
+
+func (f *Fid) unlinkat(ctx context.Context, name string, rmdir bool) error {
+	if atomic.LoadUint32(&f.c.noUnlinkat) == 0 {
+		fcall := mustAlloc(proto.MessageTunlinkat)
+		tx := fcall.Tx.(*proto.Tunlinkat)
+		tx.DirectoryFid = f.num
+		tx.Name = name
+		if rmdir {
+			tx.Flags = proto.FlagRemoveDir
+		}
+		err := f.c.rpc(ctx, fcall)
+		proto.Release(fcall)
+		if err == nil {
+			f.c.cache.invalidate(f.fi.Qid.Path, name)
+		}
+		if !isNotSupported(err) {
+			return err
+		}
+		atomic.StoreUint32(&f.c.noUnlinkat, 1)
+	}
+
+	fidnum, fi, err := f.walk(ctx, name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() != rmdir {
+		(&Fid{c: f.c, num: fidnum}).clunk(context.Background())
+		if rmdir {
+			return unix.ENOTDIR
+		}
+		return unix.EISDIR
+	}
+
+	// Tremove clunks the fid, even if the remove fails.
+	fcall := mustAlloc(proto.MessageTremove)
+	tx := fcall.Tx.(*proto.Tremove)
+	tx.Fid = fidnum
+	err = f.c.rpc(ctx, fcall)
+	proto.Release(fcall)
+	f.c.untrack(fidnum)
+	if err == nil {
+		f.c.cache.invalidate(f.fi.Qid.Path, name)
+		f.c.cache.forget(fi.Qid.Path)
+	}
+	return err
+}
+
+// ReadLink returns the target of the named symbolic link relative to
+// the directory represented by fid. If name is empty, fid itself must
+// represent a symbolic link.
 func (f *Fid) ReadLink(name string) (string, error) {
-	return "", unix.ENOTSUP
+	return f.ReadLinkContext(context.Background(), name)
+}
+
+// ReadLinkContext is like ReadLink but aborts the requests if ctx is
+// done before the server answered.
+func (f *Fid) ReadLinkContext(ctx context.Context, name string) (string, error) {
+	f.mu.Lock()
+	target, err := f.readLink(ctx, name)
+	f.mu.Unlock()
+	return target, err
+}
+
+func (f *Fid) readLink(ctx context.Context, name string) (string, error) {
+	fidnum, _, err := f.walk(ctx, splitPath(name)...)
+	if err != nil {
+		return "", err
+	}
+	defer (&Fid{c: f.c, num: fidnum}).clunk(context.Background())
+
+	fcall := mustAlloc(proto.MessageTreadlink)
+	defer proto.Release(fcall)
+
+	tx := fcall.Tx.(*proto.Treadlink)
+	tx.Fid = fidnum
+	if err = f.c.rpc(ctx, fcall); err != nil {
+		return "", err
+	}
+	return fcall.Rx.(*proto.Rreadlink).Target, nil
+}
+
+// Sync commits the current contents of the file represented by fid to
+// stable storage. The fid must have been opened.
+func (f *Fid) Sync() error {
+	return f.SyncContext(context.Background())
+}
+
+// SyncContext is like Sync but aborts the request if ctx is done before
+// the server answered.
+func (f *Fid) SyncContext(ctx context.Context) error {
+	f.mu.Lock()
+	opened := f.opened
+	f.mu.Unlock()
+	if !opened {
+		return errFidNotOpened
+	}
+
+	fcall := mustAlloc(proto.MessageTfsync)
+	defer proto.Release(fcall)
+
+	fcall.Tx.(*proto.Tfsync).Fid = f.num
+	return f.c.rpc(ctx, fcall)
 }
 
-func (f *Fid) Sync() error { return unix.ENOTSUP }
+// splitPath splits the slash-separated path name into its elements.
+func splitPath(name string) []string {
+	name = strings.Trim(path.Clean(name), separator)
+	if name == "" || name == "." {
+		return nil
+	}
+	return strings.Split(name, separator)
+}
 
 // isReserved returns whetever name is a reserved filesystem name.
 func isReserved(name string) bool {
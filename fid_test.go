@@ -0,0 +1,767 @@
+package ninep
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/azmodb/ninep/posix"
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+// mockFile serves a single regular file. Replies to read requests are
+// limited to maxRead bytes to force short reads.
+type mockFile struct {
+	mu      sync.Mutex
+	data    []byte
+	iounit  uint32
+	maxRead int
+	counts  []int
+
+	perm     proto.Mode
+	uid, gid uint32
+	mtime    unix.Timespec
+	setattrs []proto.Tsetattr
+}
+
+func (m *mockFile) handle(tx, rx proto.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch tx := tx.(type) {
+	case *proto.Tlattach, *proto.Tclunk:
+	case *proto.Tgetattr:
+		st := &unix.Stat_t{
+			Mode: unix.S_IFREG,
+			Uid:  m.uid,
+			Gid:  m.gid,
+			Size: int64(len(m.data)),
+			Mtim: m.mtime,
+		}
+		setPerm(st, m.perm)
+		rx.(*proto.Rgetattr).Stat_t = st
+	case *proto.Tsetattr:
+		m.setattrs = append(m.setattrs, *tx)
+		if tx.Valid&proto.SetAttrMode != 0 {
+			m.perm = tx.Mode
+		}
+		if tx.Valid&proto.SetAttrUid != 0 {
+			m.uid = tx.Uid
+		}
+		if tx.Valid&proto.SetAttrGid != 0 {
+			m.gid = tx.Gid
+		}
+		if tx.Valid&proto.SetAttrSize != 0 {
+			m.data = append(m.data, make([]byte, int(tx.Size))...)[:tx.Size]
+		}
+		if tx.Valid&proto.SetAttrMtimeSet != 0 {
+			m.mtime = tx.Mtime
+		}
+	case *proto.Twalk:
+		for range tx.Names {
+			*rx.(*proto.Rwalk) = append(*rx.(*proto.Rwalk), proto.Qid{})
+		}
+	case *proto.Tlopen:
+		rx.(*proto.Rlopen).Iounit = m.iounit
+	case *proto.Tread:
+		m.counts = append(m.counts, int(tx.Count))
+		if tx.Offset >= uint64(len(m.data)) {
+			return nil
+		}
+		data := m.data[tx.Offset:]
+		if len(data) > int(tx.Count) {
+			data = data[:tx.Count]
+		}
+		if m.maxRead > 0 && len(data) > m.maxRead {
+			data = data[:m.maxRead]
+		}
+		rx.(*proto.Rread).Data = data
+	case *proto.Twrite:
+		m.counts = append(m.counts, len(tx.Data))
+		if end := int(tx.Offset) + len(tx.Data); end > len(m.data) {
+			m.data = append(m.data, make([]byte, end-len(m.data))...)
+		}
+		copy(m.data[tx.Offset:], tx.Data)
+		rx.(*proto.Rwrite).Count = uint32(len(tx.Data))
+	default:
+		return unix.ENOTSUP
+	}
+	return nil
+}
+
+// setPerm sets the permission bits of st to perm. The type of
+// unix.Stat_t.Mode differs between platforms.
+func setPerm(st *unix.Stat_t, perm proto.Mode) {
+	for bit := uint(0); bit < 12; bit++ {
+		if perm&(1<<bit) != 0 {
+			st.Mode |= 1 << bit
+		}
+	}
+}
+
+func openMockFile(t *testing.T, m *mockFile, opts ...Option) (*Client, *Fid) {
+	t.Helper()
+
+	c := newMockClient(t, m.handle, opts...)
+	f, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	if _, err = f.ReadAt(make([]byte, 1), 0); err != errFidNotOpened {
+		t.Fatalf("read: expected error %v, got %v", errFidNotOpened, err)
+	}
+	if err = f.Open(os.O_RDWR); err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	return c, f
+}
+
+func TestFidReadAt(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	m := &mockFile{data: data, iounit: 64, maxRead: 48, perm: 0644}
+	c, f := openMockFile(t, m)
+	defer c.Close()
+
+	for num, test := range []struct {
+		offset int64
+		size   int
+		want   int
+		err    error
+	}{
+		{0, 0, 0, nil},
+		{0, 10, 10, nil},
+		{0, 200, 200, nil},
+		{990, 10, 10, nil},
+		{990, 20, 10, io.EOF},
+		{1000, 1, 0, io.EOF},
+		{2000, 1, 0, io.EOF},
+		{-1, 1, 0, unix.EINVAL},
+	} {
+		p := make([]byte, test.size)
+		n, err := f.ReadAt(p, test.offset)
+		if err != test.err {
+			t.Fatalf("read(%d): expected error %v, got %v", num, test.err, err)
+		}
+		if n != test.want {
+			t.Fatalf("read(%d): expected %d bytes, got %d", num, test.want, n)
+		}
+		if n > 0 && !bytes.Equal(p[:n], data[test.offset:test.offset+int64(n)]) {
+			t.Fatalf("read(%d): data differ", num)
+		}
+	}
+
+	for _, count := range m.counts {
+		if count > 64 {
+			t.Fatalf("read: request of %d bytes exceeds iounit", count)
+		}
+	}
+}
+
+func TestFidWriteAt(t *testing.T) {
+	m := &mockFile{}
+	c, f := openMockFile(t, m, WithMaxMessageSize(256))
+	defer c.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), 50)
+	n, err := f.WriteAt(data, 10)
+	if err != nil || n != len(data) {
+		t.Fatalf("write: unexpected result %d, %v", n, err)
+	}
+	if !bytes.Equal(m.data[10:], data) || !bytes.Equal(m.data[:10], make([]byte, 10)) {
+		t.Fatalf("write: data differ")
+	}
+	for _, count := range m.counts {
+		if count > int(calcMaxDataSize(256)) {
+			t.Fatalf("write: request of %d bytes exceeds max data size", count)
+		}
+	}
+
+	if _, err = f.WriteAt(data, -1); err != unix.EINVAL {
+		t.Fatalf("write: expected error %v, got %v", unix.EINVAL, err)
+	}
+}
+
+// mockDir serves a single directory containing regular files. Names
+// listed in ghosts are returned by Treaddir but cannot be walked.
+// Replies to Treaddir requests are limited to maxEntries entries.
+type mockDir struct {
+	mu         sync.Mutex
+	names      []string
+	ghosts     map[string]bool
+	maxEntries int
+	fids       map[uint32]string
+}
+
+func newMockDir(names []string, ghosts ...string) *mockDir {
+	m := &mockDir{
+		names:      append([]string{".", ".."}, names...),
+		ghosts:     make(map[string]bool),
+		maxEntries: 3,
+		fids:       make(map[uint32]string),
+	}
+	for _, name := range ghosts {
+		m.ghosts[name] = true
+	}
+	return m
+}
+
+func (m *mockDir) handle(tx, rx proto.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch tx := tx.(type) {
+	case *proto.Tlattach:
+		m.fids[tx.Fid] = ""
+	case *proto.Tclunk:
+		delete(m.fids, tx.Fid)
+	case *proto.Tlopen:
+	case *proto.Twalk:
+		name := m.fids[tx.Fid]
+		for _, elem := range tx.Names {
+			if name != "" || m.ghosts[elem] {
+				return unix.ENOENT
+			}
+			name = elem
+			*rx.(*proto.Rwalk) = append(*rx.(*proto.Rwalk), proto.Qid{})
+		}
+		m.fids[tx.NewFid] = name
+	case *proto.Tgetattr:
+		st := &unix.Stat_t{Mode: unix.S_IFDIR | 0755}
+		if name := m.fids[tx.Fid]; name != "" {
+			st = &unix.Stat_t{Mode: unix.S_IFREG | 0644, Size: int64(len(name))}
+		}
+		rx.(*proto.Rgetattr).Stat_t = st
+	case *proto.Treaddir:
+		var data []byte
+		for i := int(tx.Offset); i < len(m.names) && i < int(tx.Offset)+m.maxEntries; i++ {
+			dirent := proto.Dirent{Offset: uint64(i + 1), Name: m.names[i]}
+			data, _, _ = dirent.Marshal(data)
+		}
+		rx.(*proto.Rreaddir).Data = data
+	default:
+		return unix.ENOTSUP
+	}
+	return nil
+}
+
+func TestFidReadDir(t *testing.T) {
+	var names []string
+	for i := 0; i < 10; i++ {
+		names = append(names, fmt.Sprintf("file%02d", i))
+	}
+
+	for num, test := range []struct {
+		n      int
+		ghosts []string
+		want   []int
+	}{
+		{0, nil, []int{10}},
+		{-1, []string{"file03"}, []int{9}},
+		{4, nil, []int{4, 4, 2}},
+		{3, []string{"file03", "file04", "file05"}, []int{3, 3, 1}},
+		{100, nil, []int{10}},
+	} {
+		m := newMockDir(names, test.ghosts...)
+		c := newMockClient(t, m.handle)
+		f, err := c.Attach(nil, "/", "root", 0)
+		if err != nil {
+			t.Fatalf("attach: unexpected error: %v", err)
+		}
+
+		var got []string
+		for _, want := range test.want {
+			info, err := f.ReadDir(test.n)
+			if err != nil {
+				t.Fatalf("readdir(%d): unexpected error: %v", num, err)
+			}
+			if len(info) != want {
+				t.Fatalf("readdir(%d): expected %d entries, got %d", num, want, len(info))
+			}
+			for _, fi := range info {
+				if fi.Size() != int64(len(fi.Name())) || !fi.Mode().IsRegular() {
+					t.Fatalf("readdir(%d): unexpected file info %v", num, fi)
+				}
+				got = append(got, fi.Name())
+			}
+		}
+		if test.n > 0 {
+			if info, err := f.ReadDir(test.n); err != io.EOF || len(info) != 0 {
+				t.Fatalf("readdir(%d): expected EOF, got %d entries, %v", num, len(info), err)
+			}
+		}
+		if len(got) != len(names)-len(test.ghosts) || got[0] != "file00" {
+			t.Fatalf("readdir(%d): unexpected entries %v", num, got)
+		}
+
+		f.Close()
+		c.Close()
+		if len(m.fids) != 0 {
+			t.Fatalf("readdir(%d): %d fids not clunked", num, len(m.fids))
+		}
+	}
+}
+
+func TestFidSetAttr(t *testing.T) {
+	m := &mockFile{data: []byte("data"), perm: 0644}
+	c := newMockClient(t, m.handle)
+	defer c.Close()
+	f, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+
+	mtime := time.Unix(1234567890, 42)
+	for num, test := range []struct {
+		fn    func() error
+		valid uint32
+	}{
+		{func() error { return f.Chmod(0600 | os.ModeSetuid) }, proto.SetAttrMode},
+		{func() error { return f.Chown(1000, -1) }, proto.SetAttrUid},
+		{func() error { return f.Chown(-1, 1000) }, proto.SetAttrGid},
+		{func() error { return f.Truncate(2) }, proto.SetAttrSize},
+		{func() error { return f.Chtimes(mtime, mtime) }, proto.SetAttrAtime |
+			proto.SetAttrAtimeSet | proto.SetAttrMtime | proto.SetAttrMtimeSet},
+		{func() error { return f.SetAttr(Attr{Valid: proto.SetAttrMtime}) }, proto.SetAttrMtime},
+	} {
+		if err := test.fn(); err != nil {
+			t.Fatalf("setattr(%d): unexpected error: %v", num, err)
+		}
+		if tx := m.setattrs[num]; tx.Valid != test.valid {
+			t.Fatalf("setattr(%d): expected valid %#x, got %#x", num, test.valid, tx.Valid)
+		}
+	}
+	if tx := m.setattrs[0]; tx.Mode != proto.ModeUserID|0600 {
+		t.Fatalf("setattr: unexpected mode %v", tx.Mode)
+	}
+	if tx := m.setattrs[5]; tx.Mtime != (unix.Timespec{}) {
+		t.Fatalf("setattr: expected server time, got %v", tx.Mtime)
+	}
+
+	fi := f.fi
+	if fi.Mode() != 0600|os.ModeSetuid || fi.Uid != 1000 || fi.Gid != 1000 || fi.Size() != 2 || !fi.ModTime().Equal(mtime) {
+		t.Fatalf("setattr: file info not refreshed: %v", fi.Rgetattr)
+	}
+
+	if err = f.Chown(-2, -1); err != errInvalidUid {
+		t.Fatalf("setattr: expected error %v, got %v", errInvalidUid, err)
+	}
+	if err = f.Truncate(-1); err != unix.EINVAL {
+		t.Fatalf("setattr: expected error %v, got %v", unix.EINVAL, err)
+	}
+}
+
+// mockTree serves a file tree of regular files and directories. If
+// legacy is set Trenameat and Tunlinkat requests are rejected. Files
+// created by Tsymlink and Tmknod are recorded in nodes.
+type mockTree struct {
+	mu     sync.Mutex
+	files  map[string]bool // maps path to isDir
+	data   map[string][]byte
+	qids   map[string]uint64
+	nodes  map[string]proto.Message
+	fids   map[uint32]string
+	legacy bool
+	calls  map[proto.MessageType]int
+}
+
+func newMockTree(legacy bool, files map[string]bool) *mockTree {
+	files[""] = true
+	return &mockTree{
+		files:  files,
+		data:   make(map[string][]byte),
+		qids:   make(map[string]uint64),
+		nodes:  make(map[string]proto.Message),
+		fids:   make(map[uint32]string),
+		legacy: legacy,
+		calls:  make(map[proto.MessageType]int),
+	}
+}
+
+func (m *mockTree) create(name string, tx proto.Message) (proto.Qid, error) {
+	if _, found := m.files[name]; found {
+		return proto.Qid{}, unix.EEXIST
+	}
+	m.files[name] = false
+	m.qids[name] = uint64(len(m.qids) + 1)
+	// requests are released to the pool once answered, keep a copy
+	v := reflect.New(reflect.TypeOf(tx).Elem())
+	v.Elem().Set(reflect.ValueOf(tx).Elem())
+	m.nodes[name] = v.Interface().(proto.Message)
+	return proto.Qid{Path: m.qids[name]}, nil
+}
+
+// qid returns the Qid of the named file. Qids of files which are not
+// created by the client are assigned on first use.
+func (m *mockTree) qid(name string) proto.Qid {
+	if _, found := m.qids[name]; !found {
+		m.qids[name] = uint64(len(m.qids) + 1)
+	}
+	qid := proto.Qid{Path: m.qids[name]}
+	if m.files[name] {
+		qid.Type = proto.TypeDirectory
+	}
+	return qid
+}
+
+func (m *mockTree) unlink(name string, rmdir bool) error {
+	isDir, found := m.files[name]
+	switch {
+	case !found:
+		return unix.ENOENT
+	case isDir && !rmdir:
+		return unix.EISDIR
+	case !isDir && rmdir:
+		return unix.ENOTDIR
+	}
+	for child := range m.files {
+		if strings.HasPrefix(child, name+"/") {
+			return unix.ENOTEMPTY
+		}
+	}
+	delete(m.files, name)
+	delete(m.data, name)
+	return nil
+}
+
+func (m *mockTree) rename(oldpath, newpath string) error {
+	isDir, found := m.files[oldpath]
+	if !found {
+		return unix.ENOENT
+	}
+	for name := range m.files {
+		if name == oldpath || strings.HasPrefix(name, oldpath+"/") {
+			moved := newpath + name[len(oldpath):]
+			m.files[moved] = m.files[name]
+			m.data[moved] = m.data[name]
+			m.qids[moved] = m.qid(name).Path
+			delete(m.files, name)
+			delete(m.data, name)
+			delete(m.qids, name)
+		}
+	}
+	m.files[newpath] = isDir
+	return nil
+}
+
+func (m *mockTree) handle(tx, rx proto.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.calls[tx.MessageType()]++
+	switch tx := tx.(type) {
+	case *proto.Tlattach:
+		m.fids[tx.Fid] = ""
+	case *proto.Tclunk:
+		delete(m.fids, tx.Fid)
+	case *proto.Twalk:
+		if len(tx.Names) > proto.MaxNames {
+			return unix.EINVAL
+		}
+		name := m.fids[tx.Fid]
+		for i, elem := range tx.Names {
+			if _, found := m.files[path.Join(name, elem)]; !found {
+				if i == 0 {
+					return unix.ENOENT
+				}
+				return nil
+			}
+			name = path.Join(name, elem)
+			*rx.(*proto.Rwalk) = append(*rx.(*proto.Rwalk), m.qid(name))
+		}
+		m.fids[tx.NewFid] = name
+	case *proto.Tgetattr:
+		st := &unix.Stat_t{Mode: unix.S_IFREG | 0644}
+		if m.files[m.fids[tx.Fid]] {
+			st.Mode = unix.S_IFDIR | 0755
+		}
+		if _, ok := m.nodes[m.fids[tx.Fid]].(*proto.Tsymlink); ok {
+			st.Mode = unix.S_IFLNK | 0777
+		}
+		st.Size = int64(len(m.data[m.fids[tx.Fid]]))
+		rx.(*proto.Rgetattr).Stat_t = st
+		rx.(*proto.Rgetattr).Qid = m.qid(m.fids[tx.Fid])
+	case *proto.Tmkdir:
+		name := path.Join(m.fids[tx.DirectoryFid], tx.Name)
+		if _, found := m.files[name]; found {
+			return unix.EEXIST
+		}
+		m.files[name] = true
+	case *proto.Treadlink:
+		link, ok := m.nodes[m.fids[tx.Fid]].(*proto.Tsymlink)
+		if !ok {
+			return unix.EINVAL
+		}
+		rx.(*proto.Rreadlink).Target = link.Target
+	case *proto.Tfsync, *proto.Tlock:
+	case *proto.Tlopen:
+		if tx.Flags&proto.FlagTruncate != 0 {
+			m.data[m.fids[tx.Fid]] = nil
+		}
+	case *proto.Tlcreate:
+		name := path.Join(m.fids[tx.Fid], tx.Name)
+		qid, err := m.create(name, tx)
+		if err != nil {
+			return err
+		}
+		m.fids[tx.Fid] = name
+		rx.(*proto.Rlcreate).Qid = qid
+	case *proto.Tread:
+		data := m.data[m.fids[tx.Fid]]
+		if tx.Offset >= uint64(len(data)) {
+			return nil
+		}
+		data = data[tx.Offset:]
+		if len(data) > int(tx.Count) {
+			data = data[:tx.Count]
+		}
+		rx.(*proto.Rread).Data = data
+	case *proto.Twrite:
+		name := m.fids[tx.Fid]
+		if end := int(tx.Offset) + len(tx.Data); end > len(m.data[name]) {
+			m.data[name] = append(m.data[name], make([]byte, end-len(m.data[name]))...)
+		}
+		copy(m.data[name][tx.Offset:], tx.Data)
+		rx.(*proto.Rwrite).Count = uint32(len(tx.Data))
+	case *proto.Treaddir:
+		dir := m.fids[tx.Fid]
+		var names []string
+		for name := range m.files {
+			if parent := strings.TrimSuffix(path.Dir(name), "."); name != "" && parent == dir {
+				names = append(names, path.Base(name))
+			}
+		}
+		sort.Strings(names)
+		var data []byte
+		for i := int(tx.Offset); i < len(names); i++ {
+			name := path.Join(dir, names[i])
+			dirent := proto.Dirent{Qid: m.qid(name), Offset: uint64(i + 1), Type: unix.DT_REG, Name: names[i]}
+			if m.files[name] {
+				dirent.Type = unix.DT_DIR
+			}
+			if _, ok := m.nodes[name].(*proto.Tsymlink); ok {
+				dirent.Type = unix.DT_LNK
+			}
+			data, _, _ = dirent.Marshal(data)
+		}
+		rx.(*proto.Rreaddir).Data = data
+	case *proto.Tsymlink:
+		qid, err := m.create(path.Join(m.fids[tx.DirectoryFid], tx.Name), tx)
+		rx.(*proto.Rsymlink).Qid = qid
+		return err
+	case *proto.Tmknod:
+		qid, err := m.create(path.Join(m.fids[tx.DirectoryFid], tx.Name), tx)
+		rx.(*proto.Rmknod).Qid = qid
+		return err
+	case *proto.Tlink:
+		name := path.Join(m.fids[tx.DirectoryFid], tx.Name)
+		if _, err := m.create(name, tx); err != nil {
+			return err
+		}
+		m.qids[name] = m.qids[m.fids[tx.Target]]
+	case *proto.Trenameat:
+		if m.legacy {
+			return errNotSupported
+		}
+		return m.rename(path.Join(m.fids[tx.OldDirectoryFid], tx.OldName),
+			path.Join(m.fids[tx.NewDirectoryFid], tx.NewName))
+	case *proto.Trename:
+		return m.rename(m.fids[tx.Fid], path.Join(m.fids[tx.DirectoryFid], tx.Name))
+	case *proto.Tunlinkat:
+		if m.legacy {
+			return unix.ENOTSUP
+		}
+		return m.unlink(path.Join(m.fids[tx.DirectoryFid], tx.Name),
+			tx.Flags&proto.FlagRemoveDir != 0)
+	case *proto.Tremove:
+		name := m.fids[tx.Fid]
+		delete(m.fids, tx.Fid)
+		return m.unlink(name, m.files[name])
+	default:
+		return unix.ENOTSUP
+	}
+	return nil
+}
+
+func TestFidRenameUnlink(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		m := newMockTree(legacy, map[string]bool{
+			"dir": true, "dir/a": false, "b": false, "empty": true,
+		})
+		c := newMockClient(t, m.handle)
+		f, err := c.Attach(nil, "/", "root", 0)
+		if err != nil {
+			t.Fatalf("attach: unexpected error: %v", err)
+		}
+
+		if err = f.Rename("dir/a", "c"); err != nil {
+			t.Fatalf("rename(%v): unexpected error: %v", legacy, err)
+		}
+		dir, err := f.Walk("dir")
+		if err != nil {
+			t.Fatalf("walk(%v): unexpected error: %v", legacy, err)
+		}
+		if err = f.Renameat("b", dir, "b"); err != nil {
+			t.Fatalf("renameat(%v): unexpected error: %v", legacy, err)
+		}
+		if err = f.Rename("missing", "d"); err != unix.ENOENT {
+			t.Fatalf("rename(%v): expected error %v, got %v", legacy, unix.ENOENT, err)
+		}
+
+		if err = f.Unlinkat("c", 0); err != nil {
+			t.Fatalf("unlinkat(%v): unexpected error: %v", legacy, err)
+		}
+		if err = f.Unlinkat("empty", unix.AT_REMOVEDIR); err != nil {
+			t.Fatalf("unlinkat(%v): unexpected error: %v", legacy, err)
+		}
+		if err = f.Unlinkat("dir", 0); err != unix.EISDIR {
+			t.Fatalf("unlinkat(%v): expected error %v, got %v", legacy, unix.EISDIR, err)
+		}
+		if err = dir.Unlinkat("b", unix.AT_REMOVEDIR); err != unix.ENOTDIR {
+			t.Fatalf("unlinkat(%v): expected error %v, got %v", legacy, unix.ENOTDIR, err)
+		}
+
+		want := map[string]bool{"": true, "dir": true, "dir/b": false}
+		if !reflect.DeepEqual(m.files, want) {
+			t.Fatalf("rename(%v): unexpected files %v", legacy, m.files)
+		}
+		if n := m.calls[proto.MessageTrenameat]; legacy && n != 1 {
+			t.Fatalf("renameat(%v): expected one Trenameat, got %d", legacy, n)
+		}
+		if n := m.calls[proto.MessageTunlinkat]; legacy && n != 1 {
+			t.Fatalf("unlinkat(%v): expected one Tunlinkat, got %d", legacy, n)
+		}
+		if n := m.calls[proto.MessageTrename] + m.calls[proto.MessageTremove]; !legacy && n != 0 {
+			t.Fatalf("rename(%v): unexpected fallback requests", legacy)
+		}
+
+		dir.Close()
+		f.Close()
+		c.Close()
+		if len(m.fids) != 0 {
+			t.Fatalf("rename(%v): %d fids not clunked", legacy, len(m.fids))
+		}
+	}
+}
+
+func TestFidCreateNodes(t *testing.T) {
+	m := newMockTree(false, map[string]bool{"dir": true, "file": false})
+	m.qids["file"] = 42
+	c := newMockClient(t, m.handle)
+	defer c.Close()
+	f, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	dir, err := f.Walk("dir")
+	if err != nil {
+		t.Fatalf("walk: unexpected error: %v", err)
+	}
+	file, err := f.Walk("file")
+	if err != nil {
+		t.Fatalf("walk: unexpected error: %v", err)
+	}
+
+	qid, err := dir.Symlink("link", "../file")
+	if err != nil || qid.Path == 0 {
+		t.Fatalf("symlink: unexpected result %v, %v", qid, err)
+	}
+	if tx := m.nodes["dir/link"].(*proto.Tsymlink); tx.Target != "../file" {
+		t.Fatalf("symlink: unexpected target %q", tx.Target)
+	}
+
+	qid, err = dir.Mknod("null", 0666|os.ModeDevice|os.ModeCharDevice, 1, 3)
+	if err != nil || qid.Path == 0 {
+		t.Fatalf("mknod: unexpected result %v, %v", qid, err)
+	}
+	tx := m.nodes["dir/null"].(*proto.Tmknod)
+	if tx.Perm != proto.ModeCharacterDevice|0666 || tx.Major != 1 || tx.Minor != 3 {
+		t.Fatalf("mknod: unexpected request %v", tx)
+	}
+
+	if qid, err = dir.Link(file, "hard"); err != nil || qid.Path != 42 {
+		t.Fatalf("link: unexpected result %v, %v", qid, err)
+	}
+
+	if _, err = dir.Mknod("dir", os.ModeDir|0755, 0, 0); err != unix.EINVAL {
+		t.Fatalf("mknod: expected error %v, got %v", unix.EINVAL, err)
+	}
+	for _, name := range []string{"", ".", ".."} {
+		if _, err = dir.Symlink(name, "file"); err != errInvalildName {
+			t.Fatalf("symlink: expected error %v, got %v", errInvalildName, err)
+		}
+		if _, err = dir.Mknod(name, os.ModeNamedPipe, 0, 0); err != errInvalildName {
+			t.Fatalf("mknod: expected error %v, got %v", errInvalildName, err)
+		}
+		if _, err = dir.Link(file, name); err != errInvalildName {
+			t.Fatalf("link: expected error %v, got %v", errInvalildName, err)
+		}
+	}
+	if _, err = dir.Symlink("link", "file"); err != unix.EEXIST {
+		t.Fatalf("symlink: expected error %v, got %v", unix.EEXIST, err)
+	}
+}
+
+func TestFidStatfs(t *testing.T) {
+	root, err := ioutil.TempDir("", "ninep-statfs-test")
+	if err != nil {
+		t.Fatalf("cannot create export directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+	fs, err := posix.Open(root, -1, -1)
+	if err != nil {
+		t.Fatalf("cannot init export filesystem: %v", err)
+	}
+
+	s, err := NewServer(fs)
+	if err != nil {
+		t.Fatalf("server: unexpected error: %v", err)
+	}
+	server, client := net.Pipe()
+	sess := newSession(s.exports, s.qids, server, proto.MaxMessageSize, proto.MaxDataSize)
+	go sess.serve()
+	defer sess.Close()
+
+	c, err := NewClient(client)
+	if err != nil {
+		t.Fatalf("client: cannot initialize connection: %v", err)
+	}
+	defer c.Close()
+	f, err := c.Attach(nil, "/", "root", proto.NoUid)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	defer f.Close()
+
+	st, err := f.Statfs()
+	if err != nil {
+		t.Fatalf("statfs: unexpected error: %v", err)
+	}
+	want := unix.Statfs_t{}
+	if err = unix.Statfs(root, &want); err != nil {
+		t.Fatalf("statfs: cannot stat %q: %v", root, err)
+	}
+	// free counts may change meanwhile
+	expected := Statfs(proto.StatfsToRstatfs(&want))
+	expected.BlocksFree, expected.BlocksAvailable = st.BlocksFree, st.BlocksAvailable
+	expected.FilesFree = st.FilesFree
+	if st != expected {
+		t.Fatalf("statfs: expected %+v, got %+v", expected, st)
+	}
+	if st.Total() != st.Blocks*uint64(st.BlockSize) || st.Used() != st.Total()-st.Free() {
+		t.Fatalf("statfs: unexpected sizes %+v", st)
+	}
+	if st.Available() > st.Free() || st.FreeInodes() > st.Inodes() {
+		t.Fatalf("statfs: unexpected free counts %+v", st)
+	}
+}
@@ -0,0 +1,491 @@
+package ninep
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path"
+	"sync"
+
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	_ io.ReadWriteSeeker = (*File)(nil) // File implements io.ReadWriteSeeker
+	_ io.ReaderAt        = (*File)(nil) // File implements io.ReaderAt
+	_ io.WriterAt        = (*File)(nil) // File implements io.WriterAt
+	_ io.Closer          = (*File)(nil) // File implements io.Closer
+	_ fs.ReadDirFile     = (*File)(nil) // File implements fs.ReadDirFile
+)
+
+var errWriteAtInAppendMode = errors.New("invalid use of WriteAt on file opened with O_APPEND")
+
+// File represents an open file of a 9P2000.L file server. File
+// implements io.Reader, io.Writer, io.Seeker, io.ReaderAt, io.WriterAt
+// and io.Closer with the semantics of os.File. Errors returned by File
+// methods are of type *os.PathError, except io.EOF.
+//
+// Directories are not opened for I/O, but can be read with Readdir.
+type File struct {
+	fid   *Fid
+	name  string
+	flags int
+	dir   bool
+
+	mu     sync.Mutex // protects following
+	offset int64
+	closed bool
+	seq    *sequential
+}
+
+// OpenFile opens the named file. The name is the attach name of the
+// file tree followed by the path of the file, the directory of the
+// file is attached as the user running the process. See Fid.OpenFile
+// for the meaning of flags and perm.
+func (c *Client) OpenFile(name string, flags int, perm os.FileMode) (*File, error) {
+	return c.OpenFileContext(context.Background(), name, flags, perm)
+}
+
+// OpenFileContext is like OpenFile but aborts the requests if ctx is
+// done before the server answered.
+func (c *Client) OpenFileContext(ctx context.Context, name string, flags int, perm os.FileMode) (*File, error) {
+	if !path.IsAbs(name) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errInvalildName}
+	}
+	username := ""
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	dir, base := path.Split(path.Clean(name))
+	root, err := c.AttachContext(ctx, nil, dir, username, os.Getuid())
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	defer root.Close()
+
+	fid, err := root.openFile(ctx, base, flags, perm)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return newFile(fid, name, flags), nil
+}
+
+// OpenFile opens the named file relative to the directory represented
+// by fid with specified flags (os.O_RDONLY etc.). If the file does not
+// exist and the os.O_CREATE flag is passed, it is created with mode
+// perm. The returned File uses a new fid, fid itself is left
+// unchanged.
+func (f *Fid) OpenFile(name string, flags int, perm os.FileMode) (*File, error) {
+	return f.OpenFileContext(context.Background(), name, flags, perm)
+}
+
+// OpenFileContext is like OpenFile but aborts the requests if ctx is
+// done before the server answered.
+func (f *Fid) OpenFileContext(ctx context.Context, name string, flags int, perm os.FileMode) (*File, error) {
+	f.mu.Lock()
+	fid, err := f.openFile(ctx, name, flags, perm)
+	f.mu.Unlock()
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return newFile(fid, name, flags), nil
+}
+
+func newFile(fid *Fid, name string, flags int) *File {
+	return &File{
+		fid:   fid,
+		name:  name,
+		flags: flags,
+		dir:   fid.fi.Mode().IsDir(),
+	}
+}
+
+func (f *Fid) openFile(ctx context.Context, name string, flags int, perm os.FileMode) (*Fid, error) {
+	if path.IsAbs(name) {
+		return nil, errInvalildName
+	}
+	dir, base := path.Split(path.Clean(name))
+	if base == ".." {
+		dir, base = path.Join(dir, base), "."
+	}
+
+	parent, err := f.walkDir(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer parent.release(f)
+
+	if base == "." {
+		if flags&os.O_CREATE != 0 && flags&os.O_EXCL != 0 {
+			return nil, unix.EEXIST
+		}
+		return parent.openExisting(ctx, nil, flags)
+	}
+
+	if flags&os.O_CREATE == 0 || flags&os.O_EXCL == 0 {
+		fid, err := parent.openExisting(ctx, []string{base}, flags)
+		if err != unix.ENOENT || flags&os.O_CREATE == 0 {
+			return fid, err
+		}
+	}
+
+	fid, err := parent.clone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = fid.create(ctx, base, flags, perm); err != nil {
+		fid.clunk(context.Background())
+		if err == unix.EEXIST && flags&os.O_EXCL == 0 {
+			// created by someone else meanwhile
+			return parent.openExisting(ctx, []string{base}, flags)
+		}
+		return nil, err
+	}
+
+	attr, err := f.c.stat(ctx, fid.num, proto.GetAttrBasic)
+	if err != nil {
+		fid.clunk(context.Background())
+		return nil, err
+	}
+	fid.fi.Rgetattr = attr
+	return fid, nil
+}
+
+// openExisting walks to the file reached by names and opens it for
+// I/O unless it is a directory.
+func (f *Fid) openExisting(ctx context.Context, names []string, flags int) (*Fid, error) {
+	fidnum, fi, err := f.walk(ctx, names...)
+	if err != nil {
+		return nil, err
+	}
+	fid := &Fid{c: f.c, num: fidnum, fi: fi}
+
+	if fi.Mode().IsDir() {
+		if flags&(os.O_WRONLY|os.O_RDWR) != 0 {
+			fid.clunk(context.Background())
+			return nil, unix.EISDIR
+		}
+		return fid, nil
+	}
+	if err = fid.open(ctx, flags&^(os.O_CREATE|os.O_EXCL)); err != nil {
+		fid.clunk(context.Background())
+		return nil, err
+	}
+	return fid, nil
+}
+
+// Name returns the name of the file as presented to OpenFile.
+func (f *File) Name() string { return f.name }
+
+func (f *File) wrapErr(op string, err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	return &os.PathError{Op: op, Path: f.name, Err: err}
+}
+
+// checkValid returns an error if the file cannot be used for I/O. The
+// caller must hold f.mu.
+func (f *File) checkValid(op string) error {
+	if f.closed {
+		return f.wrapErr(op, os.ErrClosed)
+	}
+	if f.dir {
+		return f.wrapErr(op, unix.EISDIR)
+	}
+	return nil
+}
+
+// Read reads up to len(p) bytes from the File. It returns the number
+// of bytes read and any error encountered. At end of file, Read
+// returns 0, io.EOF.
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkValid("read"); err != nil {
+		return 0, err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if f.seq != nil {
+		n, err := f.seq.read(p, f.offset)
+		f.offset += int64(n)
+		return n, f.wrapErr("read", err)
+	}
+
+	size, err := f.fid.iosize()
+	if err != nil {
+		return 0, f.wrapErr("read", err)
+	}
+	if len(p) > size {
+		p = p[:size]
+	}
+	n, err := f.fid.read(context.Background(), p, f.offset)
+	f.offset += int64(n)
+	if err == nil && n == 0 {
+		return 0, io.EOF
+	}
+	return n, f.wrapErr("read", err)
+}
+
+// ReadAt reads len(p) bytes from the File starting at byte offset. It
+// returns the number of bytes read and the error, if any. ReadAt
+// always returns a non-nil error when n < len(p). At end of file, that
+// error is io.EOF.
+func (f *File) ReadAt(p []byte, offset int64) (int, error) {
+	f.mu.Lock()
+	err := f.checkValid("read")
+	if err == nil {
+		err = f.wrapErr("read", f.syncSequential(false))
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := f.fid.ReadAt(p, offset)
+	return n, f.wrapErr("read", err)
+}
+
+// Write writes len(p) bytes to the File. It returns the number of
+// bytes written and an error, if any. Write returns a non-nil error
+// when n != len(p). If the file was opened with os.O_APPEND, data is
+// written at the end of the file.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkValid("write"); err != nil {
+		return 0, err
+	}
+	if f.seq != nil && f.flags&os.O_APPEND == 0 {
+		n, err := f.seq.write(p, f.offset)
+		f.offset += int64(n)
+		return n, f.wrapErr("write", err)
+	}
+
+	if f.flags&os.O_APPEND != 0 {
+		if err := f.syncSequential(true); err != nil {
+			return 0, f.wrapErr("write", err)
+		}
+		fi, err := f.fid.Stat()
+		if err != nil {
+			return 0, f.wrapErr("write", err)
+		}
+		f.offset = fi.Size()
+	}
+	n, err := f.fid.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, f.wrapErr("write", err)
+}
+
+// WriteAt writes len(p) bytes to the File starting at byte offset. It
+// returns the number of bytes written and an error, if any. WriteAt
+// returns a non-nil error when n != len(p).
+//
+// If the file was opened with os.O_APPEND, WriteAt returns an error.
+func (f *File) WriteAt(p []byte, offset int64) (int, error) {
+	f.mu.Lock()
+	err := f.checkValid("write")
+	if err == nil {
+		err = f.wrapErr("write", f.syncSequential(true))
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if f.flags&os.O_APPEND != 0 {
+		return 0, errWriteAtInAppendMode
+	}
+
+	n, err := f.fid.WriteAt(p, offset)
+	return n, f.wrapErr("write", err)
+}
+
+// Seek sets the offset for the next Read or Write on file to offset,
+// interpreted according to whence: io.SeekStart means relative to the
+// origin of the file, io.SeekCurrent means relative to the current
+// offset, and io.SeekEnd means relative to the end. It returns the new
+// offset and an error, if any.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, f.wrapErr("seek", os.ErrClosed)
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		if err := f.syncSequential(false); err != nil {
+			return 0, f.wrapErr("seek", err)
+		}
+		fi, err := f.fid.Stat()
+		if err != nil {
+			return 0, f.wrapErr("seek", err)
+		}
+		offset += fi.Size()
+	default:
+		return 0, f.wrapErr("seek", unix.EINVAL)
+	}
+	if offset < 0 {
+		return 0, f.wrapErr("seek", unix.EINVAL)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Readdir reads the contents of the directory associated with file and
+// returns a slice of up to n os.FileInfo values, as would be returned
+// by Stat, in directory order. See Fid.ReadDir for the meaning of n.
+func (f *File) Readdir(n int) ([]os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, f.wrapErr("readdir", os.ErrClosed)
+	}
+	if !f.dir {
+		return nil, f.wrapErr("readdir", unix.ENOTDIR)
+	}
+
+	info, err := f.fid.ReadDir(n)
+	return info, f.wrapErr("readdir", err)
+}
+
+// ReadDir reads the contents of the directory associated with file and
+// returns a slice of up to n directory entries in directory order. See
+// Fid.ReadDir for the meaning of n.
+//
+// Unlike Readdir, ReadDir does not request the attributes of the
+// entries, their Info method does.
+func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, f.wrapErr("readdir", os.ErrClosed)
+	}
+	if !f.dir {
+		return nil, f.wrapErr("readdir", unix.ENOTDIR)
+	}
+
+	f.fid.mu.Lock()
+	dirents, err := f.fid.readDirents(context.Background(), n)
+	f.fid.mu.Unlock()
+
+	ents := make([]fs.DirEntry, len(dirents))
+	for i, dirent := range dirents {
+		ents[i] = &dirEntry{dirent: dirent, lstat: f.lstat}
+	}
+	return ents, f.wrapErr("readdir", err)
+}
+
+// lstat returns the attributes of the named entry of the directory
+// associated with file.
+func (f *File) lstat(name string) (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, &os.PathError{Op: "lstat", Path: path.Join(f.name, name), Err: os.ErrClosed}
+	}
+
+	f.fid.mu.Lock()
+	fi, err := f.fid.lstat(context.Background(), name)
+	f.fid.mu.Unlock()
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: path.Join(f.name, name), Err: err}
+	}
+	return *fi, nil
+}
+
+// dirEntry implements fs.DirEntry on top of a directory entry returned
+// by the server. The attributes are requested by Info, using lstat.
+type dirEntry struct {
+	dirent proto.Dirent
+	lstat  func(name string) (os.FileInfo, error)
+}
+
+func (e *dirEntry) Name() string { return e.dirent.Name }
+func (e *dirEntry) IsDir() bool  { return e.Type().IsDir() }
+
+// Type returns the type bits of the entry. If the server did not report
+// the type, it is derived from the qid.
+func (e *dirEntry) Type() fs.FileMode {
+	if e.dirent.Type == unix.DT_UNKNOWN {
+		switch {
+		case e.dirent.Qid.Type&proto.TypeDirectory != 0:
+			return fs.ModeDir
+		case e.dirent.Qid.Type&proto.TypeSymlink != 0:
+			return fs.ModeSymlink
+		}
+		return 0
+	}
+	// DT_* constants are the S_IF* file types shifted by 12 bits.
+	return proto.Mode(uint32(e.dirent.Type) << 12).FileMode().Type()
+}
+
+func (e *dirEntry) Info() (fs.FileInfo, error) { return e.lstat(e.dirent.Name) }
+
+// Stat returns the os.FileInfo structure describing file.
+func (f *File) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	closed := f.closed
+	var err error
+	if !closed {
+		err = f.syncSequential(false)
+	}
+	f.mu.Unlock()
+	if closed {
+		return nil, f.wrapErr("stat", os.ErrClosed)
+	}
+	if err != nil {
+		return nil, f.wrapErr("stat", err)
+	}
+
+	fi, err := f.fid.Stat()
+	return fi, f.wrapErr("stat", err)
+}
+
+// Close closes the File, rendering it unusable for I/O. Close returns
+// an error if it has already been called.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return f.wrapErr("close", os.ErrClosed)
+	}
+	f.closed = true
+	err := f.leaveSequential()
+	if cerr := f.fid.Close(); err == nil {
+		err = cerr
+	}
+	return f.wrapErr("close", err)
+}
+
+// Sync commits the current contents of the file to stable storage. In
+// sequential mode, it waits for queued writes first.
+func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkValid("sync"); err != nil {
+		return err
+	}
+	if err := f.syncSequential(false); err != nil {
+		return f.wrapErr("sync", err)
+	}
+	return f.wrapErr("sync", f.fid.Sync())
+}
@@ -0,0 +1,240 @@
+package ninep
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+func checkPathError(t *testing.T, op string, err, want error) {
+	t.Helper()
+
+	perr, ok := err.(*os.PathError)
+	if !ok || perr.Err != want {
+		t.Fatalf("%s: expected error %v, got %v", op, want, err)
+	}
+}
+
+func TestFileReadWriteSeek(t *testing.T) {
+	m := newMockTree(false, map[string]bool{"dir": true})
+	c := newMockClient(t, m.handle)
+	defer c.Close()
+	root, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	defer root.Close()
+
+	if _, err = root.OpenFile("dir/file", os.O_RDONLY, 0); err == nil {
+		t.Fatalf("open: expected error, got <nil>")
+	}
+	checkPathError(t, "open", err, unix.ENOENT)
+
+	f, err := root.OpenFile("dir/file", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	if f.Name() != "dir/file" {
+		t.Fatalf("open: unexpected name %q", f.Name())
+	}
+	if _, err = root.OpenFile("dir/file", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); err == nil {
+		t.Fatalf("open: expected error, got <nil>")
+	}
+
+	if n, err := f.Write([]byte("hello world")); err != nil || n != 11 {
+		t.Fatalf("write: unexpected result %d, %v", n, err)
+	}
+	if off, err := f.Seek(-5, io.SeekEnd); err != nil || off != 6 {
+		t.Fatalf("seek: unexpected result %d, %v", off, err)
+	}
+	if n, err := f.Write([]byte("gophe")); err != nil || n != 5 {
+		t.Fatalf("write: unexpected result %d, %v", n, err)
+	}
+	if _, err = f.Seek(-1, io.SeekStart); err == nil {
+		t.Fatalf("seek: expected error, got <nil>")
+	}
+	if off, err := f.Seek(0, io.SeekStart); err != nil || off != 0 {
+		t.Fatalf("seek: unexpected result %d, %v", off, err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil || string(data) != "hello gophe" {
+		t.Fatalf("read: unexpected result %q, %v", data, err)
+	}
+	if n, err := f.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("read: expected EOF, got %d, %v", n, err)
+	}
+
+	buf := make([]byte, 4)
+	if n, err := f.ReadAt(buf, 9); n != 2 || err != io.EOF {
+		t.Fatalf("readat: unexpected result %d, %v", n, err)
+	}
+	if n, err := f.WriteAt([]byte("r!"), 11); n != 2 || err != nil {
+		t.Fatalf("writeat: unexpected result %d, %v", n, err)
+	}
+	if string(m.data["dir/file"]) != "hello gopher!" {
+		t.Fatalf("writeat: unexpected data %q", m.data["dir/file"])
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("stat: unexpected error: %v", err)
+	}
+	if fi.Name() != "file" || fi.Size() != 13 || !fi.Mode().IsRegular() {
+		t.Fatalf("stat: unexpected file info %q, %d, %v", fi.Name(), fi.Size(), fi.Mode())
+	}
+	if _, err = f.Readdir(-1); err == nil {
+		t.Fatalf("readdir: expected error, got <nil>")
+	}
+	checkPathError(t, "readdir", err, unix.ENOTDIR)
+
+	if err = f.Close(); err != nil {
+		t.Fatalf("close: unexpected error: %v", err)
+	}
+	checkPathError(t, "close", f.Close(), os.ErrClosed)
+	_, err = f.Read(buf)
+	checkPathError(t, "read", err, os.ErrClosed)
+	if len(m.fids) != 1 {
+		t.Fatalf("close: %d fids not clunked", len(m.fids)-1)
+	}
+}
+
+func TestFileAppendTruncate(t *testing.T) {
+	m := newMockTree(false, map[string]bool{"file": false})
+	m.data["file"] = []byte("0123")
+	c := newMockClient(t, m.handle)
+	defer c.Close()
+	root, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	defer root.Close()
+
+	f, err := root.OpenFile("file", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	f.Seek(0, io.SeekStart)
+	if _, err = f.Write([]byte("45")); err != nil {
+		t.Fatalf("write: unexpected error: %v", err)
+	}
+	m.data["file"] = append(m.data["file"], '6') // concurrent writer
+	if _, err = f.Write([]byte("78")); err != nil {
+		t.Fatalf("write: unexpected error: %v", err)
+	}
+	if string(m.data["file"]) != "012345678" {
+		t.Fatalf("write: unexpected data %q", m.data["file"])
+	}
+	if _, err = f.WriteAt([]byte("x"), 0); err != errWriteAtInAppendMode {
+		t.Fatalf("writeat: expected error %v, got %v", errWriteAtInAppendMode, err)
+	}
+	f.Close()
+
+	f, err = root.OpenFile("file", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	if len(m.data["file"]) != 0 {
+		t.Fatalf("open: file not truncated, got %q", m.data["file"])
+	}
+	f.Close()
+}
+
+func TestFileReaddir(t *testing.T) {
+	m := newMockTree(false, map[string]bool{
+		"dir": true, "dir/b": false, "dir/a": true, "file": false,
+	})
+	c := newMockClient(t, m.handle)
+	defer c.Close()
+	root, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	defer root.Close()
+
+	if _, err = root.OpenFile("dir", os.O_RDWR, 0); err == nil {
+		t.Fatalf("open: expected error, got <nil>")
+	}
+	checkPathError(t, "open", err, unix.EISDIR)
+
+	f, err := root.OpenFile("dir", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	_, err = f.Read(make([]byte, 1))
+	checkPathError(t, "read", err, unix.EISDIR)
+
+	info, err := f.Readdir(-1)
+	if err != nil {
+		t.Fatalf("readdir: unexpected error: %v", err)
+	}
+	var names []string
+	for _, fi := range info {
+		names = append(names, fi.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"a", "b"}) || !info[0].IsDir() {
+		t.Fatalf("readdir: unexpected entries %v", names)
+	}
+	if _, err = f.Readdir(1); err != io.EOF {
+		t.Fatalf("readdir: expected error %v, got %v", io.EOF, err)
+	}
+	f.Close()
+
+	if f, err = root.OpenFile("dir/a/..", os.O_RDONLY, 0); err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	f.Close()
+}
+
+func TestFileReadDir(t *testing.T) {
+	m := newMockTree(false, map[string]bool{
+		"dir": true, "dir/b": false, "dir/a": true, "dir/c": false,
+	})
+	m.data["dir/b"] = []byte("data")
+	c := newMockClient(t, m.handle)
+	defer c.Close()
+	root, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	defer root.Close()
+
+	f, err := root.OpenFile("dir", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	stats := countCalls(m, proto.MessageTgetattr)
+	ents, err := f.ReadDir(-1)
+	if err != nil || len(ents) != 3 {
+		t.Fatalf("readdir: unexpected result %v, %v", ents, err)
+	}
+	if !ents[0].IsDir() || ents[1].Type() != 0 || ents[1].Name() != "b" {
+		t.Fatalf("readdir: unexpected entries %v", ents)
+	}
+	// only the directory itself is stat'ed, when read first
+	if n := countCalls(m, proto.MessageTgetattr); n != stats+1 {
+		t.Fatalf("readdir: expected 1 attribute request, got %d", n-stats)
+	}
+
+	fi, err := ents[1].Info()
+	if err != nil || fi.Size() != 4 || fi.Name() != "b" {
+		t.Fatalf("info: unexpected result %v, %v", fi, err)
+	}
+	if err = root.Unlinkat("dir/c", 0); err != nil {
+		t.Fatalf("unlinkat: unexpected error: %v", err)
+	}
+	if _, err = ents[2].Info(); !os.IsNotExist(err) {
+		t.Fatalf("info: expected not exist error, got %v", err)
+	}
+	if _, err = f.ReadDir(1); err != io.EOF {
+		t.Fatalf("readdir: expected error %v, got %v", io.EOF, err)
+	}
+
+	f.Close()
+	_, err = ents[1].Info()
+	checkPathError(t, "info", err, os.ErrClosed)
+}
@@ -0,0 +1,119 @@
+package ninep
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	_ fs.ReadDirFS  = (*dirFS)(nil) // dirFS implements fs.ReadDirFS
+	_ fs.ReadFileFS = (*dirFS)(nil) // dirFS implements fs.ReadFileFS
+	_ fs.StatFS     = (*dirFS)(nil) // dirFS implements fs.StatFS
+	_ fs.SubFS      = (*dirFS)(nil) // dirFS implements fs.SubFS
+)
+
+// dirFS implements fs.FS for the file tree below dir of a Root.
+type dirFS struct {
+	root *Root
+	dir  string
+}
+
+// FS returns a file system (an fs.FS) for the file tree of r. The
+// returned file system implements fs.ReadDirFS, fs.ReadFileFS,
+// fs.StatFS and fs.SubFS. Symbolic links are followed by Stat only.
+//
+// The file system is only valid as long as r is not closed.
+func (r *Root) FS() fs.FS { return &dirFS{root: r, dir: "."} }
+
+// join returns the path of name relative to the root. The returned
+// error describes the operation op on name if name is invalid.
+func (d *dirFS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return path.Join(d.dir, name), nil
+}
+
+// pathError rewrites the path of err to name, errors returned by Root
+// methods report the path relative to the root.
+func pathError(err error, name string) error {
+	var perr *fs.PathError
+	if errors.As(err, &perr) {
+		return &fs.PathError{Op: perr.Op, Path: name, Err: perr.Err}
+	}
+	return err
+}
+
+func (d *dirFS) Open(name string) (fs.File, error) {
+	full, err := d.join("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := d.root.Open(full)
+	if err != nil {
+		return nil, pathError(err, name)
+	}
+	f.name = name
+	return f, nil
+}
+
+func (d *dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	full, err := d.join("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := d.root.Open(full)
+	if err != nil {
+		return nil, pathError(err, name)
+	}
+	defer f.Close()
+
+	ents, err := f.ReadDir(-1)
+	for _, e := range ents {
+		// f is closed on return, look up the attributes by name.
+		e := e.(*dirEntry)
+		e.lstat = func(base string) (fs.FileInfo, error) {
+			fi, err := d.root.Lstat(path.Join(full, base))
+			return fi, pathError(err, path.Join(name, base))
+		}
+	}
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Name() < ents[j].Name() })
+	return ents, pathError(err, name)
+}
+
+func (d *dirFS) ReadFile(name string) ([]byte, error) {
+	full, err := d.join("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.root.ReadFile(full)
+	return data, pathError(err, name)
+}
+
+func (d *dirFS) Stat(name string) (fs.FileInfo, error) {
+	full, err := d.join("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := d.root.Stat(full)
+	return fi, pathError(err, name)
+}
+
+func (d *dirFS) Sub(dir string) (fs.FS, error) {
+	full, err := d.join("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := d.root.Stat(full)
+	if err != nil {
+		return nil, pathError(err, dir)
+	}
+	if !fi.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: unix.ENOTDIR}
+	}
+	return &dirFS{root: d.root, dir: full}, nil
+}
@@ -0,0 +1,41 @@
+package ninep
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	m := newMockTree(false, map[string]bool{
+		"a": false, "dir": true, "dir/b": false, "dir/sub": true,
+		"dir/sub/c": false, "empty": true,
+	})
+	m.data["a"] = []byte("hello")
+	m.data["dir/b"] = []byte("world")
+	c, r := attachMockRoot(t, m)
+	defer c.Close()
+	defer r.Close()
+
+	fsys := r.FS()
+	if err := fstest.TestFS(fsys, "a", "dir/b", "dir/sub/c", "empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := fs.Sub(fsys, "dir")
+	if err != nil {
+		t.Fatalf("sub: unexpected error: %v", err)
+	}
+	if err = fstest.TestFS(sub, "b", "sub/c"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile(sub, "b"); err != nil || string(data) != "world" {
+		t.Fatalf("readfile: unexpected result %q, %v", data, err)
+	}
+	if _, err = fs.Sub(fsys, "a"); err == nil {
+		t.Fatalf("sub: expected error, got <nil>")
+	}
+	if _, err = fsys.Open("/a"); err == nil {
+		t.Fatalf("open: expected error, got <nil>")
+	}
+}
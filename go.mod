@@ -1,6 +1,6 @@
 module github.com/azmodb/ninep
 
-go 1.12
+go 1.16
 
 require (
 	github.com/azmodb/pkg v0.0.5
@@ -0,0 +1,206 @@
+package ninep
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"time"
+
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+// Lock describes a POSIX record lock. A Length of 0 locks all bytes
+// starting at Start up to the end of the file.
+type Lock struct {
+	// Type is one of proto.LockTypeRead, proto.LockTypeWrite or
+	// proto.LockTypeUnlock.
+	Type uint8
+
+	Start  uint64
+	Length uint64
+
+	// ProcID and ClientID identify the owner of the lock.
+	ProcID   uint32
+	ClientID string
+}
+
+const (
+	minLockBackoff = 10 * time.Millisecond
+	maxLockBackoff = time.Second
+)
+
+// newClientID returns an identifier which is unique for a client. It
+// is sent as lock owner in Tlock and Tgetlock requests.
+func newClientID() string {
+	host, _ := os.Hostname()
+	var id [8]byte
+	rand.Read(id[:])
+	return host + "-" + hex.EncodeToString(id[:])
+}
+
+// Lock acquires a read (proto.LockTypeRead) or write
+// (proto.LockTypeWrite) lock on the byte range of the file represented
+// by fid. If the range is locked by another owner, Lock retries with
+// exponential backoff until the lock is acquired.
+//
+// All fids of a client share the same lock owner, as all file
+// descriptors of a process do. If a reconnecting client lost the
+// locks of fid with the connection, the next lock request on fid
+// fails with unix.ENOLCK.
+func (f *Fid) Lock(typ uint8, start, length uint64) error {
+	return f.LockContext(context.Background(), typ, start, length)
+}
+
+// LockContext is like Lock but gives up once ctx is done.
+func (f *Fid) LockContext(ctx context.Context, typ uint8, start, length uint64) error {
+	if typ != proto.LockTypeRead && typ != proto.LockTypeWrite {
+		return unix.EINVAL
+	}
+
+	backoff := minLockBackoff
+	for {
+		status, err := f.lock(ctx, typ, start, length)
+		if err != nil {
+			return err
+		}
+		switch status {
+		case proto.LockStatusSuccess:
+			return nil
+		case proto.LockStatusBlocked, proto.LockStatusGrace:
+		default:
+			return unix.ENOLCK
+		}
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		if backoff *= 2; backoff > maxLockBackoff {
+			backoff = maxLockBackoff
+		}
+	}
+}
+
+// TryLock acquires a read (proto.LockTypeRead) or write
+// (proto.LockTypeWrite) lock on the byte range of the file represented
+// by fid. If the range is locked by another owner, unix.EAGAIN is
+// returned.
+func (f *Fid) TryLock(typ uint8, start, length uint64) error {
+	return f.TryLockContext(context.Background(), typ, start, length)
+}
+
+// TryLockContext is like TryLock but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) TryLockContext(ctx context.Context, typ uint8, start, length uint64) error {
+	if typ != proto.LockTypeRead && typ != proto.LockTypeWrite {
+		return unix.EINVAL
+	}
+
+	status, err := f.lock(ctx, typ, start, length)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case proto.LockStatusSuccess:
+		return nil
+	case proto.LockStatusBlocked, proto.LockStatusGrace:
+		return unix.EAGAIN
+	}
+	return unix.ENOLCK
+}
+
+// Unlock releases the locks held on the byte range of the file
+// represented by fid.
+func (f *Fid) Unlock(start, length uint64) error {
+	return f.UnlockContext(context.Background(), start, length)
+}
+
+// UnlockContext is like Unlock but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) UnlockContext(ctx context.Context, start, length uint64) error {
+	status, err := f.lock(ctx, proto.LockTypeUnlock, start, length)
+	if err != nil {
+		return err
+	}
+	if status != proto.LockStatusSuccess {
+		return unix.ENOLCK
+	}
+	return nil
+}
+
+func (f *Fid) lock(ctx context.Context, typ uint8, start, length uint64) (uint8, error) {
+	if f.c.lostLocks(f.num) {
+		return 0, unix.ENOLCK
+	}
+
+	fcall := mustAlloc(proto.MessageTlock)
+	defer proto.Release(fcall)
+
+	tx := fcall.Tx.(*proto.Tlock)
+	tx.Fid = f.num
+	tx.Type = typ
+	tx.Start = start
+	tx.Length = length
+	tx.ProcID = f.c.procID
+	tx.ClientID = f.c.clientID
+	if err := f.c.rpc(ctx, fcall); err != nil {
+		return 0, err
+	}
+	status := fcall.Rx.(*proto.Rlock).Status
+	if status == proto.LockStatusSuccess {
+		switch {
+		case typ != proto.LockTypeUnlock:
+			f.c.trackLock(f.num, true)
+		case start == 0 && length == 0:
+			f.c.trackLock(f.num, false)
+		}
+	}
+	return status, nil
+}
+
+// GetLock tests whether a lock of the given type could be placed on the
+// byte range of the file represented by fid. If so, the returned lock
+// has type proto.LockTypeUnlock. Otherwise one of the conflicting locks
+// is returned.
+func (f *Fid) GetLock(typ uint8, start, length uint64) (Lock, error) {
+	return f.GetLockContext(context.Background(), typ, start, length)
+}
+
+// GetLockContext is like GetLock but aborts the request if ctx is done
+// before the server answered.
+func (f *Fid) GetLockContext(ctx context.Context, typ uint8, start, length uint64) (Lock, error) {
+	if typ != proto.LockTypeRead && typ != proto.LockTypeWrite {
+		return Lock{}, unix.EINVAL
+	}
+	if f.c.lostLocks(f.num) {
+		return Lock{}, unix.ENOLCK
+	}
+
+	fcall := mustAlloc(proto.MessageTgetlock)
+	defer proto.Release(fcall)
+
+	tx := fcall.Tx.(*proto.Tgetlock)
+	tx.Fid = f.num
+	tx.Type = typ
+	tx.Start = start
+	tx.Length = length
+	tx.ProcID = f.c.procID
+	tx.ClientID = f.c.clientID
+	if err := f.c.rpc(ctx, fcall); err != nil {
+		return Lock{}, err
+	}
+
+	rx := fcall.Rx.(*proto.Rgetlock)
+	return Lock{
+		Type:     rx.Type,
+		Start:    rx.Start,
+		Length:   rx.Length,
+		ProcID:   rx.ProcID,
+		ClientID: rx.ClientID,
+	}, nil
+}
@@ -0,0 +1,111 @@
+package ninep
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+// mockLock serves a single file which can be write locked as a whole
+// by one client at a time.
+type mockLock struct {
+	mu    sync.Mutex
+	owner string
+}
+
+func (m *mockLock) handle(tx, rx proto.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch tx := tx.(type) {
+	case *proto.Tlattach, *proto.Tclunk:
+	case *proto.Tgetattr:
+		rx.(*proto.Rgetattr).Stat_t = &unix.Stat_t{Mode: unix.S_IFREG | 0644}
+	case *proto.Tlock:
+		switch {
+		case tx.Type == proto.LockTypeUnlock:
+			if m.owner == tx.ClientID {
+				m.owner = ""
+			}
+		case m.owner != "" && m.owner != tx.ClientID:
+			rx.(*proto.Rlock).Status = proto.LockStatusBlocked
+		default:
+			m.owner = tx.ClientID
+		}
+	case *proto.Tgetlock:
+		rx := rx.(*proto.Rgetlock)
+		rx.Type = proto.LockTypeUnlock
+		if m.owner != "" && m.owner != tx.ClientID {
+			rx.Type = proto.LockTypeWrite
+			rx.ClientID = m.owner
+		}
+	default:
+		return unix.ENOTSUP
+	}
+	return nil
+}
+
+func attachMockLock(t *testing.T, m *mockLock) (*Client, *Fid) {
+	t.Helper()
+
+	c := newMockClient(t, m.handle)
+	f, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	return c, f
+}
+
+func TestFidLock(t *testing.T) {
+	m := &mockLock{}
+	c1, f1 := attachMockLock(t, m)
+	defer c1.Close()
+	c2, f2 := attachMockLock(t, m)
+	defer c2.Close()
+
+	if c1.clientID == c2.clientID {
+		t.Fatalf("lock: clients share id %q", c1.clientID)
+	}
+
+	if err := f1.TryLock(proto.LockTypeWrite, 0, 0); err != nil {
+		t.Fatalf("trylock: unexpected error: %v", err)
+	}
+	if err := f2.TryLock(proto.LockTypeWrite, 0, 0); err != unix.EAGAIN {
+		t.Fatalf("trylock: expected error %v, got %v", unix.EAGAIN, err)
+	}
+	lock, err := f2.GetLock(proto.LockTypeWrite, 0, 0)
+	if err != nil {
+		t.Fatalf("getlock: unexpected error: %v", err)
+	}
+	if lock.Type != proto.LockTypeWrite || lock.ClientID != c1.clientID {
+		t.Fatalf("getlock: unexpected lock %+v", lock)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err = f2.LockContext(ctx, proto.LockTypeWrite, 0, 0)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatalf("lock: expected error %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- f2.Lock(proto.LockTypeWrite, 0, 0) }()
+	time.Sleep(30 * time.Millisecond)
+	if err = f1.Unlock(0, 0); err != nil {
+		t.Fatalf("unlock: unexpected error: %v", err)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("lock: unexpected error: %v", err)
+	}
+	if m.owner != c2.clientID {
+		t.Fatalf("lock: expected owner %q, got %q", c2.clientID, m.owner)
+	}
+
+	if err = f1.TryLock(proto.LockTypeUnlock, 0, 0); err != unix.EINVAL {
+		t.Fatalf("trylock: expected error %v, got %v", unix.EINVAL, err)
+	}
+}
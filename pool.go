@@ -0,0 +1,256 @@
+package ninep
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/azmodb/ninep/proto"
+)
+
+// WithConnections makes a Client open n connections to the server,
+// using dial for all but the first. Attach distributes the attached
+// file trees round-robin over the connections and fids stay on the
+// connection of the fid they were walked from.
+//
+// ReadAt and WriteAt requests of more than one message are striped
+// across the connections. Therefore the fid is opened again on each
+// other connection on first use, by attaching its file tree and walking
+// its path. Writes to fids opened with os.O_APPEND are not striped. If
+// a striped request fails, parts of p after the returned count may
+// have been transferred.
+//
+// Clients created by Dial dial the network address if dial is nil.
+func WithConnections(n int, dial Dialer) Option {
+	return func(v interface{}) error {
+		c, ok := v.(*Client)
+		if !ok {
+			return fmt.Errorf("unknown ninep option type: %T", v)
+		}
+		if n < 1 {
+			return fmt.Errorf("invalid number of connections: %d", n)
+		}
+		c.conns = n
+		if dial != nil {
+			c.dial = dial
+		}
+		return nil
+	}
+}
+
+// connPool holds the connections of a client created WithConnections.
+// The first connection is the client itself.
+type connPool struct {
+	conns []*Client
+	next  uint32 // accessed atomically
+}
+
+// pick returns the next connection in round-robin order.
+func (p *connPool) pick() *Client {
+	n := atomic.AddUint32(&p.next, 1) - 1
+	return p.conns[n%uint32(len(p.conns))]
+}
+
+// dialPool opens the other connections of the pool with the options
+// of the client.
+func (c *Client) dialPool(opts []Option) error {
+	pool := &connPool{conns: []*Client{c}}
+	for len(pool.conns) < c.conns {
+		peer, err := c.dialPeer(opts)
+		if err != nil {
+			for _, peer := range pool.conns[1:] {
+				peer.Close()
+			}
+			return err
+		}
+		pool.conns = append(pool.conns, peer)
+	}
+	for _, conn := range pool.conns {
+		conn.pool = pool
+	}
+	return nil
+}
+
+func (c *Client) dialPeer(opts []Option) (*Client, error) {
+	rwc, err := c.dial(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	peer, err := newClient(rwc, opts...)
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+	if err = peer.handshake(proto.Version); err != nil {
+		peer.Close()
+		return nil, err
+	}
+	// all connections own the same POSIX record locks
+	peer.procID, peer.clientID = c.procID, c.clientID
+	peer.cache = c.cache
+	return peer, nil
+}
+
+// lookupFid returns the recorded state of the fid num.
+func (c *Client) lookupFid(num uint32) (fidState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st, found := c.fids[num]
+	if !found {
+		return fidState{}, false
+	}
+	return *st, true
+}
+
+// openClone opens the file described by st on c.
+func (c *Client) openClone(ctx context.Context, st fidState) (*Fid, error) {
+	root, err := c.attachFid(ctx, nil, st.attach.export, st.attach.username, int(st.attach.uid))
+	if err != nil {
+		return nil, err
+	}
+	defer root.clunk(context.Background())
+
+	fidnum, fi, err := root.walk(ctx, splitPath(st.path)...)
+	if err != nil {
+		return nil, err
+	}
+	clone := &Fid{c: c, num: fidnum, fi: fi}
+	if err = clone.open(ctx, st.flags); err != nil {
+		clone.clunk(context.Background())
+		return nil, err
+	}
+	return clone, nil
+}
+
+// stripes returns f and its clones on the other connections of the
+// pool, and the maximal data size of a request common to all of them.
+// The clones are opened on first use, without holding f.mu, while
+// concurrent callers wait for them. If the I/O of f cannot be striped,
+// only f is returned.
+func (f *Fid) stripes(ctx context.Context, size int) ([]*Fid, int) {
+	f.mu.Lock()
+	for !f.striped && f.cloning != nil && f.opened {
+		done := f.cloning
+		f.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return []*Fid{f}, size
+		}
+		f.mu.Lock()
+	}
+	if f.c.pool == nil || !f.opened {
+		f.mu.Unlock()
+		return []*Fid{f}, size
+	}
+	if !f.striped {
+		done := make(chan struct{})
+		f.cloning = done
+		f.mu.Unlock()
+		clones, striped := f.openClones(ctx)
+		f.mu.Lock()
+		f.cloning = nil
+		close(done)
+		if !f.opened {
+			f.mu.Unlock()
+			for _, clone := range clones {
+				clone.clunk(context.Background())
+			}
+			return []*Fid{f}, size
+		}
+		f.clones, f.striped = clones, striped
+	}
+	fids := append([]*Fid{f}, f.clones...)
+	f.mu.Unlock()
+
+	for _, clone := range fids[1:] {
+		if n, err := clone.iosize(); err == nil && n < size {
+			size = n
+		}
+	}
+	return fids, size
+}
+
+// openClones opens the clones of f. If a clone cannot be opened, no
+// clones are returned. Striped reports whether the clones must not be
+// opened again, which is not the case if ctx is done.
+func (f *Fid) openClones(ctx context.Context) (clones []*Fid, striped bool) {
+	st, found := f.c.lookupFid(f.num)
+	if !found || !st.opened || st.flags&os.O_APPEND != 0 {
+		return nil, true
+	}
+
+	for _, conn := range f.c.pool.conns {
+		if conn == f.c {
+			continue
+		}
+		clone, err := conn.openClone(ctx, st)
+		if err != nil {
+			for _, clone := range clones {
+				clone.clunk(context.Background())
+			}
+			return nil, ctx.Err() == nil
+		}
+		clones = append(clones, clone)
+	}
+	return clones, true
+}
+
+// clunkClones clunks the clones of f. The caller must hold f.mu.
+func (f *Fid) clunkClones(ctx context.Context) {
+	for _, clone := range f.clones {
+		clone.clunk(ctx)
+	}
+	f.clones = nil
+}
+
+// stripe transfers p at offset in chunks of size bytes using transfer.
+// The chunks are distributed round-robin over fids, which transfer
+// their chunks concurrently. It returns the number of bytes
+// transferred before the first chunk which failed or was transferred
+// partially, and the error of that chunk.
+func stripe(ctx context.Context, fids []*Fid, p []byte, offset int64, size int,
+	transfer func(*Fid, context.Context, []byte, int64) (int, error)) (int, error) {
+	type result struct {
+		n   int
+		err error
+	}
+
+	chunks := (len(p) + size - 1) / size
+	results := make([]result, chunks)
+	chunk := func(i int) []byte {
+		if end := (i + 1) * size; end < len(p) {
+			return p[i*size : end]
+		}
+		return p[i*size:]
+	}
+
+	var wg sync.WaitGroup
+	for i, fid := range fids {
+		wg.Add(1)
+		go func(i int, fid *Fid) {
+			defer wg.Done()
+			for ; i < chunks; i += len(fids) {
+				buf := chunk(i)
+				n, err := transfer(fid, ctx, buf, offset+int64(i*size))
+				results[i] = result{n: n, err: err}
+				if err != nil || n < len(buf) {
+					return
+				}
+			}
+		}(i, fid)
+	}
+	wg.Wait()
+
+	n := 0
+	for i, r := range results {
+		n += r.n
+		if r.err != nil || r.n < len(chunk(i)) {
+			return n, r.err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,201 @@
+package ninep
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/azmodb/ninep/proto"
+)
+
+// poolServer serves a mockTree on several connections. Fid numbers are
+// made unique by adding the connection number in the upper bits.
+type poolServer struct {
+	*mockTree
+
+	mu    sync.Mutex
+	conns int
+	io    []int // read and write requests per connection
+
+	gate chan struct{} // if not nil, delays opens on other connections
+}
+
+func (s *poolServer) dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	s.mu.Lock()
+	conn := s.conns
+	s.conns++
+	s.io = append(s.io, 0)
+	s.mu.Unlock()
+
+	server, client := net.Pipe()
+	go serveMock(server, func(tx, rx proto.Message) error {
+		return s.handle(conn, tx, rx)
+	})
+	return client, nil
+}
+
+func (s *poolServer) handle(conn int, tx, rx proto.Message) error {
+	base := uint32(conn) << 24
+	switch tx := tx.(type) {
+	case *proto.Tlattach:
+		tx.Fid += base
+	case *proto.Tclunk:
+		tx.Fid += base
+	case *proto.Twalk:
+		tx.Fid += base
+		tx.NewFid += base
+	case *proto.Tgetattr:
+		tx.Fid += base
+	case *proto.Tlopen:
+		tx.Fid += base
+		if s.gate != nil && conn > 0 {
+			<-s.gate
+		}
+	case *proto.Tlcreate:
+		tx.Fid += base
+	case *proto.Tread:
+		tx.Fid += base
+		s.count(conn)
+	case *proto.Twrite:
+		tx.Fid += base
+		s.count(conn)
+	}
+	return s.mockTree.handle(tx, rx)
+}
+
+func (s *poolServer) count(conn int) {
+	s.mu.Lock()
+	s.io[conn]++
+	s.mu.Unlock()
+}
+
+func TestClientConnections(t *testing.T) {
+	s := &poolServer{mockTree: newMockTree(false, map[string]bool{"dir": true})}
+	conn, _ := s.dial(context.Background())
+	c, err := NewClient(conn, WithConnections(3, s.dial), WithMaxMessageSize(1024))
+	if err != nil {
+		t.Fatalf("client: cannot initialize connection: %v", err)
+	}
+	defer c.Close()
+	if s.conns != 3 {
+		t.Fatalf("client: expected 3 connections, got %d", s.conns)
+	}
+
+	r1, err := c.AttachRoot("/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	r2, err := c.AttachRoot("/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	if r1.Fid().c == r2.Fid().c {
+		t.Fatalf("attach: expected distinct connections")
+	}
+	r2.Close()
+
+	f, err := r1.OpenFile("dir/file", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	if f.fid.c != r1.Fid().c {
+		t.Fatalf("open: fid not pinned to the connection of its root")
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	if n, err := f.WriteAt(data, 0); n != len(data) || err != nil {
+		t.Fatalf("writeat: unexpected result %d, %v", n, err)
+	}
+	if !bytes.Equal(s.data["dir/file"], data) {
+		t.Fatalf("writeat: unexpected data")
+	}
+	buf := make([]byte, len(data)+10)
+	if n, err := f.ReadAt(buf, 0); n != len(data) || err != io.EOF {
+		t.Fatalf("readat: unexpected result %d, %v", n, err)
+	}
+	if !bytes.Equal(buf[:len(data)], data) {
+		t.Fatalf("readat: unexpected data")
+	}
+	for conn, n := range s.io {
+		if n < 6 {
+			t.Fatalf("striping: %d requests on connection %d", n, conn)
+		}
+	}
+
+	f.Close()
+	r1.Close()
+	if len(s.fids) != 0 {
+		t.Fatalf("close: fids not clunked: %v", s.fids)
+	}
+}
+
+func TestClientConnectionsClones(t *testing.T) {
+	s := &poolServer{
+		mockTree: newMockTree(false, map[string]bool{"dir": true}),
+		gate:     make(chan struct{}),
+	}
+	conn, _ := s.dial(context.Background())
+	c, err := NewClient(conn, WithConnections(3, s.dial), WithMaxMessageSize(1024))
+	if err != nil {
+		t.Fatalf("client: cannot initialize connection: %v", err)
+	}
+	defer c.Close()
+
+	root, err := c.AttachRoot("/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	defer root.Close()
+	f, err := root.OpenFile("dir/file", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	defer f.Close()
+	if f.fid.c != c {
+		t.Fatalf("open: fid not opened on the first connection")
+	}
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	s.mockTree.mu.Lock()
+	s.data["dir/file"] = data
+	s.mockTree.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, len(data))
+			if n, err := f.ReadAt(buf, 0); n != len(data) || !bytes.Equal(buf, data) {
+				t.Errorf("readat: unexpected result %d, %v", n, err)
+			}
+		}()
+	}
+
+	// the fid stays usable while its clones are opened
+	for i := 0; ; i++ {
+		f.fid.mu.Lock()
+		cloning := f.fid.cloning != nil
+		f.fid.mu.Unlock()
+		if cloning {
+			break
+		}
+		if i > 5000 {
+			t.Fatalf("striping: clones are not opened")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err = f.fid.Stat(); err != nil {
+		t.Fatalf("stat: unexpected error: %v", err)
+	}
+	close(s.gate)
+	wg.Wait()
+
+	if n := countCalls(s.mockTree, proto.MessageTlopen); n != 2 {
+		t.Fatalf("striping: expected 2 clones to be opened, got %d", n)
+	}
+}
@@ -0,0 +1,25 @@
+package posix
+
+import (
+	"os"
+
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+// Getattr returns the attributes reported by stat(2), which include
+// the birth time and the generation number. The mask is ignored.
+func (fs *posixFS) Getattr(path string, mask uint64) (*Attr, error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return nil, unix.EPERM
+	}
+
+	attr := &Attr{Valid: proto.GetAttrBasic | proto.GetAttrBtime | proto.GetAttrGen}
+	if err := unix.Stat(path, &attr.Stat); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	attr.Btime = attr.Btim
+	attr.Gen = uint64(attr.Stat.Gen)
+	return attr, nil
+}
@@ -0,0 +1,116 @@
+package posix
+
+import (
+	"os"
+	"unsafe"
+
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+// statxFields maps getattr mask bits to statx(2) mask bits.
+var statxFields = []struct {
+	getattr uint64
+	statx   int
+}{
+	{proto.GetAttrMode, unix.STATX_TYPE | unix.STATX_MODE},
+	{proto.GetAttrNlink, unix.STATX_NLINK},
+	{proto.GetAttrUid, unix.STATX_UID},
+	{proto.GetAttrGid, unix.STATX_GID},
+	{proto.GetAttrRdev, unix.STATX_TYPE},
+	{proto.GetAttrAtime, unix.STATX_ATIME},
+	{proto.GetAttrMtime, unix.STATX_MTIME},
+	{proto.GetAttrCtime, unix.STATX_CTIME},
+	{proto.GetAttrIno, unix.STATX_INO},
+	{proto.GetAttrSize, unix.STATX_SIZE},
+	{proto.GetAttrBlocks, unix.STATX_BLOCKS},
+	{proto.GetAttrBtime, unix.STATX_BTIME},
+}
+
+// statxQid are the statx(2) fields always requested, since they are
+// required to derive a Qid.
+const statxQid = unix.STATX_TYPE | unix.STATX_INO | unix.STATX_MTIME |
+	unix.STATX_CTIME | unix.STATX_SIZE
+
+// fsIocGetversion is FS_IOC_GETVERSION, _IOR('v', 1, long).
+const fsIocGetversion = 0x80007601 | uint(unsafe.Sizeof(int(0)))<<16
+
+// Getattr returns the attributes selected by mask using statx(2). The
+// inode generation number is queried for regular files and
+// directories if requested. Data versions are not exposed by Linux.
+func (fs *posixFS) Getattr(path string, mask uint64) (*Attr, error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return nil, unix.EPERM
+	}
+
+	want := statxQid
+	for _, f := range statxFields {
+		if mask&f.getattr != 0 {
+			want |= f.statx
+		}
+	}
+
+	stx := &unix.Statx_t{}
+	if err := unix.Statx(unix.AT_FDCWD, path, 0, want, stx); err != nil {
+		if err == unix.ENOSYS {
+			return statAttr(path)
+		}
+		return nil, &os.PathError{Op: "statx", Path: path, Err: err}
+	}
+
+	attr := &Attr{}
+	for _, f := range statxFields {
+		if int(stx.Mask)&f.statx == f.statx {
+			attr.Valid |= f.getattr
+		}
+	}
+	attr.Dev = unix.Mkdev(stx.Dev_major, stx.Dev_minor)
+	attr.Ino = stx.Ino
+	attr.Nlink = uint64(stx.Nlink)
+	attr.Mode = uint32(stx.Mode)
+	attr.Uid = stx.Uid
+	attr.Gid = stx.Gid
+	attr.Rdev = unix.Mkdev(stx.Rdev_major, stx.Rdev_minor)
+	attr.Size = int64(stx.Size)
+	attr.Blksize = int64(stx.Blksize)
+	attr.Blocks = int64(stx.Blocks)
+	attr.Atim = statxTimespec(stx.Atime)
+	attr.Mtim = statxTimespec(stx.Mtime)
+	attr.Ctim = statxTimespec(stx.Ctime)
+	attr.Btime = statxTimespec(stx.Btime)
+
+	typ := attr.Mode & unix.S_IFMT
+	if mask&proto.GetAttrGen != 0 && (typ == unix.S_IFREG || typ == unix.S_IFDIR) {
+		if gen, err := generation(path); err == nil {
+			attr.Gen = gen
+			attr.Valid |= proto.GetAttrGen
+		}
+	}
+	return attr, nil
+}
+
+func statxTimespec(ts unix.StatxTimestamp) unix.Timespec {
+	return unix.Timespec{Sec: ts.Sec, Nsec: int64(ts.Nsec)}
+}
+
+// statAttr returns the attributes reported by stat(2), for kernels
+// without statx(2).
+func statAttr(path string) (*Attr, error) {
+	attr := &Attr{Valid: proto.GetAttrBasic}
+	if err := unix.Stat(path, &attr.Stat); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	return attr, nil
+}
+
+func generation(path string) (uint64, error) {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+
+	gen, err := unix.IoctlGetInt(fd, fsIocGetversion)
+	return uint64(uint32(gen)), err
+}
@@ -0,0 +1,48 @@
+package posix
+
+import (
+	"os"
+	"testing"
+
+	"github.com/azmodb/ninep/proto"
+)
+
+func TestGetattr(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestPosixFS(t)
+	defer os.RemoveAll(fs.root)
+
+	f, err := fs.Create("file", os.O_RDWR, 0644, uid, gid)
+	if err != nil {
+		t.Fatalf("getattr: unexpected create error: %v", err)
+	}
+	f.WriteAt([]byte("data"), 0)
+	f.Close()
+
+	stat, err := fs.Stat("file")
+	if err != nil {
+		t.Fatalf("getattr: unexpected stat error: %v", err)
+	}
+	for _, mask := range []uint64{proto.GetAttrSize, proto.GetAttrBasic, proto.GetAttrAll} {
+		attr, err := fs.Getattr("file", mask)
+		if err != nil {
+			t.Fatalf("getattr: unexpected error: %v", err)
+		}
+		if attr.Valid&mask&proto.GetAttrBasic != mask&proto.GetAttrBasic {
+			t.Fatalf("getattr: expected valid %#x, got %#x", mask&proto.GetAttrBasic, attr.Valid)
+		}
+		if attr.Ino != stat.Ino || attr.Size != 4 || attr.Mode != stat.Mode || attr.Mtim != stat.Mtim {
+			t.Fatalf("getattr: attributes %+v differ from stat %+v", attr.Stat, stat)
+		}
+		if attr.Valid&proto.GetAttrBtime != 0 && attr.Btime.Sec == 0 {
+			t.Fatalf("getattr: expected birth time, got %v", attr.Btime)
+		}
+		if attr.Valid&proto.GetAttrDataVersion != 0 {
+			t.Fatalf("getattr: unexpected data version in %#x", attr.Valid)
+		}
+	}
+
+	if _, err = fs.Getattr("missing", proto.GetAttrBasic); !os.IsNotExist(err) {
+		t.Fatalf("getattr: expected not exist error, got %v", err)
+	}
+}
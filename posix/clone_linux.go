@@ -0,0 +1,19 @@
+package posix
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ficlone is the FICLONE ioctl(2) request, see ioctl_ficlone(2).
+const ficlone = 0x40049409
+
+// clone shares the content of src with dst using copy-on-write.
+func clone(dst, src *os.File) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
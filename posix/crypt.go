@@ -0,0 +1,758 @@
+package posix
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// KeyProvider supplies the master key of an encrypted FileSystem.
+type KeyProvider interface {
+	// Key returns the master key. The key must be at least 16 bytes
+	// long.
+	Key() ([]byte, error)
+}
+
+// StaticKey is a KeyProvider returning a fixed key.
+type StaticKey []byte
+
+// Key implements KeyProvider.
+func (k StaticKey) Key() ([]byte, error) { return []byte(k), nil }
+
+// Encrypted files start with a header followed by a sequence of
+// authenticated chunks. Each chunk holds up to cryptChunkSize bytes of
+// plaintext:
+//
+//     magic[4] id[16] (nonce[12] ciphertext[n] tag[16])*
+//
+// Chunks are sealed with AES-256-GCM using a key derived from the file
+// id, a random nonce and the file id, chunk index and a final flag as
+// additional data, hence chunks cannot be swapped. All chunks but the
+// last are full, the last chunk may be empty and is the only one
+// sealed as final, hence truncating a file at a chunk boundary is
+// detected. Only truncation to an empty file goes unnoticed.
+const (
+	cryptChunkSize  = 4096
+	cryptNonceSize  = 12
+	cryptTagSize    = 16
+	cryptOverhead   = cryptNonceSize + cryptTagSize
+	cryptBlockSize  = cryptChunkSize + cryptOverhead
+	cryptIDSize     = 16
+	cryptHeaderSize = 4 + cryptIDSize
+)
+
+var cryptMagic = []byte("9PE1")
+
+// plainSize returns the plaintext size of a file of the given
+// ciphertext size.
+func plainSize(size int64) int64 {
+	if size -= cryptHeaderSize; size <= 0 {
+		return 0
+	}
+	n := (size / cryptBlockSize) * cryptChunkSize
+	if rem := size % cryptBlockSize; rem > cryptOverhead {
+		n += rem - cryptOverhead
+	}
+	return n
+}
+
+// lastChunk returns the index of the final chunk of a file of the given
+// plaintext size.
+func lastChunk(size int64) int64 { return size / cryptChunkSize }
+
+// cipherSize returns the ciphertext size of a file of the given
+// plaintext size.
+func cipherSize(size int64) int64 {
+	return cryptHeaderSize + (size/cryptChunkSize)*cryptBlockSize +
+		size%cryptChunkSize + cryptOverhead
+}
+
+func derive(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+type cryptFS struct {
+	FileSystem
+	content []byte      // content master key
+	nameKey []byte      // name nonce key
+	names   cipher.AEAD // nil if names are stored in plaintext
+
+	// locks serializes read-modify-write cycles of chunks across
+	// all open files of an inode.
+	locks inodeLocks
+}
+
+var _ (FileSystem) = (*cryptFS)(nil) // cryptFS implements FileSystem
+
+// NewCrypt returns a FileSystem which stores file contents of fs
+// encrypted in authenticated chunks, supporting random access. If
+// encryptNames is set, file names and symbolic link targets are
+// encrypted too. Extended attributes are stored in plaintext.
+//
+// Files opened write-only are opened read-write on fs, since partial
+// chunk writes require reading the chunk.
+func NewCrypt(fs FileSystem, keys KeyProvider, encryptNames bool) (FileSystem, error) {
+	key, err := keys.Key()
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < 16 {
+		return nil, unix.EINVAL
+	}
+
+	c := &cryptFS{FileSystem: fs, content: derive(key, "content")}
+	if encryptNames {
+		c.nameKey = derive(key, "name-nonce")
+		if c.names, err = newGCM(derive(key, "names")); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// encryptName deterministically encrypts name. The nonce is derived
+// from the name, hence equal names encrypt to equal ciphertexts.
+func (fs *cryptFS) encryptName(name string) string {
+	mac := hmac.New(sha256.New, fs.nameKey)
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:cryptNonceSize]
+	data := fs.names.Seal(nonce, nonce, []byte(name), nil)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (fs *cryptFS) decryptName(name string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil || len(data) < cryptOverhead {
+		return "", unix.EINVAL
+	}
+	plain, err := fs.names.Open(nil, data[:cryptNonceSize], data[cryptNonceSize:], nil)
+	if err != nil {
+		return "", unix.EINVAL
+	}
+	return string(plain), nil
+}
+
+// path returns the path of name on the underlying FileSystem.
+func (fs *cryptFS) path(path string) (string, error) {
+	if fs.names == nil {
+		return path, nil
+	}
+
+	names := split(pathClean(path))
+	for i, name := range names {
+		if names[i] = fs.encryptName(name); len(names[i]) > maxNameLen {
+			return "", unix.ENAMETOOLONG
+		}
+	}
+	return separator + join(names...), nil
+}
+
+const maxNameLen = 255
+
+func (fs *cryptFS) path2(oldpath, newpath string) (string, string, error) {
+	oldpath, err := fs.path(oldpath)
+	if err != nil {
+		return "", "", err
+	}
+	newpath, err = fs.path(newpath)
+	return oldpath, newpath, err
+}
+
+func (fs *cryptFS) Mknod(path string, perm os.FileMode, major, minor uint32, uid, gid int) error {
+	path, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Mknod(path, perm, major, minor, uid, gid)
+}
+
+func (fs *cryptFS) Mkdir(path string, perm os.FileMode, uid, gid int) error {
+	path, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Mkdir(path, perm, uid, gid)
+}
+
+// rwFlags returns flags opening a writable file read-write, for
+// files which are read before written to.
+func rwFlags(flags int) int {
+	if flags&(os.O_WRONLY|os.O_RDWR) != 0 {
+		flags = flags&^(os.O_WRONLY|os.O_APPEND) | os.O_RDWR
+	}
+	return flags
+}
+
+func (fs *cryptFS) Create(path string, flags int, perm os.FileMode, uid, gid int) (File, error) {
+	path, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := fs.FileSystem.Create(path, rwFlags(flags)|os.O_RDWR, perm, uid, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := fs.newFile(file, path)
+	if err == nil {
+		err = f.init()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs *cryptFS) Open(path string, flags int, uid, gid int) (File, error) {
+	path, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := fs.FileSystem.Open(path, rwFlags(flags), uid, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := fs.newFile(file, path)
+	if err == nil {
+		err = f.load(flags&(os.O_WRONLY|os.O_RDWR) != 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs *cryptFS) Remove(path string, uid, gid int) error {
+	path, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Remove(path, uid, gid)
+}
+
+func (fs *cryptFS) Truncate(path string, size int64, uid, gid int) error {
+	path, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	file, err := fs.FileSystem.Open(path, os.O_RDWR, uid, gid)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	f, err := fs.newFile(file, path)
+	if err != nil {
+		return err
+	}
+	if err = f.load(true); err != nil {
+		return err
+	}
+
+	unlock := fs.locks.lock(f.key)
+	defer unlock()
+	return f.truncate(size, uid, gid)
+}
+
+func (fs *cryptFS) Symlink(target, path string, uid, gid int) error {
+	path, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	if fs.names != nil {
+		target = fs.encryptName(target)
+	}
+	return fs.FileSystem.Symlink(target, path, uid, gid)
+}
+
+func (fs *cryptFS) Link(oldpath, newpath string, uid, gid int) error {
+	oldpath, newpath, err := fs.path2(oldpath, newpath)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Link(oldpath, newpath, uid, gid)
+}
+
+func (fs *cryptFS) Rename(oldpath, newpath string, uid, gid int) error {
+	oldpath, newpath, err := fs.path2(oldpath, newpath)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Rename(oldpath, newpath, uid, gid)
+}
+
+func (fs *cryptFS) Readlink(path string) (string, error) {
+	path, err := fs.path(path)
+	if err != nil {
+		return "", err
+	}
+	target, err := fs.FileSystem.Readlink(path)
+	if err != nil || fs.names == nil {
+		return target, err
+	}
+	return fs.decryptName(target)
+}
+
+func (fs *cryptFS) Chmod(path string, perm os.FileMode, uid, gid int) error {
+	path, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Chmod(path, perm, uid, gid)
+}
+
+func (fs *cryptFS) Chown(path string, owner, group int, uid, gid int) error {
+	path, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Chown(path, owner, group, uid, gid)
+}
+
+func (fs *cryptFS) Chtimes(path string, atime, mtime time.Time, uid, gid int) error {
+	path, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Chtimes(path, atime, mtime, uid, gid)
+}
+
+func (fs *cryptFS) Getxattr(path, name string, uid, gid int) ([]byte, error) {
+	path, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.FileSystem.Getxattr(path, name, uid, gid)
+}
+
+func (fs *cryptFS) Listxattr(path string, uid, gid int) ([]string, error) {
+	path, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.FileSystem.Listxattr(path, uid, gid)
+}
+
+func (fs *cryptFS) Setxattr(path, name string, data []byte, flags int, uid, gid int) error {
+	path, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Setxattr(path, name, data, flags, uid, gid)
+}
+
+func (fs *cryptFS) Removexattr(path, name string, uid, gid int) error {
+	path, err := fs.path(path)
+	if err != nil {
+		return err
+	}
+	return fs.FileSystem.Removexattr(path, name, uid, gid)
+}
+
+// plainStat converts stat to describe the plaintext file.
+func plainStat(stat *Stat) *Stat {
+	if stat.Mode&unix.S_IFMT == unix.S_IFREG {
+		stat.Size = plainSize(stat.Size)
+	}
+	return stat
+}
+
+func (fs *cryptFS) Stat(path string) (*Stat, error) {
+	path, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fs.FileSystem.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return plainStat(stat), nil
+}
+
+func (fs *cryptFS) Getattr(path string, mask uint64) (*Attr, error) {
+	path, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+	attr, err := fs.FileSystem.Getattr(path, mask)
+	if err != nil {
+		return nil, err
+	}
+	plainStat(&attr.Stat)
+	return attr, nil
+}
+
+func (fs *cryptFS) Lstat(path string) (*Stat, error) {
+	path, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fs.FileSystem.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	return plainStat(stat), nil
+}
+
+func (fs *cryptFS) Statfs(path string, uid, gid int) (*StatFS, error) {
+	path, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.FileSystem.Statfs(path, uid, gid)
+}
+
+// ReadDir returns the decrypted directory entries. Entries which
+// cannot be decrypted are omitted.
+func (fs *cryptFS) ReadDir(path string) ([]Record, error) {
+	path, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+	records, err := fs.FileSystem.ReadDir(path)
+	if err != nil || fs.names == nil {
+		return records, err
+	}
+
+	n := 0
+	for _, rec := range records {
+		if !isReserved(rec.Name) {
+			if rec.Name, err = fs.decryptName(rec.Name); err != nil {
+				continue
+			}
+		}
+		records[n] = rec
+		n++
+	}
+	return records[:n], nil
+}
+
+func (fs *cryptFS) OpenDir(path string, uid, gid int) (Dir, error) {
+	path, err := fs.path(path)
+	if err != nil {
+		return nil, err
+	}
+	d, err := fs.FileSystem.OpenDir(path, uid, gid)
+	if err != nil || fs.names == nil {
+		return d, err
+	}
+	return &cryptDir{Dir: d, fs: fs}, nil
+}
+
+// cryptDir decrypts the names of directory entries. Entries which
+// cannot be decrypted are omitted.
+type cryptDir struct {
+	Dir
+	fs *cryptFS
+}
+
+func (d *cryptDir) ReadDir(n int) ([]Record, error) {
+	for {
+		records, err := d.Dir.ReadDir(n)
+		if err != nil {
+			return nil, err
+		}
+
+		i := 0
+		for _, rec := range records {
+			if !isReserved(rec.Name) {
+				if rec.Name, err = d.fs.decryptName(rec.Name); err != nil {
+					continue
+				}
+			}
+			records[i] = rec
+			i++
+		}
+		if i > 0 || n <= 0 {
+			return records[:i], nil
+		}
+	}
+}
+
+type cryptFile struct {
+	File
+	fs   *cryptFS
+	path string   // path on the underlying FileSystem
+	key  inodeKey // lock of the underlying inode
+
+	id   []byte
+	aead cipher.AEAD
+}
+
+func (fs *cryptFS) newFile(file File, path string) (*cryptFile, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &cryptFile{File: file, fs: fs, path: path, key: keyOf(stat)}, nil
+}
+
+// init writes a new header and an empty final chunk.
+func (f *cryptFile) init() error {
+	header := make([]byte, cryptHeaderSize)
+	copy(header, cryptMagic)
+	if _, err := io.ReadFull(rand.Reader, header[len(cryptMagic):]); err != nil {
+		return err
+	}
+	if _, err := f.File.WriteAt(header, 0); err != nil {
+		return err
+	}
+	if err := f.setID(header[len(cryptMagic):]); err != nil {
+		return err
+	}
+	return f.writeChunk(0, nil, true)
+}
+
+// load reads the header and authenticates the final chunk. An empty
+// file is initialized if writable.
+func (f *cryptFile) load(writable bool) error {
+	header := make([]byte, cryptHeaderSize)
+	n, err := f.File.ReadAt(header, 0)
+	if n == 0 && err == io.EOF {
+		if writable {
+			return f.init()
+		}
+		return nil // empty file
+	}
+	if n < cryptHeaderSize || string(header[:len(cryptMagic)]) != string(cryptMagic) {
+		return unix.EIO
+	}
+	if err = f.setID(header[len(cryptMagic):]); err != nil {
+		return err
+	}
+
+	size, err := f.size()
+	if err != nil {
+		return err
+	}
+	_, err = f.readChunk(lastChunk(size), size)
+	return err
+}
+
+func (f *cryptFile) setID(id []byte) error {
+	aead, err := newGCM(derive(f.fs.content, string(id)))
+	if err != nil {
+		return err
+	}
+	f.id, f.aead = append([]byte(nil), id...), aead
+	return nil
+}
+
+func (f *cryptFile) size() (int64, error) {
+	stat, err := f.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return plainSize(stat.Size), nil
+}
+
+// Stat returns the attributes of the plaintext file.
+func (f *cryptFile) Stat() (*Stat, error) {
+	stat, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return plainStat(stat), nil
+}
+
+func (f *cryptFile) additionalData(idx int64, final bool) []byte {
+	data := make([]byte, 0, cryptIDSize+8+1)
+	data = append(data, f.id...)
+	for i := uint(0); i < 64; i += 8 {
+		data = append(data, byte(idx>>i))
+	}
+	if final {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+// readChunk returns the plaintext of chunk idx of a file of the given
+// plaintext size. If the chunk is beyond the end of file, an empty
+// chunk is returned.
+func (f *cryptFile) readChunk(idx, size int64) ([]byte, error) {
+	last := lastChunk(size)
+	if f.aead == nil || idx > last {
+		return nil, nil
+	}
+
+	buf := make([]byte, cryptBlockSize)
+	n, err := f.File.ReadAt(buf, cryptHeaderSize+idx*cryptBlockSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n < cryptOverhead {
+		return nil, unix.EIO // truncated
+	}
+
+	plain, err := f.aead.Open(buf[cryptNonceSize:cryptNonceSize], buf[:cryptNonceSize],
+		buf[cryptNonceSize:n], f.additionalData(idx, idx == last))
+	if err != nil {
+		return nil, unix.EIO // authentication failed
+	}
+	return plain, nil
+}
+
+func (f *cryptFile) writeChunk(idx int64, plain []byte, final bool) error {
+	nonce := make([]byte, cryptNonceSize, cryptBlockSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	data := f.aead.Seal(nonce, nonce, plain, f.additionalData(idx, final))
+	_, err := f.File.WriteAt(data, cryptHeaderSize+idx*cryptBlockSize)
+	return err
+}
+
+func (f *cryptFile) ReadAt(p []byte, offset int64) (int, error) {
+	unlock := f.fs.locks.lock(f.key)
+	defer unlock()
+
+	size, err := f.size()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for n < len(p) && offset < size {
+		idx := offset / cryptChunkSize
+		plain, err := f.readChunk(idx, size)
+		if err != nil {
+			return n, err
+		}
+		pos := int(offset - idx*cryptChunkSize)
+		if pos >= len(plain) {
+			break
+		}
+		m := copy(p[n:], plain[pos:])
+		n += m
+		offset += int64(m)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *cryptFile) WriteAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, unix.EINVAL
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	unlock := f.fs.locks.lock(f.key)
+	defer unlock()
+	return f.writeAt(p, offset)
+}
+
+func (f *cryptFile) writeAt(p []byte, offset int64) (int, error) {
+	if f.aead == nil {
+		return 0, unix.EBADF
+	}
+
+	size, err := f.size()
+	if err != nil {
+		return 0, err
+	}
+
+	// a write beyond the end of file fills the hole with zeros,
+	// starting at the final chunk, which is sealed as final no more
+	end := offset + int64(len(p))
+	first := offset / cryptChunkSize
+	if last := lastChunk(size); last < first {
+		first = last
+	}
+	last := lastChunk(max64(size, end))
+
+	for idx := first; idx <= last && (idx*cryptChunkSize < end || idx == last); idx++ {
+		start := idx * cryptChunkSize
+		need := end - start
+		if need > cryptChunkSize {
+			need = cryptChunkSize
+		}
+
+		var plain []byte
+		if offset <= start && end >= start+cryptChunkSize {
+			plain = make([]byte, cryptChunkSize) // overwritten entirely
+		} else if plain, err = f.readChunk(idx, size); err != nil {
+			return written(start, offset), err
+		}
+		if int64(len(plain)) < need {
+			plain = append(plain, make([]byte, need-int64(len(plain)))...)
+		}
+
+		lo, hi := max64(offset, start), min64(end, start+cryptChunkSize)
+		if lo < hi {
+			copy(plain[lo-start:hi-start], p[lo-offset:hi-offset])
+		}
+		if err = f.writeChunk(idx, plain, idx == last); err != nil {
+			return written(start, offset), err
+		}
+	}
+	return len(p), nil
+}
+
+func written(start, offset int64) int {
+	if start <= offset {
+		return 0
+	}
+	return int(start - offset)
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (f *cryptFile) truncate(size int64, uid, gid int) error {
+	cur, err := f.size()
+	if err != nil {
+		return err
+	}
+	if size > cur {
+		_, err = f.writeAt(nil, size)
+		return err
+	}
+
+	// the chunk holding the new end of file becomes the final chunk
+	idx, rem := lastChunk(size), size%cryptChunkSize
+	plain, err := f.readChunk(idx, cur)
+	if err != nil {
+		return err
+	}
+	if err = f.writeChunk(idx, plain[:rem], true); err != nil {
+		return err
+	}
+	return f.fs.FileSystem.Truncate(f.path, cipherSize(size), uid, gid)
+}
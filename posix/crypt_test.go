@@ -0,0 +1,216 @@
+package posix
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func newTestCrypt(t *testing.T, fs FileSystem, encryptNames bool) FileSystem {
+	t.Helper()
+
+	c, err := NewCrypt(fs, StaticKey("0123456789abcdef0123456789abcdef"), encryptNames)
+	if err != nil {
+		t.Fatalf("crypt: unexpected init error: %v", err)
+	}
+	return c
+}
+
+func TestCryptSizes(t *testing.T) {
+	for _, size := range []int64{0, 1, cryptChunkSize - 1, cryptChunkSize, cryptChunkSize + 1, 10 * cryptChunkSize} {
+		if n := plainSize(cipherSize(size)); n != size {
+			t.Fatalf("crypt: expected plaintext size %d, got %d", size, n)
+		}
+	}
+}
+
+func TestCryptReadWrite(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestPosixFS(t)
+	defer os.RemoveAll(fs.root)
+	c := newTestCrypt(t, fs, false)
+
+	f, err := c.Create("file", os.O_WRONLY, 0644, uid, gid)
+	if err != nil {
+		t.Fatalf("crypt: unexpected create error: %v", err)
+	}
+	defer f.Close()
+
+	want := make([]byte, 3*cryptChunkSize+100)
+	for i := range want {
+		want[i] = byte(i)
+	}
+	if _, err = f.WriteAt(want[:1000], 0); err != nil {
+		t.Fatalf("crypt: unexpected write error: %v", err)
+	}
+	if _, err = f.WriteAt(want[5000:], 5000); err != nil {
+		t.Fatalf("crypt: unexpected write error: %v", err)
+	}
+	if _, err = f.WriteAt(want[1000:5000], 1000); err != nil {
+		t.Fatalf("crypt: unexpected write error: %v", err)
+	}
+
+	stat, err := c.Stat("file")
+	if err != nil {
+		t.Fatalf("crypt: unexpected stat error: %v", err)
+	}
+	if stat.Size != int64(len(want)) {
+		t.Fatalf("crypt: expected size %d, got %d", len(want), stat.Size)
+	}
+
+	got := make([]byte, len(want)+10)
+	n, err := f.ReadAt(got, 0)
+	if err != io.EOF || n != len(want) || !bytes.Equal(got[:n], want) {
+		t.Fatalf("crypt: unexpected read %d bytes, %v", n, err)
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(fs.root, "file"))
+	if err != nil {
+		t.Fatalf("crypt: unexpected read error: %v", err)
+	}
+	if bytes.Contains(raw, want[:64]) {
+		t.Fatalf("crypt: found plaintext in backing file")
+	}
+
+	if err = c.Truncate("file", 10, uid, gid); err != nil {
+		t.Fatalf("crypt: unexpected truncate error: %v", err)
+	}
+	n, err = f.ReadAt(got, 0)
+	if n != 10 || !bytes.Equal(got[:n], want[:10]) {
+		t.Fatalf("crypt: unexpected read after truncate %d bytes, %v", n, err)
+	}
+	if err = c.Truncate("file", 20, uid, gid); err != nil {
+		t.Fatalf("crypt: unexpected truncate error: %v", err)
+	}
+	n, _ = f.ReadAt(got, 0)
+	if n != 20 || !bytes.Equal(got[10:20], make([]byte, 10)) {
+		t.Fatalf("crypt: expected zero filled extension, got %q", got[:n])
+	}
+
+	raw[cryptHeaderSize+cryptNonceSize] ^= 0xff
+	if err = ioutil.WriteFile(filepath.Join(fs.root, "file"), raw, 0644); err != nil {
+		t.Fatalf("crypt: unexpected write error: %v", err)
+	}
+	if _, err = f.ReadAt(got[:1], 0); err == nil {
+		t.Fatalf("crypt: expected authentication error")
+	}
+}
+
+func TestCryptTruncation(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestPosixFS(t)
+	defer os.RemoveAll(fs.root)
+	c := newTestCrypt(t, fs, false)
+
+	f, err := c.Create("file", os.O_WRONLY, 0644, uid, gid)
+	if err != nil {
+		t.Fatalf("crypt: unexpected create error: %v", err)
+	}
+	if _, err = f.WriteAt(make([]byte, 2*cryptChunkSize), 0); err != nil {
+		t.Fatalf("crypt: unexpected write error: %v", err)
+	}
+	f.Close()
+
+	path := filepath.Join(fs.root, "file")
+	for _, size := range []int64{cryptHeaderSize + 2*cryptBlockSize, cryptHeaderSize + cryptBlockSize, cryptHeaderSize} {
+		if err = os.Truncate(path, size); err != nil {
+			t.Fatalf("crypt: unexpected truncate error: %v", err)
+		}
+		if _, err = c.Open("file", os.O_RDONLY, uid, gid); err != unix.EIO {
+			t.Fatalf("crypt: expected open error %v at size %d, got %v", unix.EIO, size, err)
+		}
+	}
+}
+
+func TestCryptConcurrentFiles(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestPosixFS(t)
+	defer os.RemoveAll(fs.root)
+	c := newTestCrypt(t, fs, false)
+
+	f, err := c.Create("file", os.O_RDWR, 0644, uid, gid)
+	if err != nil {
+		t.Fatalf("crypt: unexpected create error: %v", err)
+	}
+	defer f.Close()
+
+	// writers of separate files of one inode update the same chunk
+	var wg sync.WaitGroup
+	errc := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			g, err := c.Open("file", os.O_WRONLY, uid, gid)
+			if err != nil {
+				errc <- err
+				return
+			}
+			defer g.Close()
+			_, err = g.WriteAt(bytes.Repeat([]byte{byte('a' + i)}, 100), int64(i*100))
+			errc <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Fatalf("crypt: unexpected write error: %v", err)
+		}
+	}
+
+	got := make([]byte, 800)
+	if _, err = f.ReadAt(got, 0); err != nil {
+		t.Fatalf("crypt: unexpected read error: %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		if want := bytes.Repeat([]byte{byte('a' + i)}, 100); !bytes.Equal(got[i*100:(i+1)*100], want) {
+			t.Fatalf("crypt: lost write %d: %q", i, got[i*100:(i+1)*100])
+		}
+	}
+}
+
+func TestCryptNames(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestPosixFS(t)
+	defer os.RemoveAll(fs.root)
+	c := newTestCrypt(t, fs, true)
+
+	if err := c.Mkdir("dir", 0755, uid, gid); err != nil {
+		t.Fatalf("crypt: unexpected mkdir error: %v", err)
+	}
+	f, err := c.Create("dir/secret", os.O_RDWR, 0644, uid, gid)
+	if err != nil {
+		t.Fatalf("crypt: unexpected create error: %v", err)
+	}
+	f.Close()
+	if err = c.Symlink("dir/secret", "link", uid, gid); err != nil {
+		t.Fatalf("crypt: unexpected symlink error: %v", err)
+	}
+
+	if _, err = os.Stat(filepath.Join(fs.root, "dir")); err == nil {
+		t.Fatalf("crypt: found plaintext name in backing directory")
+	}
+
+	records, err := c.ReadDir("dir")
+	if err != nil {
+		t.Fatalf("crypt: unexpected readdir error: %v", err)
+	}
+	found := false
+	for _, rec := range records {
+		found = found || rec.Name == "secret"
+	}
+	if !found {
+		t.Fatalf("crypt: expected decrypted name in %+v", records)
+	}
+
+	if target, err := c.Readlink("link"); err != nil || target != "dir/secret" {
+		t.Fatalf("crypt: unexpected readlink %q, %v", target, err)
+	}
+}
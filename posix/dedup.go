@@ -0,0 +1,613 @@
+package posix
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/azmodb/ninep/binary"
+	"golang.org/x/sys/unix"
+)
+
+// Chunk boundaries are content-defined using a gear rolling hash,
+// hence inserting or removing bytes only changes the chunks around the
+// modification.
+const (
+	minChunkSize = 2 << 10
+	maxChunkSize = 64 << 10
+	chunkMask    = 1<<13 - 1 // average chunk size of 8 KiB
+)
+
+var gearTable = func() (t [256]uint64) {
+	x := uint64(0)
+	for i := range t { // splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+// cut returns the length of the first chunk of data.
+func cut(data []byte) int {
+	if len(data) <= minChunkSize {
+		return len(data)
+	}
+	n := len(data)
+	if n > maxChunkSize {
+		n = maxChunkSize
+	}
+
+	var h uint64
+	for i := minChunkSize; i < n; i++ {
+		h = h<<1 + gearTable[data[i]]
+		if h&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// splitChunks splits data into content-defined chunks.
+func splitChunks(data []byte) (chunks [][]byte) {
+	for len(data) > 0 {
+		n := cut(data)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+type chunkRef struct {
+	sum  [sha256.Size]byte
+	size uint32
+}
+
+// Regular files are described by manifests listing the chunks of the
+// file:
+//
+//     size[8] n[4] (sha256[32] size[4])*n
+//
+// Manifests are stored as objects like chunks, hence are written to a
+// temporary file, synced and renamed. Regular files in the index hold
+// the sha256 of their manifest, which is replaced by a single write.
+// Hard links to a file therefore share its contents, and a crash never
+// leaves a partially written manifest. An empty index file refers to
+// an empty manifest. Trailing data after the last chunk is ignored.
+type manifest struct {
+	size   int64
+	chunks []chunkRef
+}
+
+const manifestHeaderSize = 8 + 4
+const chunkRefSize = sha256.Size + 4
+
+func (m *manifest) marshal() []byte {
+	data := make([]byte, 0, manifestHeaderSize+len(m.chunks)*chunkRefSize)
+	data = binary.PutUint64(data, uint64(m.size))
+	data = binary.PutUint32(data, uint32(len(m.chunks)))
+	for _, c := range m.chunks {
+		data = append(data, c.sum[:]...)
+		data = binary.PutUint32(data, c.size)
+	}
+	return data
+}
+
+func (m *manifest) unmarshal(data []byte) error {
+	m.size, m.chunks = 0, nil
+	if len(data) == 0 {
+		return nil // newly created file
+	}
+	if len(data) < manifestHeaderSize {
+		return unix.EIO
+	}
+
+	size, n := int64(binary.Uint64(data)), int(binary.Uint32(data[8:]))
+	data = data[manifestHeaderSize:]
+	if n < 0 || len(data)/chunkRefSize < n {
+		return unix.EIO
+	}
+	m.size, m.chunks = size, make([]chunkRef, n)
+	for i := range m.chunks {
+		copy(m.chunks[i].sum[:], data)
+		m.chunks[i].size = binary.Uint32(data[sha256.Size:])
+		data = data[chunkRefSize:]
+	}
+	return nil
+}
+
+// find returns the index and offset of the chunk containing offset. If
+// offset is beyond the last chunk, the number of chunks and the file
+// size are returned.
+func (m *manifest) find(offset int64) (int, int64) {
+	var start int64
+	for i, c := range m.chunks {
+		if offset < start+int64(c.size) {
+			return i, start
+		}
+		start += int64(c.size)
+	}
+	return len(m.chunks), start
+}
+
+// Dedup is a FileSystem storing regular file contents as
+// content-addressed chunks, deduplicating identical chunks across
+// files. The namespace and all metadata are kept in an index tree.
+type Dedup struct {
+	*posixFS
+	objects string
+
+	// mu guards objects written but not yet referenced from being
+	// collected. GC holds it exclusively.
+	mu sync.RWMutex
+
+	// locks serializes updates of the manifest of an index file.
+	locks inodeLocks
+}
+
+var _ (FileSystem) = (*Dedup)(nil) // Dedup implements FileSystem
+
+// NewDedup opens a deduplicating FileSystem rooted at dir. Chunks are
+// stored below dir/objects, the index below dir/index. Unreferenced
+// chunks are kept until GC is called.
+func NewDedup(dir string, uid, gid int) (*Dedup, error) {
+	objects, index := filepath.Join(dir, "objects"), filepath.Join(dir, "index")
+	if err := os.MkdirAll(objects, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(index, 0755); err != nil {
+		return nil, err
+	}
+
+	fs, err := newPosixFS(index, uid, gid)
+	if err != nil {
+		return nil, err
+	}
+	return &Dedup{posixFS: fs, objects: objects}, nil
+}
+
+func (fs *Dedup) object(sum [sha256.Size]byte) string {
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(fs.objects, name[:2], name[2:])
+}
+
+func (fs *Dedup) readObject(sum [sha256.Size]byte) ([]byte, error) {
+	data, err := ioutil.ReadFile(fs.object(sum))
+	if err != nil {
+		return nil, err
+	}
+	if sha256.Sum256(data) != sum {
+		return nil, unix.EIO
+	}
+	return data, nil
+}
+
+func (fs *Dedup) readChunk(c chunkRef) ([]byte, error) {
+	data, err := fs.readObject(c.sum)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != int(c.size) {
+		return nil, unix.EIO
+	}
+	return data, nil
+}
+
+// writeObject stores data unless an identical object exists already.
+// The object is written to a temporary file, synced and renamed.
+func (fs *Dedup) writeObject(data []byte) ([sha256.Size]byte, error) {
+	sum := sha256.Sum256(data)
+	path := fs.object(sum)
+	if _, err := os.Lstat(path); err == nil {
+		return sum, nil
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return sum, err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp")
+	if err != nil {
+		return sum, err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return sum, err
+}
+
+// writeChunk stores data unless an identical chunk exists already.
+func (fs *Dedup) writeChunk(data []byte) (chunkRef, error) {
+	sum, err := fs.writeObject(data)
+	return chunkRef{sum: sum, size: uint32(len(data))}, err
+}
+
+// loadManifest returns the manifest referred to by the content of an
+// index file.
+func (fs *Dedup) loadManifest(ref []byte) (*manifest, error) {
+	m := &manifest{}
+	if len(ref) == 0 {
+		return m, nil // newly created file
+	}
+	if len(ref) < sha256.Size {
+		return nil, unix.EIO
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], ref)
+	data, err := fs.readObject(sum)
+	if err != nil {
+		return nil, err
+	}
+	return m, m.unmarshal(data)
+}
+
+// readManifest reads the manifest of the regular file at path.
+func (fs *Dedup) readManifest(path string) (*manifest, error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return nil, unix.EPERM
+	}
+	ref, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.loadManifest(ref)
+}
+
+func (fs *Dedup) dataStat(path string, stat *Stat) (*Stat, error) {
+	if stat.Mode&unix.S_IFMT != unix.S_IFREG {
+		return stat, nil
+	}
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	unlock := fs.locks.lock(keyOf(stat))
+	defer unlock()
+
+	m, err := fs.readManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	stat.Size = m.size
+	stat.Blocks = (m.size + 511) / 512
+	return stat, nil
+}
+
+func (fs *Dedup) Stat(path string) (*Stat, error) {
+	stat, err := fs.posixFS.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.dataStat(path, stat)
+}
+
+func (fs *Dedup) Getattr(path string, mask uint64) (*Attr, error) {
+	attr, err := fs.posixFS.Getattr(path, mask)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fs.dataStat(path, &attr.Stat); err != nil {
+		return nil, err
+	}
+	return attr, nil
+}
+
+func (fs *Dedup) Lstat(path string) (*Stat, error) {
+	stat, err := fs.posixFS.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.dataStat(path, stat)
+}
+
+func (fs *Dedup) Create(path string, flags int, perm os.FileMode, uid, gid int) (File, error) {
+	file, err := fs.posixFS.Create(path, rwFlags(flags), perm, uid, gid)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.newFile(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs *Dedup) Open(path string, flags int, uid, gid int) (File, error) {
+	file, err := fs.posixFS.Open(path, rwFlags(flags), uid, gid)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fs.newFile(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs *Dedup) Truncate(path string, size int64, uid, gid int) error {
+	if size < 0 {
+		return unix.EINVAL
+	}
+	file, err := fs.posixFS.Open(path, os.O_RDWR, uid, gid)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	f, err := fs.newFile(file)
+	if err != nil {
+		return err
+	}
+	return f.truncate(size)
+}
+
+// GC removes all chunks not referenced by a file and returns the number
+// of removed chunks.
+func (fs *Dedup) GC() (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	live := make(map[string]struct{})
+	err := filepath.Walk(fs.root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		ref, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		m, err := fs.loadManifest(ref)
+		if err != nil {
+			return err
+		}
+		if len(ref) > 0 {
+			var sum [sha256.Size]byte
+			copy(sum[:], ref)
+			live[fs.object(sum)] = struct{}{}
+		}
+		for _, c := range m.chunks {
+			live[fs.object(c.sum)] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	err = filepath.Walk(fs.objects, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		if _, ok := live[path]; ok {
+			return nil
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+type dedupFile struct {
+	*posixFile // index file
+	fs         *Dedup
+	key        inodeKey
+}
+
+// newFile returns the dedupFile of the index file opened by posixFS.
+func (fs *Dedup) newFile(file File) (*dedupFile, error) {
+	f := file.(*posixFile)
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &dedupFile{posixFile: f, fs: fs, key: keyOf(stat)}, nil
+}
+
+// lock prevents collection of objects and serializes manifest updates.
+func (f *dedupFile) lock() func() {
+	f.fs.mu.RLock()
+	unlock := f.fs.locks.lock(f.key)
+	return func() {
+		unlock()
+		f.fs.mu.RUnlock()
+	}
+}
+
+func (f *dedupFile) load() (*manifest, error) {
+	ref := make([]byte, sha256.Size)
+	n, err := f.posixFile.ReadAt(ref, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return f.fs.loadManifest(ref[:n])
+}
+
+// store writes m as object and replaces the reference of the index
+// file.
+func (f *dedupFile) store(m *manifest) error {
+	sum, err := f.fs.writeObject(m.marshal())
+	if err != nil {
+		return err
+	}
+	if _, err = f.posixFile.WriteAt(sum[:], 0); err != nil {
+		return err
+	}
+	return f.posixFile.f.Sync()
+}
+
+// Stat returns the attributes of the file with the size recorded in its
+// manifest.
+func (f *dedupFile) Stat() (*Stat, error) {
+	stat, err := f.posixFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := f.lock()
+	defer unlock()
+
+	m, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	stat.Size = m.size
+	stat.Blocks = (m.size + 511) / 512
+	return stat, nil
+}
+
+func (f *dedupFile) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, unix.EINVAL
+	}
+
+	unlock := f.lock()
+	defer unlock()
+
+	m, err := f.load()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	i, start := m.find(offset)
+	for ; n < len(p) && i < len(m.chunks); i++ {
+		data, err := f.fs.readChunk(m.chunks[i])
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[offset+int64(n)-start:])
+		start += int64(len(data))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt rechunks the region spanning the chunks overlapped by p. If
+// offset is beyond the end of file, the hole is filled with zeros.
+func (f *dedupFile) WriteAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, unix.EINVAL
+	}
+
+	unlock := f.lock()
+	defer unlock()
+	return f.writeAt(p, offset)
+}
+
+func (f *dedupFile) writeAt(p []byte, offset int64) (int, error) {
+	m, err := f.load()
+	if err != nil {
+		return 0, err
+	}
+	if len(p) == 0 && offset <= m.size {
+		return 0, nil
+	}
+
+	// The region starts at the chunk containing offset, or the last
+	// chunk if writing at or beyond the end of file.
+	first, rstart := m.find(offset)
+	if first == len(m.chunks) && first > 0 {
+		first--
+		rstart -= int64(m.chunks[first].size)
+	}
+	end := offset + int64(len(p))
+	last, rend := m.find(end - 1)
+	if last < len(m.chunks) && end > offset {
+		rend += int64(m.chunks[last].size)
+		last++
+	}
+	if last < first {
+		last = first
+	}
+	if rend < end {
+		rend = end
+	}
+
+	region := make([]byte, rend-rstart)
+	pos := rstart
+	for _, c := range m.chunks[first:last] {
+		data, err := f.fs.readChunk(c)
+		if err != nil {
+			return 0, err
+		}
+		copy(region[pos-rstart:], data)
+		pos += int64(len(data))
+	}
+	copy(region[offset-rstart:], p)
+
+	var refs []chunkRef
+	for _, data := range splitChunks(region) {
+		c, err := f.fs.writeChunk(data)
+		if err != nil {
+			return 0, err
+		}
+		refs = append(refs, c)
+	}
+
+	chunks := append([]chunkRef{}, m.chunks[:first]...)
+	chunks = append(chunks, refs...)
+	m.chunks = append(chunks, m.chunks[last:]...)
+	if end > m.size {
+		m.size = end
+	}
+	if err = f.store(m); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (f *dedupFile) truncate(size int64) error {
+	unlock := f.lock()
+	defer unlock()
+
+	m, err := f.load()
+	if err != nil {
+		return err
+	}
+	if size >= m.size {
+		if size > m.size {
+			_, err = f.writeAt(nil, size)
+		}
+		return err
+	}
+
+	i, start := m.find(size)
+	if rem := size - start; rem > 0 {
+		data, err := f.fs.readChunk(m.chunks[i])
+		if err != nil {
+			return err
+		}
+		c, err := f.fs.writeChunk(data[:rem])
+		if err != nil {
+			return err
+		}
+		m.chunks[i] = c
+		i++
+	}
+	m.chunks, m.size = m.chunks[:i], size
+	return f.store(m)
+}
@@ -0,0 +1,233 @@
+package posix
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newTestDedup(t *testing.T) *Dedup {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "ninep-dedup-test")
+	if err != nil {
+		t.Fatalf("dedup: cannot create test directory: %v", err)
+	}
+	fs, err := NewDedup(dir, -1, -1)
+	if err != nil {
+		t.Fatalf("dedup: unexpected init error: %v", err)
+	}
+	return fs
+}
+
+func countObjects(t *testing.T, fs *Dedup) (n int) {
+	t.Helper()
+
+	filepath.Walk(fs.objects, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			n++
+		}
+		return err
+	})
+	return n
+}
+
+func writeTestFile(t *testing.T, fs FileSystem, path string, data []byte, uid, gid int) {
+	t.Helper()
+
+	f, err := fs.Create(path, os.O_WRONLY, 0644, uid, gid)
+	if err != nil {
+		t.Fatalf("dedup: unexpected create error: %v", err)
+	}
+	defer f.Close()
+	for off := 0; off < len(data); off += 32 << 10 {
+		end := off + 32<<10
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err = f.WriteAt(data[off:end], int64(off)); err != nil {
+			t.Fatalf("dedup: unexpected write error: %v", err)
+		}
+	}
+}
+
+func TestDedupChunking(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := splitChunks(data)
+	size := 0
+	for _, c := range chunks {
+		if len(c) > maxChunkSize {
+			t.Fatalf("dedup: chunk of %d bytes exceeds maximum", len(c))
+		}
+		size += len(c)
+	}
+	if size != len(data) {
+		t.Fatalf("dedup: expected %d chunked bytes, got %d", len(data), size)
+	}
+
+	// Inserting a byte only changes the chunks around the insertion.
+	shifted := append([]byte{0}, data...)
+	sums := make(map[[32]byte]bool)
+	for _, c := range chunks {
+		sums[sha256.Sum256(c)] = true
+	}
+	shared := 0
+	for _, c := range splitChunks(shifted) {
+		if sums[sha256.Sum256(c)] {
+			shared++
+		}
+	}
+	if shared < len(chunks)-2 {
+		t.Fatalf("dedup: expected %d shared chunks, got %d", len(chunks)-2, shared)
+	}
+}
+
+func TestDedupReadWrite(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestDedup(t)
+	defer os.RemoveAll(filepath.Dir(fs.root))
+
+	want := make([]byte, 300<<10)
+	rand.New(rand.NewSource(2)).Read(want)
+	writeTestFile(t, fs, "a", want, uid, gid)
+	objects := countObjects(t, fs)
+	writeTestFile(t, fs, "b", want, uid, gid)
+	if n := countObjects(t, fs); n != objects {
+		t.Fatalf("dedup: expected %d objects after writing duplicate, got %d", objects, n)
+	}
+
+	f, err := fs.Open("b", os.O_RDWR, uid, gid)
+	if err != nil {
+		t.Fatalf("dedup: unexpected open error: %v", err)
+	}
+	defer f.Close()
+
+	patch := []byte("hello world")
+	copy(want[100000:], patch)
+	if _, err = f.WriteAt(patch, 100000); err != nil {
+		t.Fatalf("dedup: unexpected write error: %v", err)
+	}
+	tail := []byte("tail")
+	if _, err = f.WriteAt(tail, int64(len(want))+10); err != nil {
+		t.Fatalf("dedup: unexpected write error: %v", err)
+	}
+	want = append(append(want, make([]byte, 10)...), tail...)
+
+	stat, err := fs.Stat("b")
+	if err != nil || stat.Size != int64(len(want)) {
+		t.Fatalf("dedup: unexpected stat %+v, %v", stat, err)
+	}
+
+	got := make([]byte, len(want)+10)
+	n, err := f.ReadAt(got, 0)
+	if err != io.EOF || n != len(want) || !bytes.Equal(got[:n], want) {
+		t.Fatalf("dedup: unexpected read %d bytes, %v", n, err)
+	}
+	n, err = f.ReadAt(got[:20], 99995)
+	if err != nil || !bytes.Equal(got[:n], want[99995:100015]) {
+		t.Fatalf("dedup: unexpected read at offset %q, %v", got[:n], err)
+	}
+
+	if err = fs.Truncate("b", 1000, uid, gid); err != nil {
+		t.Fatalf("dedup: unexpected truncate error: %v", err)
+	}
+	n, _ = f.ReadAt(got, 0)
+	if n != 1000 || !bytes.Equal(got[:n], want[:1000]) {
+		t.Fatalf("dedup: unexpected read after truncate %d bytes", n)
+	}
+	if err = fs.Truncate("b", 1010, uid, gid); err != nil {
+		t.Fatalf("dedup: unexpected truncate error: %v", err)
+	}
+	n, _ = f.ReadAt(got, 0)
+	if n != 1010 || !bytes.Equal(got[1000:n], make([]byte, 10)) {
+		t.Fatalf("dedup: expected zero filled extension, got %d bytes", n)
+	}
+}
+
+func TestDedupGC(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestDedup(t)
+	defer os.RemoveAll(filepath.Dir(fs.root))
+
+	data := make([]byte, 100<<10)
+	rand.New(rand.NewSource(3)).Read(data)
+	writeTestFile(t, fs, "a", data, uid, gid)
+	if err := fs.Link("a", "b", uid, gid); err != nil {
+		t.Fatalf("dedup: unexpected link error: %v", err)
+	}
+	if _, err := fs.GC(); err != nil { // chunks replaced by later writes
+		t.Fatalf("dedup: unexpected gc error: %v", err)
+	}
+	objects := countObjects(t, fs)
+
+	if err := fs.Remove("a", uid, gid); err != nil {
+		t.Fatalf("dedup: unexpected remove error: %v", err)
+	}
+	if n, err := fs.GC(); err != nil || n != 0 {
+		t.Fatalf("dedup: unexpected gc of referenced chunks %d, %v", n, err)
+	}
+	if err := fs.Remove("b", uid, gid); err != nil {
+		t.Fatalf("dedup: unexpected remove error: %v", err)
+	}
+	if n, err := fs.GC(); err != nil || n != objects {
+		t.Fatalf("dedup: expected gc of %d chunks, got %d, %v", objects, n, err)
+	}
+}
+
+func TestDedupConcurrentFiles(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestDedup(t)
+	defer os.RemoveAll(filepath.Dir(fs.root))
+
+	writeTestFile(t, fs, "file", nil, uid, gid)
+	var wg sync.WaitGroup
+	errc := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := fs.Open("file", os.O_WRONLY, uid, gid)
+			if err != nil {
+				errc <- err
+				return
+			}
+			defer f.Close()
+			_, err = f.WriteAt(bytes.Repeat([]byte{byte('a' + i)}, 100), int64(i*100))
+			errc <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Fatalf("dedup: unexpected write error: %v", err)
+		}
+	}
+
+	// the index file only refers to the manifest
+	if fi, err := os.Stat(filepath.Join(fs.root, "file")); err != nil || fi.Size() != sha256.Size {
+		t.Fatalf("dedup: unexpected index file %v, %v", fi, err)
+	}
+	f, err := fs.Open("file", os.O_RDONLY, uid, gid)
+	if err != nil {
+		t.Fatalf("dedup: unexpected open error: %v", err)
+	}
+	defer f.Close()
+	got := make([]byte, 800)
+	if _, err = f.ReadAt(got, 0); err != nil {
+		t.Fatalf("dedup: unexpected read error: %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		if want := bytes.Repeat([]byte{byte('a' + i)}, 100); !bytes.Equal(got[i*100:(i+1)*100], want) {
+			t.Fatalf("dedup: lost write %d: %q", i, got[i*100:(i+1)*100])
+		}
+	}
+}
@@ -109,6 +109,14 @@ func (f *Fid) Remove() error {
 // Stat returns a Stat describing the named file.
 func (f *Fid) Stat() (*Stat, error) { return f.fs.Stat(f.path) }
 
+// Getattr returns the attributes selected by mask of the file
+// represented by fid. Valid reports the attributes actually returned.
+func (f *Fid) Getattr(mask uint64) (*Attr, error) { return f.fs.Getattr(f.path, mask) }
+
+// Statfs returns a StatFS describing the file system containing the
+// file represented by fid.
+func (f *Fid) Statfs() (*StatFS, error) { return f.fs.Statfs(f.path, f.uid, f.gid) }
+
 // Close closes the fid, rendering it unusable for I/O.
 func (f *Fid) Close() error {
 	if !f.isOpened() {
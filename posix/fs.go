@@ -6,6 +6,8 @@ import (
 	"os/user"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/azmodb/pkg/log"
 	"golang.org/x/sys/unix"
@@ -20,12 +22,33 @@ var (
 // should implement this interface.
 type FileSystem interface {
 	Mknod(path string, perm os.FileMode, major, minor uint32, uid, gid int) error
+	Mkdir(path string, perm os.FileMode, uid, gid int) error
 
 	Create(path string, flags int, perm os.FileMode, uid, gid int) (File, error)
 	Open(path string, flags int, uid, gid int) (File, error)
 	Remove(path string, uid, gid int) error
+	Truncate(path string, size int64, uid, gid int) error
+
+	Symlink(target, path string, uid, gid int) error
+	Link(oldpath, newpath string, uid, gid int) error
+	Rename(oldpath, newpath string, uid, gid int) error
+	Readlink(path string) (string, error)
+
+	Chmod(path string, perm os.FileMode, uid, gid int) error
+	Chown(path string, owner, group int, uid, gid int) error
+	Chtimes(path string, atime, mtime time.Time, uid, gid int) error
+
+	Getxattr(path, name string, uid, gid int) ([]byte, error)
+	Listxattr(path string, uid, gid int) ([]string, error)
+	Setxattr(path, name string, data []byte, flags int, uid, gid int) error
+	Removexattr(path, name string, uid, gid int) error
 
 	Stat(path string) (*Stat, error)
+	Getattr(path string, mask uint64) (*Attr, error)
+	Lstat(path string) (*Stat, error)
+	Statfs(path string, uid, gid int) (*StatFS, error)
+	ReadDir(path string) ([]Record, error)
+	OpenDir(path string, uid, gid int) (Dir, error)
 
 	Lookup(username string, uid int) (gid int, err error)
 
@@ -37,12 +60,43 @@ type FileSystem interface {
 type File interface {
 	WriteAt(p []byte, offset int64) (int, error)
 	ReadAt(p []byte, offset int64) (int, error)
+	Stat() (*Stat, error)
+	Close() error
+}
+
+// Dir represents an open directory streaming its entries.
+type Dir interface {
+	// ReadDir returns the next n directory entries. If n <= 0 all
+	// remaining entries are returned. Otherwise io.EOF is returned at
+	// the end of the directory.
+	ReadDir(n int) ([]Record, error)
+
+	// Seek positions the directory at offset, which is zero or the
+	// Offset of a previously returned Record. Reading resumes with
+	// the entry following the record.
+	Seek(offset uint64) error
+
 	Close() error
 }
 
 // Stat describes a file system object.
 type Stat = unix.Stat_t
 
+// Attr describes a file system object including attributes not
+// reported by stat(2). Valid is a bitmask of proto.GetAttr* bits
+// indicating which fields are set.
+type Attr struct {
+	Valid uint64
+	Stat
+
+	Btime       unix.Timespec // time of file creation
+	Gen         uint64        // inode generation number
+	DataVersion uint64        // data version number
+}
+
+// StatFS describes a mounted file system.
+type StatFS = unix.Statfs_t
+
 type posixFS struct {
 	root string
 	euid int
@@ -100,16 +154,21 @@ func (fs *posixFS) Lookup(username string, uid int) (int, error) {
 	return int(gid), err
 }
 
+// setid sets the effective ids of the calling thread. The group is set
+// first, since an unprivileged effective user cannot change it.
 func (fs *posixFS) setid(euid, egid int) (err error) {
 	runtime.LockOSThread()
-	if euid != fs.euid {
-		if err = unix.Setreuid(-1, euid); err != nil {
+	if egid != fs.egid {
+		if err = unix.Setregid(-1, egid); err != nil {
 			runtime.UnlockOSThread()
 			return err
 		}
 	}
-	if egid != fs.egid {
-		if err = unix.Setregid(-1, egid); err != nil {
+	if euid != fs.euid {
+		if err = unix.Setreuid(-1, euid); err != nil {
+			if egid != fs.egid {
+				unix.Setregid(-1, fs.egid)
+			}
 			runtime.UnlockOSThread()
 		}
 	}
@@ -218,6 +277,283 @@ func (fs *posixFS) Mknod(path string, perm os.FileMode, major, minor uint32, uid
 	return unix.Mknod(path, uint32(perm), mkdev(major, minor))
 }
 
+func (fs *posixFS) Mkdir(path string, perm os.FileMode, uid, gid int) (err error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return unix.EPERM
+	}
+
+	if err = fs.setid(uid, gid); err != nil {
+		return err
+	}
+	defer fs.resetid(uid, gid)
+
+	return os.Mkdir(path, perm)
+}
+
+func (fs *posixFS) Truncate(path string, size int64, uid, gid int) (err error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return unix.EPERM
+	}
+
+	if err = fs.setid(uid, gid); err != nil {
+		return err
+	}
+	defer fs.resetid(uid, gid)
+
+	return os.Truncate(path, size)
+}
+
+func (fs *posixFS) Symlink(target, path string, uid, gid int) (err error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return unix.EPERM
+	}
+
+	if err = fs.setid(uid, gid); err != nil {
+		return err
+	}
+	defer fs.resetid(uid, gid)
+
+	return os.Symlink(target, path)
+}
+
+func (fs *posixFS) Link(oldpath, newpath string, uid, gid int) (err error) {
+	oldpath, ok := chroot(fs.root, oldpath)
+	if !ok {
+		return unix.EPERM
+	}
+	newpath, ok = chroot(fs.root, newpath)
+	if !ok {
+		return unix.EPERM
+	}
+
+	if err = fs.setid(uid, gid); err != nil {
+		return err
+	}
+	defer fs.resetid(uid, gid)
+
+	return os.Link(oldpath, newpath)
+}
+
+func (fs *posixFS) Rename(oldpath, newpath string, uid, gid int) (err error) {
+	oldpath, ok := chroot(fs.root, oldpath)
+	if !ok {
+		return unix.EPERM
+	}
+	newpath, ok = chroot(fs.root, newpath)
+	if !ok {
+		return unix.EPERM
+	}
+
+	if err = fs.setid(uid, gid); err != nil {
+		return err
+	}
+	defer fs.resetid(uid, gid)
+
+	// os.Rename refuses to replace directories, unlike rename(2).
+	if err = unix.Rename(oldpath, newpath); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
+func (fs *posixFS) Readlink(path string) (string, error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return "", unix.EPERM
+	}
+	return os.Readlink(path)
+}
+
+func (fs *posixFS) Chmod(path string, perm os.FileMode, uid, gid int) (err error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return unix.EPERM
+	}
+
+	if err = fs.setid(uid, gid); err != nil {
+		return err
+	}
+	defer fs.resetid(uid, gid)
+
+	return os.Chmod(path, perm)
+}
+
+func (fs *posixFS) Chown(path string, owner, group int, uid, gid int) (err error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return unix.EPERM
+	}
+
+	if err = fs.setid(uid, gid); err != nil {
+		return err
+	}
+	defer fs.resetid(uid, gid)
+
+	return os.Lchown(path, owner, group)
+}
+
+func (fs *posixFS) Chtimes(path string, atime, mtime time.Time, uid, gid int) (err error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return unix.EPERM
+	}
+
+	if err = fs.setid(uid, gid); err != nil {
+		return err
+	}
+	defer fs.resetid(uid, gid)
+
+	return os.Chtimes(path, atime, mtime)
+}
+
+func (fs *posixFS) Getxattr(path, name string, uid, gid int) (data []byte, err error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return nil, unix.EPERM
+	}
+
+	if err = fs.setid(uid, gid); err != nil {
+		return nil, err
+	}
+	defer fs.resetid(uid, gid)
+
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		data = make([]byte, size)
+		size, err = unix.Lgetxattr(path, name, data)
+		if err == unix.ERANGE {
+			continue // attribute grew in the meantime
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		return data[:size], nil
+	}
+}
+
+func (fs *posixFS) Listxattr(path string, uid, gid int) (names []string, err error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return nil, unix.EPERM
+	}
+
+	if err = fs.setid(uid, gid); err != nil {
+		return nil, err
+	}
+	defer fs.resetid(uid, gid)
+
+	var data []byte
+	for {
+		size, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+		}
+		data = make([]byte, size)
+		size, err = unix.Llistxattr(path, data)
+		if err == unix.ERANGE {
+			continue // attribute list grew in the meantime
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+		}
+		data = data[:size]
+		break
+	}
+
+	for _, name := range strings.Split(string(data), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (fs *posixFS) Setxattr(path, name string, data []byte, flags int, uid, gid int) (err error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return unix.EPERM
+	}
+
+	if err = fs.setid(uid, gid); err != nil {
+		return err
+	}
+	defer fs.resetid(uid, gid)
+
+	if err = unix.Lsetxattr(path, name, data, flags); err != nil {
+		return &os.PathError{Op: "setxattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (fs *posixFS) Removexattr(path, name string, uid, gid int) (err error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return unix.EPERM
+	}
+
+	if err = fs.setid(uid, gid); err != nil {
+		return err
+	}
+	defer fs.resetid(uid, gid)
+
+	if err = unix.Lremovexattr(path, name); err != nil {
+		return &os.PathError{Op: "removexattr", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (fs *posixFS) Statfs(path string, uid, gid int) (*StatFS, error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return nil, unix.EPERM
+	}
+
+	stat := &unix.Statfs_t{}
+	if err := unix.Statfs(path, stat); err != nil {
+		return nil, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+	return stat, nil
+}
+
+func (fs *posixFS) ReadDir(path string) ([]Record, error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return nil, unix.EPERM
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readDir(int(f.Fd()))
+}
+
+func (fs *posixFS) OpenDir(path string, uid, gid int) (Dir, error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return nil, unix.EPERM
+	}
+
+	if err := fs.setid(uid, gid); err != nil {
+		return nil, err
+	}
+	defer fs.resetid(uid, gid)
+
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "opendir", Path: path, Err: err}
+	}
+	return newDir(fd), nil
+}
+
 func (fs *posixFS) Stat(path string) (*Stat, error) {
 	path, ok := chroot(fs.root, path)
 	if !ok {
@@ -231,6 +567,19 @@ func (fs *posixFS) Stat(path string) (*Stat, error) {
 	return stat, nil
 }
 
+func (fs *posixFS) Lstat(path string) (*Stat, error) {
+	path, ok := chroot(fs.root, path)
+	if !ok {
+		return nil, unix.EPERM
+	}
+
+	stat := &unix.Stat_t{}
+	if err := unix.Lstat(path, stat); err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: path, Err: err}
+	}
+	return stat, nil
+}
+
 func (f *posixFile) WriteAt(p []byte, offset int64) (int, error) {
 	if f == nil || f.f == nil {
 		return 0, unix.EBADF
@@ -245,4 +594,15 @@ func (f *posixFile) ReadAt(p []byte, offset int64) (int, error) {
 	return f.f.ReadAt(p, offset)
 }
 
+func (f *posixFile) Stat() (*Stat, error) {
+	if f == nil || f.f == nil {
+		return nil, unix.EBADF
+	}
+	stat := &unix.Stat_t{}
+	if err := unix.Fstat(int(f.f.Fd()), stat); err != nil {
+		return nil, &os.PathError{Op: "fstat", Path: f.f.Name(), Err: err}
+	}
+	return stat, nil
+}
+
 func (f *posixFile) Close() error { return f.f.Close() }
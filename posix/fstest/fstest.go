@@ -0,0 +1,712 @@
+// Package fstest implements support for testing implementations of
+// posix.FileSystem.
+package fstest
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/azmodb/ninep/posix"
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+// User identifies a user performing file system operations.
+type User struct {
+	Uid int
+	Gid int
+}
+
+// Config configures a conformance test run.
+type Config struct {
+	// New returns a new and empty file system. New is called once for
+	// every check.
+	New func(t *testing.T) posix.FileSystem
+
+	// Owner is the user creating files. If nil, the effective user
+	// of the process is used.
+	Owner *User
+
+	// Other is an unprivileged user distinct from Owner used for
+	// permission checks. If nil, the nobody user (65534) is used if
+	// the process runs as root, otherwise permission checks are
+	// skipped.
+	Other *User
+
+	// Skip lists the names of checks which are skipped, e.g. checks
+	// of features the implementation does not support.
+	Skip []string
+}
+
+type check struct {
+	name string
+	fn   func(t *testing.T, fs posix.FileSystem, c *Config)
+}
+
+var checks = []check{
+	{"Create", testCreate},
+	{"OpenFlags", testOpenFlags},
+	{"ReadWrite", testReadWrite},
+	{"Truncate", testTruncate},
+	{"Mkdir", testMkdir},
+	{"Permissions", testPermissions},
+	{"Rename", testRename},
+	{"ReadDir", testReadDir},
+	{"DirOffsets", testDirOffsets},
+	{"Symlink", testSymlink},
+	{"Link", testLink},
+	{"Xattr", testXattr},
+	{"Chmod", testChmod},
+	{"Getattr", testGetattr},
+	{"Times", testTimes},
+}
+
+// TestFileSystem runs all checks against file systems returned by
+// c.New. Every check runs as a subtest named after the check and is
+// reported independently.
+func TestFileSystem(t *testing.T, c Config) {
+	if c.New == nil {
+		t.Fatalf("fstest: missing file system constructor")
+	}
+	if c.Owner == nil {
+		c.Owner = &User{Uid: unix.Geteuid(), Gid: unix.Getegid()}
+	}
+	if c.Other == nil && unix.Geteuid() == 0 {
+		c.Other = &User{Uid: 65534, Gid: 65534}
+	}
+
+	skip := make(map[string]bool)
+	for _, name := range c.Skip {
+		skip[name] = true
+	}
+	for _, check := range checks {
+		check := check
+		t.Run(check.name, func(t *testing.T) {
+			if skip[check.name] {
+				t.Skipf("fstest: %s check disabled", check.name)
+			}
+			fs := c.New(t)
+			defer fs.Close()
+			check.fn(t, fs, &c)
+		})
+	}
+}
+
+// errno returns the unix.Errno wrapped by err.
+func errno(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return errno(e.Err)
+	case *os.LinkError:
+		return errno(e.Err)
+	case *os.SyscallError:
+		return errno(e.Err)
+	}
+	return err
+}
+
+func expect(t *testing.T, op string, err, want error) {
+	t.Helper()
+
+	if got := errno(err); got != want {
+		t.Fatalf("%s: expected error %v, got %v", op, want, err)
+	}
+}
+
+func mustCreate(t *testing.T, fs posix.FileSystem, u *User, path string, data []byte) {
+	t.Helper()
+
+	f, err := fs.Create(path, os.O_RDWR, 0644, u.Uid, u.Gid)
+	if err != nil {
+		t.Fatalf("create %s: unexpected error: %v", path, err)
+	}
+	defer f.Close()
+	if len(data) > 0 {
+		if _, err = f.WriteAt(data, 0); err != nil {
+			t.Fatalf("write %s: unexpected error: %v", path, err)
+		}
+	}
+}
+
+func mustMkdir(t *testing.T, fs posix.FileSystem, u *User, path string, perm os.FileMode) {
+	t.Helper()
+
+	if err := fs.Mkdir(path, perm, u.Uid, u.Gid); err != nil {
+		t.Fatalf("mkdir %s: unexpected error: %v", path, err)
+	}
+}
+
+func mustStat(t *testing.T, fs posix.FileSystem, path string) *posix.Stat {
+	t.Helper()
+
+	stat, err := fs.Stat(path)
+	if err != nil {
+		t.Fatalf("stat %s: unexpected error: %v", path, err)
+	}
+	return stat
+}
+
+func mustRead(t *testing.T, fs posix.FileSystem, u *User, path string) []byte {
+	t.Helper()
+
+	f, err := fs.Open(path, os.O_RDONLY, u.Uid, u.Gid)
+	if err != nil {
+		t.Fatalf("open %s: unexpected error: %v", path, err)
+	}
+	defer f.Close()
+
+	var data []byte
+	buf := make([]byte, 4096)
+	for off := int64(0); ; {
+		n, err := f.ReadAt(buf, off)
+		data = append(data, buf[:n]...)
+		off += int64(n)
+		if err == io.EOF {
+			return data
+		}
+		if err != nil {
+			t.Fatalf("read %s: unexpected error: %v", path, err)
+		}
+	}
+}
+
+func testCreate(t *testing.T, fs posix.FileSystem, c *Config) {
+	u := c.Owner
+	mustCreate(t, fs, u, "file", nil)
+
+	stat := mustStat(t, fs, "file")
+	if stat.Mode&unix.S_IFMT != unix.S_IFREG {
+		t.Fatalf("create: expected regular file, got mode %o", stat.Mode)
+	}
+	if stat.Size != 0 {
+		t.Fatalf("create: expected empty file, got size %d", stat.Size)
+	}
+	if int(stat.Uid) != u.Uid {
+		t.Fatalf("create: expected owner %d, got %d", u.Uid, stat.Uid)
+	}
+
+	_, err := fs.Create("file", os.O_RDWR, 0644, u.Uid, u.Gid)
+	expect(t, "create existing", err, unix.EEXIST)
+	_, err = fs.Create("missing/file", os.O_RDWR, 0644, u.Uid, u.Gid)
+	expect(t, "create in missing directory", err, unix.ENOENT)
+}
+
+func testOpenFlags(t *testing.T, fs posix.FileSystem, c *Config) {
+	u := c.Owner
+	mustCreate(t, fs, u, "file", []byte("hello world"))
+
+	_, err := fs.Open("missing", os.O_RDONLY, u.Uid, u.Gid)
+	expect(t, "open missing", err, unix.ENOENT)
+
+	f, err := fs.Open("file", os.O_RDONLY, u.Uid, u.Gid)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	if _, err = f.WriteAt([]byte("x"), 0); err == nil {
+		t.Fatalf("open: expected write error on read-only file")
+	}
+	f.Close()
+
+	f, err = fs.Open("file", os.O_RDWR|os.O_TRUNC, u.Uid, u.Gid)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	f.Close()
+	if size := mustStat(t, fs, "file").Size; size != 0 {
+		t.Fatalf("open: expected size 0 after O_TRUNC, got %d", size)
+	}
+
+	mustMkdir(t, fs, u, "dir", 0755)
+	_, err = fs.Open("dir", os.O_RDWR, u.Uid, u.Gid)
+	expect(t, "open directory for writing", err, unix.EISDIR)
+	_, err = fs.Open("file/sub", os.O_RDONLY, u.Uid, u.Gid)
+	expect(t, "open below regular file", err, unix.ENOTDIR)
+}
+
+func testReadWrite(t *testing.T, fs posix.FileSystem, c *Config) {
+	u := c.Owner
+	f, err := fs.Create("file", os.O_RDWR, 0644, u.Uid, u.Gid)
+	if err != nil {
+		t.Fatalf("create: unexpected error: %v", err)
+	}
+	defer f.Close()
+
+	want := make([]byte, 3*8192+17)
+	for i := range want {
+		want[i] = byte(i % 251)
+	}
+	for _, r := range [][2]int{{8192, 20000}, {0, 100}, {20000, len(want)}, {100, 8192}} {
+		if n, err := f.WriteAt(want[r[0]:r[1]], int64(r[0])); err != nil || n != r[1]-r[0] {
+			t.Fatalf("write: unexpected write of %d bytes, %v", n, err)
+		}
+	}
+
+	got := make([]byte, len(want)+10)
+	n, err := f.ReadAt(got, 0)
+	if err != io.EOF || n != len(want) || !bytes.Equal(got[:n], want) {
+		t.Fatalf("read: unexpected read of %d bytes, %v", n, err)
+	}
+	n, err = f.ReadAt(got[:10], 12345)
+	if err != nil || !bytes.Equal(got[:n], want[12345:12355]) {
+		t.Fatalf("read: unexpected read at offset of %d bytes, %v", n, err)
+	}
+	if n, err = f.ReadAt(got, int64(len(want))+1); n != 0 || err != io.EOF {
+		t.Fatalf("read: expected EOF beyond end of file, got %d bytes, %v", n, err)
+	}
+	if size := mustStat(t, fs, "file").Size; size != int64(len(want)) {
+		t.Fatalf("write: expected size %d, got %d", len(want), size)
+	}
+
+	// Writing beyond the end of file leaves a hole reading zeros.
+	off := int64(len(want)) + 1000
+	if _, err = f.WriteAt([]byte("end"), off); err != nil {
+		t.Fatalf("write: unexpected error: %v", err)
+	}
+	n, _ = f.ReadAt(got[:1000], int64(len(want)))
+	if n != 1000 || !bytes.Equal(got[:n], make([]byte, 1000)) {
+		t.Fatalf("read: expected zero filled hole")
+	}
+}
+
+func testTruncate(t *testing.T, fs posix.FileSystem, c *Config) {
+	u := c.Owner
+	mustCreate(t, fs, u, "file", []byte("hello world"))
+
+	if err := fs.Truncate("file", 5, u.Uid, u.Gid); err != nil {
+		t.Fatalf("truncate: unexpected error: %v", err)
+	}
+	if data := mustRead(t, fs, u, "file"); string(data) != "hello" {
+		t.Fatalf("truncate: unexpected content %q", data)
+	}
+	if err := fs.Truncate("file", 8, u.Uid, u.Gid); err != nil {
+		t.Fatalf("truncate: unexpected error: %v", err)
+	}
+	if data := mustRead(t, fs, u, "file"); string(data) != "hello\x00\x00\x00" {
+		t.Fatalf("truncate: unexpected content %q", data)
+	}
+	if size := mustStat(t, fs, "file").Size; size != 8 {
+		t.Fatalf("truncate: expected size 8, got %d", size)
+	}
+	expect(t, "truncate missing", fs.Truncate("missing", 0, u.Uid, u.Gid), unix.ENOENT)
+}
+
+func testMkdir(t *testing.T, fs posix.FileSystem, c *Config) {
+	u := c.Owner
+	mustMkdir(t, fs, u, "dir", 0755)
+
+	stat := mustStat(t, fs, "dir")
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		t.Fatalf("mkdir: expected directory, got mode %o", stat.Mode)
+	}
+	expect(t, "mkdir existing", fs.Mkdir("dir", 0755, u.Uid, u.Gid), unix.EEXIST)
+	expect(t, "mkdir in missing directory", fs.Mkdir("missing/dir", 0755, u.Uid, u.Gid), unix.ENOENT)
+
+	mustCreate(t, fs, u, "dir/file", nil)
+	expect(t, "remove non-empty directory", fs.Remove("dir", u.Uid, u.Gid), unix.ENOTEMPTY)
+	if err := fs.Remove("dir/file", u.Uid, u.Gid); err != nil {
+		t.Fatalf("remove: unexpected error: %v", err)
+	}
+	if err := fs.Remove("dir", u.Uid, u.Gid); err != nil {
+		t.Fatalf("remove: unexpected error: %v", err)
+	}
+	_, err := fs.Stat("dir")
+	expect(t, "stat removed directory", err, unix.ENOENT)
+	expect(t, "remove missing", fs.Remove("dir", u.Uid, u.Gid), unix.ENOENT)
+}
+
+func testPermissions(t *testing.T, fs posix.FileSystem, c *Config) {
+	if c.Other == nil {
+		t.Skip("fstest: permission checks require a second user")
+	}
+	u, o := c.Owner, c.Other
+	if err := fs.Chmod("/", 0755, u.Uid, u.Gid); err != nil {
+		t.Fatalf("chmod: unexpected error: %v", err)
+	}
+
+	mustMkdir(t, fs, u, "private", 0700)
+	mustMkdir(t, fs, u, "public", 0755)
+	mustCreate(t, fs, u, "public/file", []byte("data"))
+	if err := fs.Chmod("public/file", 0644, u.Uid, u.Gid); err != nil {
+		t.Fatalf("chmod: unexpected error: %v", err)
+	}
+
+	_, err := fs.Open("private", os.O_RDONLY, o.Uid, o.Gid)
+	expect(t, "open private directory", err, unix.EACCES)
+	_, err = fs.Create("private/file", os.O_RDWR, 0644, o.Uid, o.Gid)
+	expect(t, "create in private directory", err, unix.EACCES)
+	_, err = fs.Create("public/other", os.O_RDWR, 0644, o.Uid, o.Gid)
+	expect(t, "create in read-only directory", err, unix.EACCES)
+
+	f, err := fs.Open("public/file", os.O_RDONLY, o.Uid, o.Gid)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	f.Close()
+	_, err = fs.Open("public/file", os.O_RDWR, o.Uid, o.Gid)
+	expect(t, "open read-only file for writing", err, unix.EACCES)
+
+	expect(t, "remove in read-only directory", fs.Remove("public/file", o.Uid, o.Gid), unix.EACCES)
+	expect(t, "rename in read-only directory",
+		fs.Rename("public/file", "public/renamed", o.Uid, o.Gid), unix.EACCES)
+	expect(t, "chmod of foreign file", fs.Chmod("public/file", 0666, o.Uid, o.Gid), unix.EPERM)
+
+	if err = fs.Chmod("public", 0777, u.Uid, u.Gid); err != nil {
+		t.Fatalf("chmod: unexpected error: %v", err)
+	}
+	mustCreate(t, fs, o, "public/other", nil)
+	if uid := mustStat(t, fs, "public/other").Uid; int(uid) != o.Uid {
+		t.Fatalf("create: expected owner %d, got %d", o.Uid, uid)
+	}
+}
+
+func testRename(t *testing.T, fs posix.FileSystem, c *Config) {
+	u := c.Owner
+	mustCreate(t, fs, u, "a", []byte("a"))
+	mustCreate(t, fs, u, "b", []byte("b"))
+	mustMkdir(t, fs, u, "dir", 0755)
+	mustMkdir(t, fs, u, "full", 0755)
+	mustCreate(t, fs, u, "full/file", nil)
+
+	if err := fs.Rename("a", "b", u.Uid, u.Gid); err != nil {
+		t.Fatalf("rename: unexpected error: %v", err)
+	}
+	if data := mustRead(t, fs, u, "b"); string(data) != "a" {
+		t.Fatalf("rename: expected replaced target, got %q", data)
+	}
+	_, err := fs.Stat("a")
+	expect(t, "stat renamed file", err, unix.ENOENT)
+
+	if err = fs.Rename("b", "b", u.Uid, u.Gid); err != nil {
+		t.Fatalf("rename: unexpected error renaming to itself: %v", err)
+	}
+	if err = fs.Rename("b", "dir/b", u.Uid, u.Gid); err != nil {
+		t.Fatalf("rename: unexpected error: %v", err)
+	}
+
+	expect(t, "rename missing", fs.Rename("missing", "x", u.Uid, u.Gid), unix.ENOENT)
+	expect(t, "rename file over directory", fs.Rename("dir/b", "full", u.Uid, u.Gid), unix.EISDIR)
+	expect(t, "rename directory over file", fs.Rename("dir", "full/file", u.Uid, u.Gid), unix.ENOTDIR)
+	expect(t, "rename directory into itself", fs.Rename("dir", "dir/sub", u.Uid, u.Gid), unix.EINVAL)
+	if err = fs.Rename("full", "dir", u.Uid, u.Gid); errno(err) != unix.ENOTEMPTY && errno(err) != unix.EEXIST {
+		t.Fatalf("rename over non-empty directory: expected error %v, got %v", unix.ENOTEMPTY, err)
+	}
+
+	mustMkdir(t, fs, u, "empty", 0755)
+	if err = fs.Rename("full", "empty", u.Uid, u.Gid); err != nil {
+		t.Fatalf("rename: unexpected error replacing empty directory: %v", err)
+	}
+	mustStat(t, fs, "empty/file")
+}
+
+func testReadDir(t *testing.T, fs posix.FileSystem, c *Config) {
+	u := c.Owner
+	mustMkdir(t, fs, u, "dir", 0755)
+
+	var want []string
+	for i := 0; i < 300; i++ {
+		name := "file-" + strconv.Itoa(i)
+		mustCreate(t, fs, u, "dir/"+name, nil)
+		want = append(want, name)
+	}
+	mustMkdir(t, fs, u, "dir/sub", 0755)
+	want = append(want, "sub")
+	sort.Strings(want)
+
+	records, err := fs.ReadDir("dir")
+	if err != nil {
+		t.Fatalf("readdir: unexpected error: %v", err)
+	}
+
+	var names []string
+	offsets := make(map[uint64]bool)
+	for _, rec := range records {
+		if offsets[rec.Offset] {
+			t.Fatalf("readdir: duplicate offset %d of %q", rec.Offset, rec.Name)
+		}
+		offsets[rec.Offset] = true
+
+		if rec.Name == "." || rec.Name == ".." {
+			continue
+		}
+		names = append(names, rec.Name)
+
+		stat := mustStat(t, fs, "dir/"+rec.Name)
+		if rec.Ino != stat.Ino {
+			t.Fatalf("readdir: %q has inode %d, stat reports %d", rec.Name, rec.Ino, stat.Ino)
+		}
+		typ := uint8(unix.DT_REG)
+		if rec.Name == "sub" {
+			typ = unix.DT_DIR
+		}
+		if rec.Type != typ {
+			t.Fatalf("readdir: %q has type %d, expected %d", rec.Name, rec.Type, typ)
+		}
+	}
+	sort.Strings(names)
+	if len(names) != len(want) {
+		t.Fatalf("readdir: expected %d entries, got %d", len(want), len(names))
+	}
+	for i := range names {
+		if names[i] != want[i] {
+			t.Fatalf("readdir: expected entry %q, got %q", want[i], names[i])
+		}
+	}
+
+	_, err = fs.ReadDir("missing")
+	expect(t, "readdir missing", err, unix.ENOENT)
+}
+
+func testDirOffsets(t *testing.T, fs posix.FileSystem, c *Config) {
+	u := c.Owner
+	mustMkdir(t, fs, u, "dir", 0755)
+	for i := 0; i < 100; i++ {
+		mustCreate(t, fs, u, "dir/file-"+strconv.Itoa(i), nil)
+	}
+
+	d, err := fs.OpenDir("dir", u.Uid, u.Gid)
+	if err != nil {
+		t.Fatalf("opendir: unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	var records []posix.Record
+	for {
+		recs, err := d.ReadDir(7)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("readdir: unexpected error: %v", err)
+		}
+		if len(recs) == 0 || len(recs) > 7 {
+			t.Fatalf("readdir: expected 1 to 7 entries, got %d", len(recs))
+		}
+		records = append(records, recs...)
+	}
+	if n := len(records); n < 100 {
+		t.Fatalf("readdir: expected at least 100 entries, got %d", n)
+	}
+
+	for _, i := range []int{0, 41, len(records) - 2} {
+		if err = d.Seek(records[i].Offset); err != nil {
+			t.Fatalf("seek: unexpected error: %v", err)
+		}
+		rest, err := d.ReadDir(0)
+		if err != nil {
+			t.Fatalf("readdir: unexpected error: %v", err)
+		}
+		if len(rest) != len(records)-i-1 || rest[0].Name != records[i+1].Name {
+			t.Fatalf("seek: expected %d entries starting at %q, got %d",
+				len(records)-i-1, records[i+1].Name, len(rest))
+		}
+	}
+
+	if err = d.Seek(0); err != nil {
+		t.Fatalf("seek: unexpected error: %v", err)
+	}
+	if all, err := d.ReadDir(0); err != nil || len(all) != len(records) {
+		t.Fatalf("seek: expected %d entries after rewind, got %d, %v", len(records), len(all), err)
+	}
+
+	_, err = fs.OpenDir("dir/file-0", u.Uid, u.Gid)
+	expect(t, "opendir of regular file", err, unix.ENOTDIR)
+}
+
+func testSymlink(t *testing.T, fs posix.FileSystem, c *Config) {
+	u := c.Owner
+	mustCreate(t, fs, u, "file", []byte("data"))
+
+	if err := fs.Symlink("file", "link", u.Uid, u.Gid); err != nil {
+		t.Fatalf("symlink: unexpected error: %v", err)
+	}
+	if target, err := fs.Readlink("link"); err != nil || target != "file" {
+		t.Fatalf("readlink: unexpected target %q, %v", target, err)
+	}
+	stat, err := fs.Lstat("link")
+	if err != nil || stat.Mode&unix.S_IFMT != unix.S_IFLNK {
+		t.Fatalf("lstat: expected symbolic link, got %+v, %v", stat, err)
+	}
+	if stat := mustStat(t, fs, "link"); stat.Mode&unix.S_IFMT != unix.S_IFREG || stat.Size != 4 {
+		t.Fatalf("stat: expected link target, got %+v", stat)
+	}
+	if data := mustRead(t, fs, u, "link"); string(data) != "data" {
+		t.Fatalf("open: unexpected content through link %q", data)
+	}
+
+	expect(t, "symlink existing", fs.Symlink("file", "link", u.Uid, u.Gid), unix.EEXIST)
+	_, err = fs.Readlink("file")
+	expect(t, "readlink of regular file", err, unix.EINVAL)
+
+	if err = fs.Symlink("missing", "dangling", u.Uid, u.Gid); err != nil {
+		t.Fatalf("symlink: unexpected error: %v", err)
+	}
+	_, err = fs.Stat("dangling")
+	expect(t, "stat dangling link", err, unix.ENOENT)
+	if _, err = fs.Lstat("dangling"); err != nil {
+		t.Fatalf("lstat: unexpected error: %v", err)
+	}
+	if err = fs.Remove("link", u.Uid, u.Gid); err != nil {
+		t.Fatalf("remove: unexpected error: %v", err)
+	}
+	mustStat(t, fs, "file")
+}
+
+func testLink(t *testing.T, fs posix.FileSystem, c *Config) {
+	u := c.Owner
+	mustCreate(t, fs, u, "file", []byte("data"))
+	mustMkdir(t, fs, u, "dir", 0755)
+
+	if err := fs.Link("file", "link", u.Uid, u.Gid); err != nil {
+		t.Fatalf("link: unexpected error: %v", err)
+	}
+	a, b := mustStat(t, fs, "file"), mustStat(t, fs, "link")
+	if a.Nlink != 2 || a.Ino != b.Ino {
+		t.Fatalf("link: expected shared inode with 2 links, got %d (%d, %d)", a.Nlink, a.Ino, b.Ino)
+	}
+
+	f, err := fs.Open("link", os.O_RDWR, u.Uid, u.Gid)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	if _, err = f.WriteAt([]byte("DA"), 0); err != nil {
+		t.Fatalf("write: unexpected error: %v", err)
+	}
+	f.Close()
+	if data := mustRead(t, fs, u, "file"); string(data) != "DAta" {
+		t.Fatalf("link: expected shared content, got %q", data)
+	}
+
+	expect(t, "link existing", fs.Link("file", "link", u.Uid, u.Gid), unix.EEXIST)
+	expect(t, "link directory", fs.Link("dir", "dirlink", u.Uid, u.Gid), unix.EPERM)
+	expect(t, "link missing", fs.Link("missing", "x", u.Uid, u.Gid), unix.ENOENT)
+
+	if err = fs.Remove("file", u.Uid, u.Gid); err != nil {
+		t.Fatalf("remove: unexpected error: %v", err)
+	}
+	if stat := mustStat(t, fs, "link"); stat.Nlink != 1 {
+		t.Fatalf("remove: expected 1 link, got %d", stat.Nlink)
+	}
+}
+
+func testXattr(t *testing.T, fs posix.FileSystem, c *Config) {
+	u := c.Owner
+	mustCreate(t, fs, u, "file", nil)
+
+	err := fs.Setxattr("file", "user.test", []byte("value"), 0, u.Uid, u.Gid)
+	if errno(err) == unix.ENOTSUP {
+		t.Skip("fstest: extended attributes not supported")
+	}
+	if err != nil {
+		t.Fatalf("setxattr: unexpected error: %v", err)
+	}
+	if data, err := fs.Getxattr("file", "user.test", u.Uid, u.Gid); err != nil || string(data) != "value" {
+		t.Fatalf("getxattr: unexpected value %q, %v", data, err)
+	}
+	names, err := fs.Listxattr("file", u.Uid, u.Gid)
+	if err != nil {
+		t.Fatalf("listxattr: unexpected error: %v", err)
+	}
+	found := false
+	for _, name := range names {
+		found = found || name == "user.test"
+	}
+	if !found {
+		t.Fatalf("listxattr: expected user.test in %q", names)
+	}
+
+	expect(t, "setxattr create existing",
+		fs.Setxattr("file", "user.test", nil, unix.XATTR_CREATE, u.Uid, u.Gid), unix.EEXIST)
+	expect(t, "setxattr replace missing",
+		fs.Setxattr("file", "user.missing", nil, unix.XATTR_REPLACE, u.Uid, u.Gid), unix.ENODATA)
+
+	if err = fs.Removexattr("file", "user.test", u.Uid, u.Gid); err != nil {
+		t.Fatalf("removexattr: unexpected error: %v", err)
+	}
+	_, err = fs.Getxattr("file", "user.test", u.Uid, u.Gid)
+	expect(t, "getxattr removed", err, unix.ENODATA)
+	expect(t, "removexattr missing", fs.Removexattr("file", "user.test", u.Uid, u.Gid), unix.ENODATA)
+}
+
+func testChmod(t *testing.T, fs posix.FileSystem, c *Config) {
+	u := c.Owner
+	mustCreate(t, fs, u, "file", nil)
+
+	for _, perm := range []os.FileMode{0600, 0751, 0644} {
+		if err := fs.Chmod("file", perm, u.Uid, u.Gid); err != nil {
+			t.Fatalf("chmod: unexpected error: %v", err)
+		}
+		if stat := mustStat(t, fs, "file"); os.FileMode(stat.Mode&0777) != perm {
+			t.Fatalf("chmod: expected mode %o, got %o", perm, stat.Mode&0777)
+		}
+	}
+	expect(t, "chmod missing", fs.Chmod("missing", 0644, u.Uid, u.Gid), unix.ENOENT)
+}
+
+func testGetattr(t *testing.T, fs posix.FileSystem, c *Config) {
+	u := c.Owner
+	mustCreate(t, fs, u, "file", []byte("data"))
+
+	stat := mustStat(t, fs, "file")
+	attr, err := fs.Getattr("file", proto.GetAttrAll)
+	if err != nil {
+		t.Fatalf("getattr: unexpected error: %v", err)
+	}
+	for _, bit := range []uint64{proto.GetAttrMode, proto.GetAttrIno, proto.GetAttrSize, proto.GetAttrMtime} {
+		if attr.Valid&bit == 0 {
+			t.Fatalf("getattr: expected valid bit %#x in %#x", bit, attr.Valid)
+		}
+	}
+	if attr.Ino != stat.Ino || attr.Size != stat.Size || attr.Mode != stat.Mode {
+		t.Fatalf("getattr: attributes differ from stat: %+v, %+v", attr.Stat, *stat)
+	}
+
+	_, err = fs.Getattr("missing", proto.GetAttrBasic)
+	expect(t, "getattr missing", err, unix.ENOENT)
+}
+
+func mtime(stat *posix.Stat) time.Time {
+	return time.Unix(int64(stat.Mtim.Sec), int64(stat.Mtim.Nsec))
+}
+
+func testTimes(t *testing.T, fs posix.FileSystem, c *Config) {
+	u := c.Owner
+	mustMkdir(t, fs, u, "dir", 0755)
+	mustCreate(t, fs, u, "dir/file", []byte("data"))
+
+	past := time.Unix(1000000000, 0)
+	for _, path := range []string{"dir", "dir/file"} {
+		if err := fs.Chtimes(path, past, past, u.Uid, u.Gid); err != nil {
+			t.Fatalf("chtimes: unexpected error: %v", err)
+		}
+		stat := mustStat(t, fs, path)
+		if atime := time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec)); !atime.Equal(past) {
+			t.Fatalf("chtimes: expected atime %v, got %v", past, atime)
+		}
+		if !mtime(stat).Equal(past) {
+			t.Fatalf("chtimes: expected mtime %v, got %v", past, mtime(stat))
+		}
+	}
+
+	f, err := fs.Open("dir/file", os.O_RDWR, u.Uid, u.Gid)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	if _, err = f.WriteAt([]byte("more"), 4); err != nil {
+		t.Fatalf("write: unexpected error: %v", err)
+	}
+	f.Close()
+	if m := mtime(mustStat(t, fs, "dir/file")); !m.After(past) {
+		t.Fatalf("write: expected updated mtime, got %v", m)
+	}
+
+	mustCreate(t, fs, u, "dir/new", nil)
+	if m := mtime(mustStat(t, fs, "dir")); !m.After(past) {
+		t.Fatalf("create: expected updated directory mtime, got %v", m)
+	}
+	expect(t, "chtimes missing", fs.Chtimes("missing", past, past, u.Uid, u.Gid), unix.ENOENT)
+}
@@ -0,0 +1,111 @@
+package fstest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/azmodb/ninep/posix"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "ninep-fstest")
+	if err != nil {
+		t.Fatalf("cannot create test directory: %v", err)
+	}
+	return dir
+}
+
+func newPosix(t *testing.T) (posix.FileSystem, func()) {
+	t.Helper()
+
+	root := tempDir(t)
+	fs, err := posix.Open(root, -1, -1)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatalf("cannot init posix filesystem: %v", err)
+	}
+	return fs, func() { os.RemoveAll(root) }
+}
+
+// cleanup removes the backing directories after the check finished.
+type cleanup struct {
+	posix.FileSystem
+	fn func()
+}
+
+func (c cleanup) Close() error {
+	err := c.FileSystem.Close()
+	c.fn()
+	return err
+}
+
+func TestPosix(t *testing.T) {
+	TestFileSystem(t, Config{New: func(t *testing.T) posix.FileSystem {
+		fs, fn := newPosix(t)
+		return cleanup{fs, fn}
+	}})
+}
+
+func TestCrypt(t *testing.T) {
+	for _, names := range []bool{false, true} {
+		names := names
+		TestFileSystem(t, Config{New: func(t *testing.T) posix.FileSystem {
+			fs, fn := newPosix(t)
+			c, err := posix.NewCrypt(fs, posix.StaticKey("0123456789abcdef"), names)
+			if err != nil {
+				fn()
+				t.Fatalf("cannot init crypt filesystem: %v", err)
+			}
+			return cleanup{c, fn}
+		}})
+	}
+}
+
+func TestDedup(t *testing.T) {
+	TestFileSystem(t, Config{New: func(t *testing.T) posix.FileSystem {
+		dir := tempDir(t)
+		os.Chmod(dir, 0755) // the index is below dir
+		fs, err := posix.NewDedup(dir, -1, -1)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("cannot init dedup filesystem: %v", err)
+		}
+		return cleanup{fs, func() { os.RemoveAll(dir) }}
+	}})
+}
+
+func TestQuota(t *testing.T) {
+	TestFileSystem(t, Config{New: func(t *testing.T) posix.FileSystem {
+		fs, fn := newPosix(t)
+		q, err := posix.NewQuota(fs, posix.Quota{Export: posix.Limits{
+			Bytes: posix.Limit{Hard: 1 << 30},
+		}})
+		if err != nil {
+			fn()
+			t.Fatalf("cannot init quota filesystem: %v", err)
+		}
+		return cleanup{q, fn}
+	}})
+}
+
+func TestJournal(t *testing.T) {
+	TestFileSystem(t, Config{New: func(t *testing.T) posix.FileSystem {
+		fs, fn := newPosix(t)
+		dir := tempDir(t)
+		j, err := posix.OpenJournal(filepath.Join(dir, "journal"))
+		if err != nil {
+			fn()
+			os.RemoveAll(dir)
+			t.Fatalf("cannot open journal: %v", err)
+		}
+		return cleanup{posix.NewJournal(fs, j), func() {
+			j.Close()
+			os.RemoveAll(dir)
+			fn()
+		}}
+	}})
+}
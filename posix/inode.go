@@ -0,0 +1,71 @@
+package posix
+
+import "sync"
+
+// inodeKey identifies a file system object independent of its names.
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+func keyOf(stat *Stat) inodeKey {
+	return inodeKey{dev: uint64(stat.Dev), ino: stat.Ino}
+}
+
+type inodeLock struct {
+	sync.Mutex
+	refs int
+}
+
+// inodeLocks hands out a mutex per file system object. Mutexes are
+// dropped once no longer used.
+type inodeLocks struct {
+	mu    sync.Mutex
+	locks map[inodeKey]*inodeLock
+}
+
+// lock locks the mutex of key and returns a function unlocking it.
+func (l *inodeLocks) lock(key inodeKey) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[inodeKey]*inodeLock)
+	}
+	m, found := l.locks[key]
+	if !found {
+		m = &inodeLock{}
+		l.locks[key] = m
+	}
+	m.refs++
+	l.mu.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+		l.mu.Lock()
+		if m.refs--; m.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// lockPath locks the object named by path, as returned by stat, and
+// returns its attributes. The object is looked up again once locked,
+// in case path has been replaced meanwhile.
+func (l *inodeLocks) lockPath(path string, stat func(string) (*Stat, error)) (*Stat, func(), error) {
+	for {
+		st, err := stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		unlock := l.lock(keyOf(st))
+		again, err := stat(path)
+		if err == nil && keyOf(again) == keyOf(st) {
+			return again, unlock, nil
+		}
+		unlock()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
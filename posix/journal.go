@@ -0,0 +1,810 @@
+package posix
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/azmodb/ninep/binary"
+	"golang.org/x/sys/unix"
+)
+
+// Op identifies a journaled file system mutation.
+type Op uint8
+
+// Defines journaled file system mutations.
+const (
+	OpCreate Op = iota + 1
+	OpWrite
+	OpTruncate
+	OpMkdir
+	OpMknod
+	OpSymlink
+	OpLink
+	OpRename
+	OpRemove
+	OpChmod
+	OpChown
+	OpChtimes
+	OpSetxattr
+	OpRemovexattr
+)
+
+// Entry describes a successful file system mutation. Fields not used by
+// an operation are zero.
+type Entry struct {
+	Seq uint64 // monotonic sequence number
+	Op  Op
+	Uid int // acting user
+	Gid int // acting group
+
+	Path   string
+	Target string // new path, link target or xattr name
+
+	Perm  os.FileMode
+	Major uint32
+	Minor uint32
+	Flags int
+
+	Offset int64 // write offset or truncate size
+	Data   []byte
+
+	Owner int
+	Group int
+	Atime time.Time
+	Mtime time.Time
+}
+
+const (
+	journalHeaderSize = 8     // base[8]
+	entryHeaderSize   = 4 + 4 // size[4] crc[4]
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func (e *Entry) marshal() []byte {
+	buf := binary.NewBuffer(nil)
+	buf.PutUint64(e.Seq)
+	buf.PutUint8(uint8(e.Op))
+	buf.PutUint32(uint32(e.Uid))
+	buf.PutUint32(uint32(e.Gid))
+	buf.PutString(e.Path)
+	buf.PutString(e.Target)
+	buf.PutUint32(uint32(e.Perm))
+	buf.PutUint32(e.Major)
+	buf.PutUint32(e.Minor)
+	buf.PutUint32(uint32(e.Flags))
+	buf.PutUint64(uint64(e.Offset))
+	buf.PutUint32(uint32(e.Owner))
+	buf.PutUint32(uint32(e.Group))
+	buf.PutUint64(uint64(unixNano(e.Atime)))
+	buf.PutUint64(uint64(unixNano(e.Mtime)))
+
+	payload := append(buf.Bytes(), e.Data...)
+	data := make([]byte, 0, entryHeaderSize+len(payload))
+	data = binary.PutUint32(data, uint32(len(payload)))
+	data = binary.PutUint32(data, crc32.Checksum(payload, crcTable))
+	return append(data, payload...)
+}
+
+func (e *Entry) unmarshal(payload []byte) error {
+	buf := binary.NewBuffer(payload)
+	e.Seq = buf.Uint64()
+	e.Op = Op(buf.Uint8())
+	e.Uid = int(int32(buf.Uint32()))
+	e.Gid = int(int32(buf.Uint32()))
+	e.Path = buf.String()
+	e.Target = buf.String()
+	e.Perm = os.FileMode(buf.Uint32())
+	e.Major = buf.Uint32()
+	e.Minor = buf.Uint32()
+	e.Flags = int(int32(buf.Uint32()))
+	e.Offset = int64(buf.Uint64())
+	e.Owner = int(int32(buf.Uint32()))
+	e.Group = int(int32(buf.Uint32()))
+	e.Atime = unixTime(int64(buf.Uint64()))
+	e.Mtime = unixTime(int64(buf.Uint64()))
+	if err := buf.Err(); err != nil {
+		return err
+	}
+	e.Data = append([]byte(nil), buf.Bytes()...)
+	return nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func unixTime(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+// readEntry reads the next entry from r. Io.EOF is returned if r holds
+// no complete entry.
+func readEntry(r io.Reader, e *Entry) (int64, error) {
+	header := make([]byte, entryHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return 0, err
+	}
+
+	size, crc := binary.Uint32(header[:4]), binary.Uint32(header[4:])
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != crc {
+		return 0, io.EOF // torn write
+	}
+	return entryHeaderSize + int64(size), e.unmarshal(payload)
+}
+
+// Journal is a durable, append-only log of file system mutations.
+// Every entry is synced to stable storage before Append returns,
+// concurrent appends share a sync. Entries are delivered by Tail once
+// synced. A Journal is safe for use by multiple goroutines
+// simultaneously.
+type Journal struct {
+	path string
+
+	mu       sync.Mutex // protects following
+	f        *os.File
+	seq      uint64        // of the last written entry
+	synced   uint64        // of the last synced entry
+	syncing  bool          // a sync is in progress, see commit
+	syncCond *sync.Cond    // signaled when a sync completed
+	gen      uint64        // incremented by Compact
+	notify   chan struct{} // closed on sync
+	closed   bool
+}
+
+var (
+	errJournalClosed    = errors.New("journal is closed")
+	errJournalCompacted = errors.New("journal entries have been compacted")
+)
+
+// OpenJournal opens the journal stored in the named file, creating it
+// if it does not exist. A partially written last entry is discarded.
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	seq, size, err := scanJournal(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err = f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	j := &Journal{
+		path:   path,
+		f:      f,
+		seq:    seq,
+		synced: seq,
+		notify: make(chan struct{}),
+	}
+	j.syncCond = sync.NewCond(&j.mu)
+	return j, nil
+}
+
+// scanJournal returns the last sequence number and the size of all
+// complete entries. An empty file is initialized.
+func scanJournal(f *os.File) (uint64, int64, error) {
+	header := make([]byte, journalHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, 0, err
+		}
+		header = binary.PutUint64(header[:0], 0)
+		if _, err = f.WriteAt(header, 0); err != nil {
+			return 0, 0, err
+		}
+		return 0, journalHeaderSize, f.Sync()
+	}
+
+	seq, size := binary.Uint64(header), int64(journalHeaderSize)
+	r := bufio.NewReader(f)
+	for {
+		e := Entry{}
+		n, err := readEntry(r, &e)
+		if err == io.EOF {
+			return seq, size, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		seq, size = e.Seq, size+n
+	}
+}
+
+// Seq returns the sequence number of the last synced entry.
+func (j *Journal) Seq() uint64 {
+	j.mu.Lock()
+	seq := j.synced
+	j.mu.Unlock()
+	return seq
+}
+
+// Append assigns the next sequence number to e and appends it to the
+// journal.
+func (j *Journal) Append(e *Entry) error {
+	if err := j.write(e); err != nil {
+		return err
+	}
+	return j.commit(e.Seq)
+}
+
+// write assigns the next sequence number to e and writes it to the
+// journal, without syncing it.
+func (j *Journal) write(e *Entry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return errJournalClosed
+	}
+	e.Seq = j.seq + 1
+	if _, err := j.f.Write(e.marshal()); err != nil {
+		return err
+	}
+	j.seq = e.Seq
+	return nil
+}
+
+// commit waits until the entry seq is synced to stable storage. If no
+// sync is in progress, commit syncs all entries written so far,
+// otherwise it waits for the sync in progress, which may cover seq.
+func (j *Journal) commit(seq uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for j.synced < seq {
+		if j.closed {
+			return errJournalClosed
+		}
+		if j.syncing {
+			j.syncCond.Wait()
+			continue
+		}
+
+		j.syncing = true
+		f, last := j.f, j.seq
+		j.mu.Unlock()
+		err := f.Sync()
+		j.mu.Lock()
+		j.syncing = false
+		j.syncCond.Broadcast()
+		if err != nil {
+			return err
+		}
+		if last > j.synced {
+			j.synced = last
+			close(j.notify)
+			j.notify = make(chan struct{})
+		}
+	}
+	return nil
+}
+
+// idle waits until no sync is in progress. The caller must hold j.mu.
+func (j *Journal) idle() {
+	for j.syncing {
+		j.syncCond.Wait()
+	}
+}
+
+func (j *Journal) state() (uint64, uint64, chan struct{}, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.synced, j.gen, j.notify, j.closed
+}
+
+// Tail calls fn for every entry with a sequence number greater than
+// seq, in order. Once all entries have been delivered Tail waits for
+// new entries until ctx is done or the journal is closed. If fn returns
+// an error, Tail stops and returns that error. If entries following seq
+// have been discarded by Compact, errJournalCompacted is returned.
+func (j *Journal) Tail(ctx context.Context, seq uint64, fn func(*Entry) error) error {
+	var f *os.File
+	var r *bufio.Reader
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	gen := ^uint64(0)
+	for {
+		last, g, notify, closed := j.state()
+		if closed {
+			return errJournalClosed
+		}
+		if g != gen { // journal has been compacted
+			if f != nil {
+				f.Close()
+			}
+			var err error
+			if f, err = os.Open(j.path); err != nil {
+				return err
+			}
+			header := make([]byte, journalHeaderSize)
+			if _, err = io.ReadFull(f, header); err != nil {
+				return err
+			}
+			if seq < binary.Uint64(header) {
+				return errJournalCompacted
+			}
+			r, gen = bufio.NewReader(f), g
+		}
+
+		for seq < last {
+			e := &Entry{}
+			if _, err := readEntry(r, e); err != nil {
+				if err == io.EOF {
+					if _, g, _, _ := j.state(); g != gen {
+						break // compacted meanwhile, reopen
+					}
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			if e.Seq <= seq {
+				continue
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+			seq = e.Seq
+		}
+		if seq < last {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// Compact discards all entries with a sequence number less than or
+// equal to seq, e.g. after all followers have applied them. Sequence
+// numbers remain monotonic across compactions.
+func (j *Journal) Compact(seq uint64) (err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return errJournalClosed
+	}
+	j.idle()
+	if seq > j.synced {
+		seq = j.synced
+	}
+
+	// Append writes at the offset of j.f, which is moved while the
+	// entries are copied.
+	defer func() {
+		if err != nil {
+			j.f.Seek(0, io.SeekEnd)
+		}
+	}()
+
+	tmp, err := os.OpenFile(j.path+".compact", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	w.Write(binary.PutUint64(nil, seq))
+	if _, err = j.f.Seek(journalHeaderSize, io.SeekStart); err != nil {
+		tmp.Close()
+		return err
+	}
+	r := bufio.NewReader(j.f)
+	for {
+		e := &Entry{}
+		if _, err = readEntry(r, e); err != nil {
+			break
+		}
+		if e.Seq > seq {
+			w.Write(e.marshal())
+		}
+	}
+	if err != io.EOF {
+		tmp.Close()
+		return err
+	}
+
+	if err = w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = os.Rename(tmp.Name(), j.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	syncDir(filepath.Dir(j.path))
+
+	j.f.Close()
+	j.f = tmp
+	if _, err = j.f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	j.synced = j.seq // all copied entries have been synced
+	j.gen++
+	close(j.notify)
+	j.notify = make(chan struct{})
+	return nil
+}
+
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	d.Close()
+	return err
+}
+
+// Close closes the journal. Pending Tail calls return.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return errJournalClosed
+	}
+	j.idle()
+	j.closed = true
+	j.syncCond.Broadcast()
+	close(j.notify)
+	return j.f.Close()
+}
+
+// Apply replays the mutation described by e on fs, e.g. on a follower.
+func Apply(fs FileSystem, e *Entry) error {
+	switch e.Op {
+	case OpCreate:
+		f, err := fs.Create(e.Path, e.Flags, e.Perm, e.Uid, e.Gid)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	case OpWrite:
+		f, err := fs.Open(e.Path, os.O_WRONLY, e.Uid, e.Gid)
+		if err != nil {
+			return err
+		}
+		if _, err = f.WriteAt(e.Data, e.Offset); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	case OpTruncate:
+		return fs.Truncate(e.Path, e.Offset, e.Uid, e.Gid)
+	case OpMkdir:
+		return fs.Mkdir(e.Path, e.Perm, e.Uid, e.Gid)
+	case OpMknod:
+		return fs.Mknod(e.Path, e.Perm, e.Major, e.Minor, e.Uid, e.Gid)
+	case OpSymlink:
+		return fs.Symlink(e.Target, e.Path, e.Uid, e.Gid)
+	case OpLink:
+		return fs.Link(e.Path, e.Target, e.Uid, e.Gid)
+	case OpRename:
+		return fs.Rename(e.Path, e.Target, e.Uid, e.Gid)
+	case OpRemove:
+		return fs.Remove(e.Path, e.Uid, e.Gid)
+	case OpChmod:
+		return fs.Chmod(e.Path, e.Perm, e.Uid, e.Gid)
+	case OpChown:
+		return fs.Chown(e.Path, e.Owner, e.Group, e.Uid, e.Gid)
+	case OpChtimes:
+		return fs.Chtimes(e.Path, e.Atime, e.Mtime, e.Uid, e.Gid)
+	case OpSetxattr:
+		return fs.Setxattr(e.Path, e.Target, e.Data, e.Flags, e.Uid, e.Gid)
+	case OpRemovexattr:
+		return fs.Removexattr(e.Path, e.Target, e.Uid, e.Gid)
+	}
+	return unix.EINVAL
+}
+
+type journalFS struct {
+	FileSystem
+	j *Journal
+
+	// mu serializes mutations, so that entries are journaled in the
+	// order the mutations have been applied. Entries are synced
+	// after mu has been released.
+	mu    sync.Mutex
+	files map[*journalFile]struct{} // open files
+
+	// locks orders writes and truncations of an inode, whose data is
+	// changed outside of mu.
+	locks inodeLocks
+}
+
+var _ (FileSystem) = (*journalFS)(nil) // journalFS implements FileSystem
+
+// NewJournal returns a FileSystem which appends every successful
+// mutation of fs to j. If a mutation succeeds but cannot be journaled,
+// the journal error is returned.
+func NewJournal(fs FileSystem, j *Journal) FileSystem {
+	return &journalFS{FileSystem: fs, j: j, files: make(map[*journalFile]struct{})}
+}
+
+// apply applies the mutation op and journals e if op succeeds.
+func (fs *journalFS) apply(e *Entry, op func() error) error {
+	fs.mu.Lock()
+	if err := op(); err != nil {
+		fs.mu.Unlock()
+		return err
+	}
+	err := fs.j.write(e)
+	fs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return fs.j.commit(e.Seq)
+}
+
+// open tracks file, which has been opened at path. The caller must hold
+// fs.mu.
+func (fs *journalFS) open(file File, path string, uid, gid int) (File, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f := &journalFile{File: file, fs: fs, key: keyOf(stat), path: path, uid: uid, gid: gid}
+	fs.files[f] = struct{}{}
+	return f, nil
+}
+
+func (fs *journalFS) Mknod(path string, perm os.FileMode, major, minor uint32, uid, gid int) error {
+	return fs.apply(&Entry{Op: OpMknod, Uid: uid, Gid: gid, Path: path, Perm: perm, Major: major, Minor: minor}, func() error {
+		return fs.FileSystem.Mknod(path, perm, major, minor, uid, gid)
+	})
+}
+
+func (fs *journalFS) Mkdir(path string, perm os.FileMode, uid, gid int) error {
+	return fs.apply(&Entry{Op: OpMkdir, Uid: uid, Gid: gid, Path: path, Perm: perm}, func() error {
+		return fs.FileSystem.Mkdir(path, perm, uid, gid)
+	})
+}
+
+func (fs *journalFS) Create(path string, flags int, perm os.FileMode, uid, gid int) (File, error) {
+	e := &Entry{Op: OpCreate, Uid: uid, Gid: gid, Path: path, Perm: perm, Flags: flags}
+	return fs.openFile(path, uid, gid, e, func() (File, error) {
+		return fs.FileSystem.Create(path, flags, perm, uid, gid)
+	})
+}
+
+func (fs *journalFS) Open(path string, flags int, uid, gid int) (File, error) {
+	var e *Entry
+	if flags&os.O_TRUNC != 0 {
+		e = &Entry{Op: OpTruncate, Uid: uid, Gid: gid, Path: path}
+		if _, unlock, err := fs.locks.lockPath(path, fs.FileSystem.Stat); err == nil {
+			defer unlock()
+		}
+	}
+	return fs.openFile(path, uid, gid, e, func() (File, error) {
+		return fs.FileSystem.Open(path, flags, uid, gid)
+	})
+}
+
+// openFile opens the file at path with op and journals e, if not nil.
+func (fs *journalFS) openFile(path string, uid, gid int, e *Entry, op func() (File, error)) (File, error) {
+	fs.mu.Lock()
+	file, err := op()
+	if err != nil {
+		fs.mu.Unlock()
+		return nil, err
+	}
+	if e != nil {
+		err = fs.j.write(e)
+	}
+	if err != nil {
+		fs.mu.Unlock()
+		file.Close()
+		return nil, err
+	}
+	f, err := fs.open(file, path, uid, gid)
+	fs.mu.Unlock()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if e != nil {
+		if err = fs.j.commit(e.Seq); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// unlinked stops journaling writes to the open files at path, if the
+// object described by stat has no names left. The caller must hold
+// fs.mu.
+func (fs *journalFS) unlinked(path string, stat *Stat) {
+	if stat == nil || stat.Nlink > 1 {
+		return
+	}
+	for f := range fs.files {
+		if f.path == path {
+			f.path = ""
+		}
+	}
+}
+
+func (fs *journalFS) Remove(path string, uid, gid int) error {
+	return fs.apply(&Entry{Op: OpRemove, Uid: uid, Gid: gid, Path: path}, func() error {
+		stat, _ := fs.FileSystem.Lstat(path)
+		if err := fs.FileSystem.Remove(path, uid, gid); err != nil {
+			return err
+		}
+		fs.unlinked(path, stat)
+		return nil
+	})
+}
+
+func (fs *journalFS) Truncate(path string, size int64, uid, gid int) error {
+	if _, unlock, err := fs.locks.lockPath(path, fs.FileSystem.Stat); err == nil {
+		defer unlock()
+	}
+	return fs.apply(&Entry{Op: OpTruncate, Uid: uid, Gid: gid, Path: path, Offset: size}, func() error {
+		return fs.FileSystem.Truncate(path, size, uid, gid)
+	})
+}
+
+func (fs *journalFS) Symlink(target, path string, uid, gid int) error {
+	return fs.apply(&Entry{Op: OpSymlink, Uid: uid, Gid: gid, Path: path, Target: target}, func() error {
+		return fs.FileSystem.Symlink(target, path, uid, gid)
+	})
+}
+
+func (fs *journalFS) Link(oldpath, newpath string, uid, gid int) error {
+	return fs.apply(&Entry{Op: OpLink, Uid: uid, Gid: gid, Path: oldpath, Target: newpath}, func() error {
+		return fs.FileSystem.Link(oldpath, newpath, uid, gid)
+	})
+}
+
+// Rename moves the open files at or below oldpath to newpath. Open
+// files replaced by oldpath are unlinked.
+func (fs *journalFS) Rename(oldpath, newpath string, uid, gid int) error {
+	return fs.apply(&Entry{Op: OpRename, Uid: uid, Gid: gid, Path: oldpath, Target: newpath}, func() error {
+		stat, _ := fs.FileSystem.Lstat(newpath)
+		if stat != nil {
+			if old, err := fs.FileSystem.Lstat(oldpath); err == nil && keyOf(old) == keyOf(stat) {
+				stat = nil // same object, rename does nothing
+			}
+		}
+		if err := fs.FileSystem.Rename(oldpath, newpath, uid, gid); err != nil {
+			return err
+		}
+		fs.unlinked(newpath, stat)
+
+		prefix := oldpath + separator
+		for f := range fs.files {
+			if f.path == oldpath {
+				f.path = newpath
+			} else if strings.HasPrefix(f.path, prefix) {
+				f.path = newpath + f.path[len(oldpath):]
+			}
+		}
+		return nil
+	})
+}
+
+func (fs *journalFS) Chmod(path string, perm os.FileMode, uid, gid int) error {
+	return fs.apply(&Entry{Op: OpChmod, Uid: uid, Gid: gid, Path: path, Perm: perm}, func() error {
+		return fs.FileSystem.Chmod(path, perm, uid, gid)
+	})
+}
+
+func (fs *journalFS) Chown(path string, owner, group int, uid, gid int) error {
+	return fs.apply(&Entry{Op: OpChown, Uid: uid, Gid: gid, Path: path, Owner: owner, Group: group}, func() error {
+		return fs.FileSystem.Chown(path, owner, group, uid, gid)
+	})
+}
+
+func (fs *journalFS) Chtimes(path string, atime, mtime time.Time, uid, gid int) error {
+	return fs.apply(&Entry{Op: OpChtimes, Uid: uid, Gid: gid, Path: path, Atime: atime, Mtime: mtime}, func() error {
+		return fs.FileSystem.Chtimes(path, atime, mtime, uid, gid)
+	})
+}
+
+func (fs *journalFS) Setxattr(path, name string, data []byte, flags int, uid, gid int) error {
+	return fs.apply(&Entry{Op: OpSetxattr, Uid: uid, Gid: gid, Path: path, Target: name, Data: data, Flags: flags}, func() error {
+		return fs.FileSystem.Setxattr(path, name, data, flags, uid, gid)
+	})
+}
+
+func (fs *journalFS) Removexattr(path, name string, uid, gid int) error {
+	return fs.apply(&Entry{Op: OpRemovexattr, Uid: uid, Gid: gid, Path: path, Target: name}, func() error {
+		return fs.FileSystem.Removexattr(path, name, uid, gid)
+	})
+}
+
+// journalFile journals writes by the current path of the file, which
+// follows renames. Writes to a file without names are not journaled,
+// since it has been removed from followers too. If a file with several
+// links is removed while open, writes are still journaled by the
+// removed name, which followers fail to apply, as the remaining names
+// are unknown.
+type journalFile struct {
+	File
+	fs       *journalFS
+	key      inodeKey
+	path     string // protected by fs.mu
+	uid, gid int
+}
+
+// WriteAt writes p while holding the lock of the inode only, so that
+// writes of different files proceed concurrently and are journaled in
+// the order they have been applied to the inode.
+func (f *journalFile) WriteAt(p []byte, offset int64) (int, error) {
+	unlock := f.fs.locks.lock(f.key)
+	defer unlock()
+
+	n, err := f.File.WriteAt(p, offset)
+	if n == 0 {
+		return n, err
+	}
+	f.fs.mu.Lock()
+	if f.path == "" {
+		f.fs.mu.Unlock()
+		return n, err
+	}
+	e := &Entry{Op: OpWrite, Uid: f.uid, Gid: f.gid, Path: f.path, Offset: offset, Data: p[:n]}
+	jerr := f.fs.j.write(e)
+	f.fs.mu.Unlock()
+	if jerr == nil {
+		jerr = f.fs.j.commit(e.Seq)
+	}
+	if jerr != nil && err == nil {
+		err = jerr
+	}
+	return n, err
+}
+
+func (f *journalFile) Close() error {
+	f.fs.mu.Lock()
+	delete(f.fs.files, f)
+	f.fs.mu.Unlock()
+	return f.File.Close()
+}
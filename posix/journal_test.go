@@ -0,0 +1,195 @@
+package posix
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func newTestJournal(t *testing.T) (*Journal, string) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "ninep-journal-test")
+	if err != nil {
+		t.Fatalf("journal: cannot create test directory: %v", err)
+	}
+	path := filepath.Join(dir, "journal")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("journal: unexpected open error: %v", err)
+	}
+	return j, path
+}
+
+func TestJournalReplication(t *testing.T) {
+	uid, gid := getTestUser(t)
+	primary, standby := newTestPosixFS(t), newTestPosixFS(t)
+	defer os.RemoveAll(primary.root)
+	defer os.RemoveAll(standby.root)
+
+	j, path := newTestJournal(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer j.Close()
+
+	fs := NewJournal(primary, j)
+	if err := fs.Mkdir("dir", 0755, uid, gid); err != nil {
+		t.Fatalf("journal: unexpected mkdir error: %v", err)
+	}
+	f, err := fs.Create("dir/file", os.O_WRONLY, 0644, uid, gid)
+	if err != nil {
+		t.Fatalf("journal: unexpected create error: %v", err)
+	}
+	if _, err = f.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatalf("journal: unexpected write error: %v", err)
+	}
+	if err = fs.Rename("dir", "moved", uid, gid); err != nil {
+		t.Fatalf("journal: unexpected rename error: %v", err)
+	}
+	if err = fs.Mkdir("dir", 0755, uid, gid); err != nil {
+		t.Fatalf("journal: unexpected mkdir error: %v", err)
+	}
+	if err = fs.Rename("moved/file", "dir/renamed", uid, gid); err != nil {
+		t.Fatalf("journal: unexpected rename error: %v", err)
+	}
+	if _, err = f.WriteAt([]byte(" world"), 5); err != nil {
+		t.Fatalf("journal: unexpected write error: %v", err)
+	}
+	f.Close()
+	if err = fs.Chmod("dir/renamed", 0600, uid, gid); err != nil {
+		t.Fatalf("journal: unexpected chmod error: %v", err)
+	}
+	if err = fs.Mkdir("dir", 0755, uid, gid); err == nil {
+		t.Fatalf("journal: expected mkdir error")
+	}
+
+	if seq := j.Seq(); seq != 8 {
+		t.Fatalf("journal: expected sequence number 8, got %d", seq)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = j.Tail(ctx, 0, func(e *Entry) error {
+		if e.Uid != uid {
+			t.Fatalf("journal: expected uid %d, got %d", uid, e.Uid)
+		}
+		if err := Apply(standby, e); err != nil {
+			t.Fatalf("journal: unexpected apply error: %v", err)
+		}
+		if e.Seq == j.Seq() {
+			cancel()
+		}
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("journal: expected tail error %v, got %v", context.Canceled, err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(standby.root, "dir", "renamed"))
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("journal: unexpected replica content %q, %v", data, err)
+	}
+	stat, err := standby.Stat("dir/renamed")
+	if err != nil || stat.Mode&0777 != 0600 {
+		t.Fatalf("journal: unexpected replica stat %+v, %v", stat, err)
+	}
+}
+
+func TestJournalConcurrentWrites(t *testing.T) {
+	uid, gid := getTestUser(t)
+	primary := newTestPosixFS(t)
+	defer os.RemoveAll(primary.root)
+
+	j, path := newTestJournal(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer j.Close()
+
+	const files, writes = 8, 16
+	fs := NewJournal(primary, j)
+	var wg sync.WaitGroup
+	for i := 0; i < files; i++ {
+		f, err := fs.Create("file"+strconv.Itoa(i), os.O_WRONLY, 0644, uid, gid)
+		if err != nil {
+			t.Fatalf("journal: unexpected create error: %v", err)
+		}
+		wg.Add(1)
+		go func(f File) {
+			defer wg.Done()
+			defer f.Close()
+			for n := 0; n < writes; n++ {
+				if _, err := f.WriteAt([]byte{byte(n)}, int64(n)); err != nil {
+					t.Errorf("journal: unexpected write error: %v", err)
+					return
+				}
+			}
+		}(f)
+	}
+	wg.Wait()
+
+	want := uint64(files + files*writes)
+	if seq := j.Seq(); seq != want {
+		t.Fatalf("journal: expected sequence number %d, got %d", want, seq)
+	}
+
+	var next uint64
+	ctx, cancel := context.WithCancel(context.Background())
+	j.Tail(ctx, 0, func(e *Entry) error {
+		if next++; e.Seq != next {
+			t.Fatalf("journal: expected sequence number %d, got %d", next, e.Seq)
+		}
+		if e.Seq == want {
+			cancel()
+		}
+		return nil
+	})
+	if next != want {
+		t.Fatalf("journal: expected %d entries, got %d", want, next)
+	}
+}
+
+func TestJournalCompact(t *testing.T) {
+	j, path := newTestJournal(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	for i := 0; i < 5; i++ {
+		if err := j.Append(&Entry{Op: OpMkdir, Path: "dir"}); err != nil {
+			t.Fatalf("journal: unexpected append error: %v", err)
+		}
+	}
+	if err := j.Compact(3); err != nil {
+		t.Fatalf("journal: unexpected compact error: %v", err)
+	}
+	if err := j.Append(&Entry{Op: OpRemove, Path: "dir"}); err != nil {
+		t.Fatalf("journal: unexpected append error: %v", err)
+	}
+	j.Close()
+
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("journal: unexpected open error: %v", err)
+	}
+	defer j.Close()
+
+	if seq := j.Seq(); seq != 6 {
+		t.Fatalf("journal: expected sequence number 6, got %d", seq)
+	}
+
+	if err = j.Tail(context.Background(), 0, func(*Entry) error { return nil }); err != errJournalCompacted {
+		t.Fatalf("journal: expected tail error %v, got %v", errJournalCompacted, err)
+	}
+
+	var seqs []uint64
+	ctx, cancel := context.WithCancel(context.Background())
+	j.Tail(ctx, 3, func(e *Entry) error {
+		seqs = append(seqs, e.Seq)
+		if e.Seq == 6 {
+			cancel()
+		}
+		return nil
+	})
+	if len(seqs) != 3 || seqs[0] != 4 {
+		t.Fatalf("journal: unexpected entries after compaction %v", seqs)
+	}
+}
@@ -0,0 +1,512 @@
+package posix
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Limit defines a soft and a hard limit for a single resource. A zero
+// limit is unlimited.
+type Limit struct {
+	Soft uint64
+	Hard uint64
+}
+
+// max returns the largest enforced amount of the resource.
+func (l Limit) max() uint64 {
+	if l.Hard > 0 {
+		return l.Hard
+	}
+	return l.Soft
+}
+
+// Limits defines the byte and inode limits of a quota.
+type Limits struct {
+	Bytes  Limit
+	Inodes Limit
+}
+
+// Quota describes the limits enforced by a quota file system. Bytes
+// are accounted for regular files only, inodes for every file system
+// object. Usage is charged to the owner of a file.
+type Quota struct {
+	// Export limits the total usage of the file system.
+	Export Limits
+
+	// User limits the usage of every user, unless the user is listed
+	// in Users.
+	User  Limits
+	Users map[int]Limits
+
+	// Grace is the period a soft limit may be exceeded before it is
+	// enforced like a hard limit.
+	Grace time.Duration
+}
+
+func (q Quota) user(uid int) Limits {
+	if l, found := q.Users[uid]; found {
+		return l
+	}
+	return q.User
+}
+
+type usage struct {
+	bytes  uint64
+	inodes uint64
+
+	// first time the soft limits have been exceeded
+	bytesSince  time.Time
+	inodesSince time.Time
+}
+
+func exceeds(l Limit, v uint64, since, now time.Time, grace time.Duration) bool {
+	if l.Hard > 0 && v > l.Hard {
+		return true
+	}
+	if l.Soft == 0 || v <= l.Soft {
+		return false
+	}
+	if grace == 0 {
+		return true
+	}
+	return !since.IsZero() && now.Sub(since) >= grace
+}
+
+func add(v uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > v {
+		return 0
+	}
+	return uint64(int64(v) + delta)
+}
+
+func (u *usage) check(l Limits, bytes, inodes int64, now time.Time, grace time.Duration) bool {
+	if bytes > 0 && exceeds(l.Bytes, add(u.bytes, bytes), u.bytesSince, now, grace) {
+		return false
+	}
+	if inodes > 0 && exceeds(l.Inodes, add(u.inodes, inodes), u.inodesSince, now, grace) {
+		return false
+	}
+	return true
+}
+
+func since(l Limit, v uint64, since, now time.Time) time.Time {
+	if l.Soft == 0 || v <= l.Soft {
+		return time.Time{}
+	}
+	if since.IsZero() {
+		return now
+	}
+	return since
+}
+
+func (u *usage) add(l Limits, bytes, inodes int64, now time.Time) {
+	u.bytes = add(u.bytes, bytes)
+	u.inodes = add(u.inodes, inodes)
+	u.bytesSince = since(l.Bytes, u.bytes, u.bytesSince, now)
+	u.inodesSince = since(l.Inodes, u.inodes, u.inodesSince, now)
+}
+
+type quotaFS struct {
+	FileSystem
+	quota Quota
+	now   func() time.Time
+
+	// locks serializes operations changing the size or the links of
+	// a file, so that its usage is charged and released once.
+	locks inodeLocks
+
+	mu     sync.Mutex // protects following
+	export usage
+	users  map[int]*usage
+}
+
+var _ (FileSystem) = (*quotaFS)(nil) // quotaFS implements FileSystem
+
+// NewQuota returns a FileSystem which enforces the given quota on fs.
+// The current usage is rebuilt by scanning the whole tree. Operations
+// exceeding a limit fail with unix.EDQUOT.
+func NewQuota(fs FileSystem, quota Quota) (FileSystem, error) {
+	q := &quotaFS{
+		FileSystem: fs,
+		quota:      quota,
+		now:        time.Now,
+		users:      make(map[int]*usage),
+	}
+	if err := q.scan(separator, make(map[uint64]bool)); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *quotaFS) scan(path string, seen map[uint64]bool) error {
+	records, err := q.FileSystem.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	now := q.now()
+	for _, rec := range records {
+		if isReserved(rec.Name) {
+			continue
+		}
+
+		name := join(path, rec.Name)
+		stat, err := q.FileSystem.Lstat(name)
+		if err != nil {
+			return err
+		}
+		if stat.Nlink > 1 {
+			if seen[stat.Ino] {
+				continue
+			}
+			seen[stat.Ino] = true
+		}
+
+		q.account(int(stat.Uid), size(stat), 1, now)
+		if stat.Mode&unix.S_IFMT == unix.S_IFDIR {
+			if err = q.scan(name, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// size returns the number of bytes accounted for stat.
+func size(stat *Stat) int64 {
+	if stat.Mode&unix.S_IFMT != unix.S_IFREG {
+		return 0
+	}
+	return stat.Size
+}
+
+func (q *quotaFS) usage(uid int) *usage {
+	u, found := q.users[uid]
+	if !found {
+		u = &usage{}
+		q.users[uid] = u
+	}
+	return u
+}
+
+func (q *quotaFS) account(uid int, bytes, inodes int64, now time.Time) {
+	q.mu.Lock()
+	q.usage(uid).add(q.quota.user(uid), bytes, inodes, now)
+	q.export.add(q.quota.Export, bytes, inodes, now)
+	q.mu.Unlock()
+}
+
+// charge charges the given bytes and inodes to uid. An error is
+// returned if a limit would be exceeded.
+func (q *quotaFS) charge(uid int, bytes, inodes int64) error {
+	now := q.now()
+	limits := q.quota.user(uid)
+
+	q.mu.Lock()
+	u := q.usage(uid)
+	if !u.check(limits, bytes, inodes, now, q.quota.Grace) ||
+		!q.export.check(q.quota.Export, bytes, inodes, now, q.quota.Grace) {
+		q.mu.Unlock()
+		return unix.EDQUOT
+	}
+	u.add(limits, bytes, inodes, now)
+	q.export.add(q.quota.Export, bytes, inodes, now)
+	q.mu.Unlock()
+	return nil
+}
+
+func (q *quotaFS) release(uid int, bytes, inodes int64) {
+	q.account(uid, -bytes, -inodes, q.now())
+}
+
+// settle moves the inode charged to uid for the newly created object
+// described by stat to its actual owner, which differs from uid if the
+// underlying FileSystem cannot act as uid. If the owner exceeds its
+// quota, the object at path is removed.
+func (q *quotaFS) settle(path string, stat *Stat, uid, gid int) error {
+	owner := int(stat.Uid)
+	if owner == uid {
+		return nil
+	}
+	q.release(uid, 0, 1)
+	if err := q.charge(owner, 0, 1); err != nil {
+		q.FileSystem.Remove(path, uid, gid)
+		return err
+	}
+	return nil
+}
+
+// created settles the inode charged to uid for path once it has been
+// created, or releases it if err is set.
+func (q *quotaFS) created(path string, uid, gid int, err error) error {
+	if err != nil {
+		q.release(uid, 0, 1)
+		return err
+	}
+	stat, err := q.FileSystem.Lstat(path)
+	if err != nil {
+		return nil // removed meanwhile
+	}
+	return q.settle(path, stat, uid, gid)
+}
+
+func (q *quotaFS) Mknod(path string, perm os.FileMode, major, minor uint32, uid, gid int) error {
+	if err := q.charge(uid, 0, 1); err != nil {
+		return err
+	}
+	err := q.FileSystem.Mknod(path, perm, major, minor, uid, gid)
+	return q.created(path, uid, gid, err)
+}
+
+func (q *quotaFS) Mkdir(path string, perm os.FileMode, uid, gid int) error {
+	if err := q.charge(uid, 0, 1); err != nil {
+		return err
+	}
+	err := q.FileSystem.Mkdir(path, perm, uid, gid)
+	return q.created(path, uid, gid, err)
+}
+
+func (q *quotaFS) Create(path string, flags int, perm os.FileMode, uid, gid int) (File, error) {
+	if err := q.charge(uid, 0, 1); err != nil {
+		return nil, err
+	}
+	file, err := q.FileSystem.Create(path, flags, perm, uid, gid)
+	if err != nil {
+		q.release(uid, 0, 1)
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err == nil {
+		err = q.settle(path, stat, uid, gid)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &quotaFile{File: file, fs: q, key: keyOf(stat)}, nil
+}
+
+func (q *quotaFS) Open(path string, flags int, uid, gid int) (File, error) {
+	var stat *Stat
+	if flags&os.O_TRUNC != 0 {
+		var unlock func()
+		var err error
+		if stat, unlock, err = q.locks.lockPath(path, q.FileSystem.Stat); err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	file, err := q.FileSystem.Open(path, flags, uid, gid)
+	if err != nil {
+		return nil, err
+	}
+	if stat != nil {
+		q.release(int(stat.Uid), size(stat), 0)
+	} else if stat, err = file.Stat(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &quotaFile{File: file, fs: q, key: keyOf(stat)}, nil
+}
+
+// released reports whether removing a name of the object described by
+// stat frees the object.
+func released(stat *Stat) bool {
+	return stat.Nlink <= 1 || stat.Mode&unix.S_IFMT == unix.S_IFDIR
+}
+
+func (q *quotaFS) Remove(path string, uid, gid int) error {
+	stat, unlock, err := q.locks.lockPath(path, q.FileSystem.Lstat)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err = q.FileSystem.Remove(path, uid, gid); err != nil {
+		return err
+	}
+	if released(stat) {
+		q.release(int(stat.Uid), size(stat), 1)
+	}
+	return nil
+}
+
+// Link adds a name to an object which is already accounted. The object
+// is locked, so that concurrent removals of its names observe the new
+// link count.
+func (q *quotaFS) Link(oldpath, newpath string, uid, gid int) error {
+	_, unlock, err := q.locks.lockPath(oldpath, q.FileSystem.Lstat)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return q.FileSystem.Link(oldpath, newpath, uid, gid)
+}
+
+func (q *quotaFS) Truncate(path string, length int64, uid, gid int) error {
+	stat, unlock, err := q.locks.lockPath(path, q.FileSystem.Stat)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	owner, delta := int(stat.Uid), length-size(stat)
+	if delta > 0 {
+		if err = q.charge(owner, delta, 0); err != nil {
+			return err
+		}
+	}
+
+	if err = q.FileSystem.Truncate(path, length, uid, gid); err != nil {
+		if delta > 0 {
+			q.release(owner, delta, 0)
+		}
+		return err
+	}
+	if delta < 0 {
+		q.release(owner, -delta, 0)
+	}
+	return nil
+}
+
+func (q *quotaFS) Symlink(target, path string, uid, gid int) error {
+	if err := q.charge(uid, 0, 1); err != nil {
+		return err
+	}
+	err := q.FileSystem.Symlink(target, path, uid, gid)
+	return q.created(path, uid, gid, err)
+}
+
+func (q *quotaFS) Rename(oldpath, newpath string, uid, gid int) error {
+	stat, unlock, err := q.locks.lockPath(newpath, q.FileSystem.Lstat)
+	if err != nil {
+		stat = nil // newpath does not exist
+	} else {
+		defer unlock()
+	}
+
+	if err = q.FileSystem.Rename(oldpath, newpath, uid, gid); err != nil {
+		return err
+	}
+	if stat != nil && released(stat) {
+		q.release(int(stat.Uid), size(stat), 1)
+	}
+	return nil
+}
+
+// Chown transfers the usage of path to the new owner.
+func (q *quotaFS) Chown(path string, owner, group int, uid, gid int) error {
+	stat, unlock, err := q.locks.lockPath(path, q.FileSystem.Lstat)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	from := int(stat.Uid)
+	if owner < 0 || owner == from {
+		return q.FileSystem.Chown(path, owner, group, uid, gid)
+	}
+
+	if err = q.charge(owner, size(stat), 1); err != nil {
+		return err
+	}
+	if err = q.FileSystem.Chown(path, owner, group, uid, gid); err != nil {
+		q.release(owner, size(stat), 1)
+		return err
+	}
+	q.release(from, size(stat), 1)
+	return nil
+}
+
+// Statfs reports the remaining quota of uid and of the export, if less
+// than what is available on the underlying file system.
+func (q *quotaFS) Statfs(path string, uid, gid int) (*StatFS, error) {
+	stat, err := q.FileSystem.Statfs(path, uid, gid)
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	clamp(stat, q.quota.Export, &q.export)
+	clamp(stat, q.quota.user(uid), q.usage(uid))
+	q.mu.Unlock()
+	return stat, nil
+}
+
+func clamp(stat *StatFS, l Limits, u *usage) {
+	if limit := l.Bytes.max(); limit > 0 {
+		bsize := uint64(stat.Bsize)
+		if bsize == 0 {
+			bsize = 1
+		}
+
+		blocks, free := limit/bsize, uint64(0)
+		if u.bytes < limit {
+			free = (limit - u.bytes) / bsize
+		}
+		stat.Blocks = minUint64(stat.Blocks, blocks)
+		stat.Bfree = minUint64(stat.Bfree, free)
+		stat.Bavail = minUint64(stat.Bavail, free)
+	}
+
+	if limit := l.Inodes.max(); limit > 0 {
+		free := uint64(0)
+		if u.inodes < limit {
+			free = limit - u.inodes
+		}
+		stat.Files = minUint64(stat.Files, limit)
+		stat.Ffree = minUint64(stat.Ffree, free)
+	}
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type quotaFile struct {
+	File
+	fs  *quotaFS
+	key inodeKey
+}
+
+// WriteAt charges the growth of the file to its owner. Writes to the
+// same file are serialized, so that concurrent writers do not charge
+// the same growth twice. Files without links are no longer accounted.
+func (f *quotaFile) WriteAt(p []byte, offset int64) (int, error) {
+	unlock := f.fs.locks.lock(f.key)
+	defer unlock()
+
+	stat, err := f.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if stat.Nlink == 0 {
+		return f.File.WriteAt(p, offset)
+	}
+
+	owner, grow := int(stat.Uid), offset+int64(len(p))-stat.Size
+	if grow > 0 {
+		if err = f.fs.charge(owner, grow, 0); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.File.WriteAt(p, offset)
+	if grow > 0 && n < len(p) {
+		written := offset + int64(n) - stat.Size
+		if written < 0 {
+			written = 0
+		}
+		f.fs.release(owner, grow-written, 0)
+	}
+	return n, err
+}
@@ -0,0 +1,214 @@
+package posix
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestQuotaScan(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestPosixFS(t)
+	defer os.RemoveAll(fs.root)
+
+	if err := fs.Mkdir("dir", 0755, uid, gid); err != nil {
+		t.Fatalf("quota: unexpected mkdir error: %v", err)
+	}
+	f, err := fs.Create("dir/file", os.O_WRONLY, 0644, uid, gid)
+	if err != nil {
+		t.Fatalf("quota: unexpected create error: %v", err)
+	}
+	if _, err = f.WriteAt(make([]byte, 100), 0); err != nil {
+		t.Fatalf("quota: unexpected write error: %v", err)
+	}
+	f.Close()
+
+	q, err := NewQuota(fs, Quota{})
+	if err != nil {
+		t.Fatalf("quota: unexpected scan error: %v", err)
+	}
+
+	u := q.(*quotaFS).users[uid]
+	if u == nil || u.bytes != 100 || u.inodes != 2 {
+		t.Fatalf("quota: expected usage 100 bytes and 2 inodes, got %+v", u)
+	}
+}
+
+func TestQuotaEnforcement(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestPosixFS(t)
+	defer os.RemoveAll(fs.root)
+
+	q, err := NewQuota(fs, Quota{
+		User: Limits{
+			Bytes:  Limit{Hard: 1024},
+			Inodes: Limit{Hard: 2},
+		},
+	})
+	if err != nil {
+		t.Fatalf("quota: unexpected scan error: %v", err)
+	}
+
+	f, err := q.Create("file", os.O_WRONLY, 0644, uid, gid)
+	if err != nil {
+		t.Fatalf("quota: unexpected create error: %v", err)
+	}
+	defer f.Close()
+
+	if _, err = f.WriteAt(make([]byte, 1024), 0); err != nil {
+		t.Fatalf("quota: unexpected write error: %v", err)
+	}
+	if _, err = f.WriteAt(make([]byte, 1), 1024); err != unix.EDQUOT {
+		t.Fatalf("quota: expected write error %v, got %v", unix.EDQUOT, err)
+	}
+	if err = q.Truncate("file", 2048, uid, gid); err != unix.EDQUOT {
+		t.Fatalf("quota: expected truncate error %v, got %v", unix.EDQUOT, err)
+	}
+	if err = q.Truncate("file", 512, uid, gid); err != nil {
+		t.Fatalf("quota: unexpected truncate error: %v", err)
+	}
+
+	if err = q.Mkdir("dir", 0755, uid, gid); err != nil {
+		t.Fatalf("quota: unexpected mkdir error: %v", err)
+	}
+	if err = q.Mkdir("dir2", 0755, uid, gid); err != unix.EDQUOT {
+		t.Fatalf("quota: expected mkdir error %v, got %v", unix.EDQUOT, err)
+	}
+
+	stat, err := q.Statfs("/", uid, gid)
+	if err != nil {
+		t.Fatalf("quota: unexpected statfs error: %v", err)
+	}
+	if stat.Files != 2 || stat.Ffree != 0 {
+		t.Fatalf("quota: expected 2 files and 0 free, got %d/%d", stat.Files, stat.Ffree)
+	}
+
+	if err = q.Remove("dir", uid, gid); err != nil {
+		t.Fatalf("quota: unexpected remove error: %v", err)
+	}
+	if err = q.Mkdir("dir2", 0755, uid, gid); err != nil {
+		t.Fatalf("quota: unexpected mkdir error: %v", err)
+	}
+}
+
+func TestQuotaSoftLimit(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestPosixFS(t)
+	defer os.RemoveAll(fs.root)
+
+	q, err := NewQuota(fs, Quota{
+		Export: Limits{Inodes: Limit{Soft: 1}},
+		Grace:  time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("quota: unexpected scan error: %v", err)
+	}
+	now := time.Now()
+	q.(*quotaFS).now = func() time.Time { return now }
+
+	for _, name := range []string{"dir1", "dir2"} {
+		if err = q.Mkdir(name, 0755, uid, gid); err != nil {
+			t.Fatalf("quota: unexpected mkdir error: %v", err)
+		}
+	}
+	if since := q.(*quotaFS).export.inodesSince; !since.Equal(now) {
+		t.Fatalf("quota: expected grace period to start at %v, got %v", now, since)
+	}
+
+	stat, err := q.Statfs("/", uid, gid)
+	if err != nil {
+		t.Fatalf("quota: unexpected statfs error: %v", err)
+	}
+	if stat.Files != 1 || stat.Ffree != 0 {
+		t.Fatalf("quota: expected 1 file and 0 free, got %d/%d", stat.Files, stat.Ffree)
+	}
+}
+
+func TestQuotaGrace(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestPosixFS(t)
+	defer os.RemoveAll(fs.root)
+
+	q, err := NewQuota(fs, Quota{
+		User:  Limits{Inodes: Limit{Soft: 1}},
+		Grace: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("quota: unexpected scan error: %v", err)
+	}
+	now := time.Now()
+	q.(*quotaFS).now = func() time.Time { return now }
+
+	for _, name := range []string{"dir1", "dir2", "dir3"} {
+		if err = q.Mkdir(name, 0755, uid, gid); err != nil {
+			t.Fatalf("quota: unexpected mkdir error: %v", err)
+		}
+	}
+	now = now.Add(time.Hour)
+	if err = q.Mkdir("dir4", 0755, uid, gid); err != unix.EDQUOT {
+		t.Fatalf("quota: expected mkdir error %v, got %v", unix.EDQUOT, err)
+	}
+
+	// dropping below the soft limit restarts the grace period
+	for _, name := range []string{"dir2", "dir3"} {
+		if err = q.Remove(name, uid, gid); err != nil {
+			t.Fatalf("quota: unexpected remove error: %v", err)
+		}
+	}
+	if err = q.Mkdir("dir4", 0755, uid, gid); err != nil {
+		t.Fatalf("quota: unexpected mkdir error: %v", err)
+	}
+}
+
+func TestQuotaLink(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestPosixFS(t)
+	defer os.RemoveAll(fs.root)
+
+	q, err := NewQuota(fs, Quota{})
+	if err != nil {
+		t.Fatalf("quota: unexpected scan error: %v", err)
+	}
+	checkUsage := func(bytes, inodes uint64) {
+		t.Helper()
+		u := q.(*quotaFS).users[uid]
+		if u == nil || u.bytes != bytes || u.inodes != inodes {
+			t.Fatalf("quota: expected usage %d bytes and %d inodes, got %+v", bytes, inodes, u)
+		}
+	}
+
+	f, err := q.Create("file", os.O_WRONLY, 0644, uid, gid)
+	if err != nil {
+		t.Fatalf("quota: unexpected create error: %v", err)
+	}
+	defer f.Close()
+	if _, err = f.WriteAt(make([]byte, 100), 0); err != nil {
+		t.Fatalf("quota: unexpected write error: %v", err)
+	}
+	if err = q.Link("file", "link", uid, gid); err != nil {
+		t.Fatalf("quota: unexpected link error: %v", err)
+	}
+	if err = q.Remove("file", uid, gid); err != nil {
+		t.Fatalf("quota: unexpected remove error: %v", err)
+	}
+	checkUsage(100, 1)
+
+	// writes are charged once the open file has been renamed
+	if err = q.Rename("link", "moved", uid, gid); err != nil {
+		t.Fatalf("quota: unexpected rename error: %v", err)
+	}
+	if _, err = f.WriteAt(make([]byte, 100), 100); err != nil {
+		t.Fatalf("quota: unexpected write error: %v", err)
+	}
+	checkUsage(200, 1)
+
+	if err = q.Remove("moved", uid, gid); err != nil {
+		t.Fatalf("quota: unexpected remove error: %v", err)
+	}
+	if _, err = f.WriteAt(make([]byte, 100), 200); err != nil {
+		t.Fatalf("quota: unexpected write error: %v", err)
+	}
+	checkUsage(0, 0)
+}
@@ -0,0 +1,71 @@
+package posix
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type readonlyFS struct {
+	FileSystem
+}
+
+var _ (FileSystem) = (*readonlyFS)(nil) // readonlyFS implements FileSystem
+
+// ReadOnly returns a FileSystem which rejects every modification of fs
+// with unix.EROFS.
+func ReadOnly(fs FileSystem) FileSystem {
+	return &readonlyFS{FileSystem: fs}
+}
+
+func (fs *readonlyFS) Mknod(path string, perm os.FileMode, major, minor uint32, uid, gid int) error {
+	return unix.EROFS
+}
+
+func (fs *readonlyFS) Mkdir(path string, perm os.FileMode, uid, gid int) error {
+	return unix.EROFS
+}
+
+func (fs *readonlyFS) Create(path string, flags int, perm os.FileMode, uid, gid int) (File, error) {
+	return nil, unix.EROFS
+}
+
+func (fs *readonlyFS) Open(path string, flags int, uid, gid int) (File, error) {
+	if flags&writeFlags != 0 {
+		return nil, unix.EROFS
+	}
+	return fs.FileSystem.Open(path, flags, uid, gid)
+}
+
+func (fs *readonlyFS) Remove(path string, uid, gid int) error { return unix.EROFS }
+
+func (fs *readonlyFS) Truncate(path string, size int64, uid, gid int) error {
+	return unix.EROFS
+}
+
+func (fs *readonlyFS) Symlink(target, path string, uid, gid int) error { return unix.EROFS }
+
+func (fs *readonlyFS) Link(oldpath, newpath string, uid, gid int) error { return unix.EROFS }
+
+func (fs *readonlyFS) Rename(oldpath, newpath string, uid, gid int) error { return unix.EROFS }
+
+func (fs *readonlyFS) Chmod(path string, perm os.FileMode, uid, gid int) error {
+	return unix.EROFS
+}
+
+func (fs *readonlyFS) Chown(path string, owner, group int, uid, gid int) error {
+	return unix.EROFS
+}
+
+func (fs *readonlyFS) Chtimes(path string, atime, mtime time.Time, uid, gid int) error {
+	return unix.EROFS
+}
+
+func (fs *readonlyFS) Setxattr(path, name string, data []byte, flags int, uid, gid int) error {
+	return unix.EROFS
+}
+
+func (fs *readonlyFS) Removexattr(path, name string, uid, gid int) error {
+	return unix.EROFS
+}
@@ -0,0 +1,36 @@
+package posix
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReadOnly(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestPosixFS(t)
+	defer os.RemoveAll(fs.root)
+
+	f, err := fs.Create("file", os.O_RDWR, 0644, uid, gid)
+	if err != nil {
+		t.Fatalf("readonly: unexpected create error: %v", err)
+	}
+	f.Close()
+
+	ro := ReadOnly(fs)
+	if f, err = ro.Open("file", os.O_RDONLY, uid, gid); err != nil {
+		t.Fatalf("readonly: unexpected open error: %v", err)
+	}
+	f.Close()
+
+	if _, err = ro.Open("file", os.O_WRONLY, uid, gid); err != unix.EROFS {
+		t.Fatalf("readonly: expected open error %v, got %v", unix.EROFS, err)
+	}
+	if err = ro.Mkdir("dir", 0755, uid, gid); err != unix.EROFS {
+		t.Fatalf("readonly: expected mkdir error %v, got %v", unix.EROFS, err)
+	}
+	if err = ro.Remove("file", uid, gid); err != unix.EROFS {
+		t.Fatalf("readonly: expected remove error %v, got %v", unix.EROFS, err)
+	}
+}
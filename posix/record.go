@@ -3,7 +3,9 @@
 package posix
 
 import (
+	"bytes"
 	"encoding/binary"
+	"io"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -11,6 +13,8 @@ import (
 
 // Record represents a platform independent directory entry. Ino is a
 // number which is unique for each distinct file in the filesystem.
+// Offset is the position of the following entry and may be passed to
+// Dir.Seek to resume reading after the entry.
 type Record struct {
 	Ino    uint64
 	Offset uint64
@@ -20,77 +24,127 @@ type Record struct {
 
 const direntBlockSize = 4 * 1024
 
-// readDir reads directory entries from the given file descriptor. The
-// order of the directory entries is not specified.
-func readDir(fd int) (records []Record, err error) {
-	buf := make([]byte, direntBlockSize)
-	pos, size, offset := 0, 0, uint64(1)
-
-	for {
-		if pos >= size {
-			pos = 0
-			if size, err = unix.ReadDirent(fd, buf); err != nil {
-				return nil, err
+// dir streams the directory entries of a directory file descriptor.
+type dir struct {
+	fd   int
+	buf  []byte
+	pos  int
+	size int
+}
+
+var _ (Dir) = (*dir)(nil) // dir implements Dir
+
+func newDir(fd int) *dir {
+	return &dir{fd: fd, buf: make([]byte, direntBlockSize)}
+}
+
+// readDir reads all directory entries from the given file descriptor.
+// The order of the directory entries is not specified.
+func readDir(fd int) ([]Record, error) {
+	return newDir(fd).ReadDir(0)
+}
+
+// ReadDir reads the next n directory entries. Entries are read from
+// the kernel in chunks of direntBlockSize bytes, hence a directory is
+// never loaded into memory as a whole, unless n <= 0.
+func (d *dir) ReadDir(n int) (records []Record, err error) {
+	for n <= 0 || len(records) < n {
+		if d.pos >= d.size {
+			d.pos = 0
+			if d.size, err = unix.ReadDirent(d.fd, d.buf); err != nil {
+				d.size = 0
+				return records, err
 			}
-			if size <= 0 {
+			if d.size <= 0 {
 				break // EOF
 			}
 		}
 
-		rec, consumed, off := parse(buf[pos:size], offset)
-		offset = off
-		pos += consumed
-		records = append(records, rec...)
+		rec, consumed, ok := d.parse(d.buf[d.pos:d.size])
+		d.pos += consumed
+		if ok {
+			records = append(records, rec)
+		}
 	}
 
-	return records, err
+	if n > 0 && len(records) == 0 {
+		return nil, io.EOF
+	}
+	return records, nil
 }
 
-// parse parses directory entries in buf. It returns the number of bytes
-// consumed from buf and the current offset.
-func parse(buf []byte, offset uint64) ([]Record, int, uint64) {
-	var records []Record
-	n := len(buf)
-
-	for len(buf) > 0 {
-		dirent := (*unix.Dirent)(unsafe.Pointer(&buf[0]))
-		reclen, ok := direntReclen(buf, dirent)
-		if !ok {
-			return records, n, offset
-		}
-		rec := buf[:reclen]
-		buf = buf[reclen:]
+// Seek positions the directory at the given d_off cookie.
+func (d *dir) Seek(offset uint64) error {
+	if _, err := unix.Seek(d.fd, int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+	d.pos, d.size = 0, 0
+	return nil
+}
 
-		ino, ok := direntIno(rec, dirent)
-		if !ok {
-			return records, n, offset
-		}
-		if ino == 0 { // file absent in directory
-			continue
-		}
+func (d *dir) Close() error { return unix.Close(d.fd) }
 
-		typ, ok := direntType(rec, dirent)
-		if !ok {
-			return records, n, offset
+// parse parses the first directory entry in buf. It returns the number
+// of bytes consumed from buf and whether the entry is valid. Entries of
+// type DT_UNKNOWN are typed by fstatat(2).
+func (d *dir) parse(buf []byte) (Record, int, bool) {
+	dirent := &unix.Dirent{} // only used for field offsets and sizes
+	reclen, ok := direntReclen(buf, dirent)
+	if !ok || reclen == 0 || reclen > uint64(len(buf)) {
+		return Record{}, len(buf), false
+	}
+	rec := buf[:reclen]
+
+	ino, ok := direntIno(rec, dirent)
+	if !ok || ino == 0 { // file absent in directory
+		return Record{}, int(reclen), false
+	}
+	off, ok := direntOff(rec, dirent)
+	if !ok {
+		return Record{}, int(reclen), false
+	}
+	typ, ok := direntType(rec, dirent)
+	if !ok {
+		return Record{}, int(reclen), false
+	}
+	name, ok := direntName(rec, dirent)
+	if !ok {
+		return Record{}, int(reclen), false
+	}
+
+	if typ == unix.DT_UNKNOWN {
+		stat := &unix.Stat_t{}
+		err := unix.Fstatat(d.fd, name, stat, unix.AT_SYMLINK_NOFOLLOW)
+		if err == unix.ENOENT {
+			return Record{}, int(reclen), false // removed meanwhile
 		}
-		if typ == unix.DT_UNKNOWN { // TODO(mason)
-			continue
+		if err == nil {
+			typ = modeType(uint32(stat.Mode))
 		}
+	}
 
-		name, ok := direntName(rec, dirent)
-		if !ok {
-			return records, n, offset
-		}
+	return Record{Ino: ino, Offset: off, Type: typ, Name: name}, int(reclen), true
+}
 
-		records = append(records, Record{
-			Ino:    ino,
-			Offset: offset,
-			Type:   typ,
-			Name:   name,
-		})
-		offset++
+// modeType returns the directory entry type of the given file mode.
+func modeType(mode uint32) uint8 {
+	switch mode & unix.S_IFMT {
+	case unix.S_IFREG:
+		return unix.DT_REG
+	case unix.S_IFDIR:
+		return unix.DT_DIR
+	case unix.S_IFLNK:
+		return unix.DT_LNK
+	case unix.S_IFCHR:
+		return unix.DT_CHR
+	case unix.S_IFBLK:
+		return unix.DT_BLK
+	case unix.S_IFIFO:
+		return unix.DT_FIFO
+	case unix.S_IFSOCK:
+		return unix.DT_SOCK
 	}
-	return records, n - len(buf), offset
+	return unix.DT_UNKNOWN
 }
 
 func direntReclen(buf []byte, dirent *unix.Dirent) (uint64, bool) {
@@ -116,15 +170,15 @@ func direntIno(buf []byte, dirent *unix.Dirent) (uint64, bool) {
 }
 
 func direntName(buf []byte, dirent *unix.Dirent) (string, bool) {
-	const namelen = unsafe.Sizeof(dirent.Name)
-	name := (*[namelen]byte)(unsafe.Pointer(&dirent.Name[0]))
-	size := uintptr(0)
-	for ; size < namelen; size++ {
-		if name[size] == 0 {
-			break
-		}
+	offset := int(unsafe.Offsetof(dirent.Name))
+	if len(buf) < offset {
+		return "", false
+	}
+	name := buf[offset:]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
 	}
-	return string(name[:size]), true
+	return string(name), true
 }
 
 var order = binary.LittleEndian
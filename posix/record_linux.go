@@ -0,0 +1,13 @@
+package posix
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func direntOff(buf []byte, dirent *unix.Dirent) (uint64, bool) {
+	offset := unsafe.Offsetof(dirent.Off)
+	size := unsafe.Sizeof(dirent.Off)
+	return decode(buf, offset, size)
+}
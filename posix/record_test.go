@@ -1,9 +1,11 @@
 package posix
 
 import (
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
@@ -53,6 +55,86 @@ func TestReadDir(t *testing.T) {
 	checkRecords(t, records, len(expectedRecords), expectedRecords)
 }
 
+func openTestDir(t *testing.T) *dir {
+	t.Helper()
+
+	fd, err := unix.Open(filepath.Join("testdata", "dirent"), unix.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("openDir: %v", err)
+	}
+	return newDir(fd)
+}
+
+func TestDirSeek(t *testing.T) {
+	d := openTestDir(t)
+	defer d.Close()
+
+	var records []Record
+	for {
+		recs, err := d.ReadDir(2)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadDir: unexpected error: %v", err)
+		}
+		if len(recs) > 2 {
+			t.Fatalf("ReadDir: expected at most 2 records, got %d", len(recs))
+		}
+		records = append(records, recs...)
+	}
+	checkRecords(t, records, len(expectedRecords), expectedRecords)
+
+	for i := range records {
+		if err := d.Seek(records[i].Offset); err != nil {
+			t.Fatalf("Seek: unexpected error: %v", err)
+		}
+		rest, err := d.ReadDir(0)
+		if err != nil {
+			t.Fatalf("ReadDir: unexpected error: %v", err)
+		}
+		if len(rest) != len(records)-i-1 {
+			t.Fatalf("Seek: expected %d records after offset %d, got %d",
+				len(records)-i-1, records[i].Offset, len(rest))
+		}
+		for j, rec := range rest {
+			if rec != records[i+j+1] {
+				t.Fatalf("Seek: expected record %+v, got %+v", records[i+j+1], rec)
+			}
+		}
+	}
+
+	if err := d.Seek(0); err != nil {
+		t.Fatalf("Seek: unexpected error: %v", err)
+	}
+	if all, _ := d.ReadDir(0); len(all) != len(records) {
+		t.Fatalf("Seek: expected %d records after rewind, got %d", len(records), len(all))
+	}
+}
+
+func TestDirUnknownType(t *testing.T) {
+	d := openTestDir(t)
+	defer d.Close()
+
+	n, err := unix.ReadDirent(d.fd, d.buf)
+	if err != nil {
+		t.Fatalf("ReadDirent: %v", err)
+	}
+	var dirent unix.Dirent
+	for pos := 0; pos < n; {
+		reclen, _ := direntReclen(d.buf[pos:n], &dirent)
+		d.buf[pos+int(unsafe.Offsetof(dirent.Type))] = unix.DT_UNKNOWN
+		pos += int(reclen)
+	}
+	d.size = n
+
+	records, err := d.ReadDir(0)
+	if err != nil {
+		t.Fatalf("ReadDir: unexpected error: %v", err)
+	}
+	checkRecords(t, records, len(expectedRecords), expectedRecords)
+}
+
 /*
 func mustOpen(t *testing.T, name string) *os.File {
 	f, err := os.Open(name)
@@ -0,0 +1,571 @@
+package posix
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/azmodb/pkg/log"
+	"golang.org/x/sys/unix"
+)
+
+// SnapshotPrefix is the prefix of the first path element selecting a
+// snapshot, e.g. /@2006-01-02.
+const SnapshotPrefix = "@"
+
+// Snapshots manages point-in-time snapshots of the directory tree
+// exported by a FileSystem. Regular files are cloned using reflinks
+// where the host file system supports copy-on-write, and copied
+// otherwise.
+type Snapshots struct {
+	root string // exported directory tree
+	dir  string // snapshot directory
+
+	mu    sync.Mutex // protects following
+	trees map[string]FileSystem
+}
+
+// NewSnapshots returns a snapshot manager for the directory tree root
+// which stores its snapshots in dir. Dir is created if it does not
+// exist.
+func NewSnapshots(root, dir string) (*Snapshots, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Snapshots{root: root, dir: dir, trees: make(map[string]FileSystem)}, nil
+}
+
+// Snapshot captures the current state of the directory tree and stores
+// it as snapshot name.
+func (s *Snapshots) Snapshot(name string) error {
+	if !isValidName(name) {
+		return unix.EINVAL
+	}
+
+	path := filepath.Join(s.dir, name)
+	if _, err := os.Lstat(path); err == nil {
+		return unix.EEXIST
+	}
+
+	tmp, err := ioutil.TempDir(s.dir, ".snapshot-")
+	if err != nil {
+		return err
+	}
+	if err = s.capture(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Schedule takes a snapshot every interval until ctx is done. Each
+// snapshot is named by formatting the current time according to
+// layout.
+func (s *Snapshots) Schedule(ctx context.Context, interval time.Duration, layout string) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			if err := s.Snapshot(now.Format(layout)); err != nil {
+				log.Errorf("snapshot: scheduled snapshot failed: %v", err)
+			}
+		}
+	}
+}
+
+// List returns the sorted names of all snapshots.
+func (s *Snapshots) List() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, fi := range infos {
+		if fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Remove deletes the snapshot name.
+func (s *Snapshots) Remove(name string) error {
+	if !isValidName(name) {
+		return unix.EINVAL
+	}
+
+	s.mu.Lock()
+	delete(s.trees, name)
+	s.mu.Unlock()
+	return os.RemoveAll(filepath.Join(s.dir, name))
+}
+
+func (s *Snapshots) capture(dst string) error {
+	var dirs []string
+	err := filepath.Walk(s.root, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == s.dir {
+			return filepath.SkipDir
+		}
+
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		stat := &unix.Stat_t{}
+		if err = unix.Lstat(path, stat); err != nil {
+			return err
+		}
+
+		switch stat.Mode & unix.S_IFMT {
+		case unix.S_IFDIR:
+			if rel != "." {
+				if err = os.Mkdir(target, 0700); err != nil {
+					return err
+				}
+			}
+			dirs = append(dirs, target)
+			return nil
+		case unix.S_IFREG:
+			return snapshotFile(path, target, stat)
+		case unix.S_IFLNK:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err = os.Symlink(link, target); err != nil {
+				return err
+			}
+		default:
+			if err = unix.Mknod(target, uint32(stat.Mode), int(stat.Rdev)); err != nil {
+				return err
+			}
+		}
+		return setattr(target, stat)
+	})
+	if err != nil {
+		return err
+	}
+
+	// directory attributes are restored last, otherwise creating
+	// their entries would alter permissions and timestamps
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, _ := filepath.Rel(dst, dirs[i])
+		stat := &unix.Stat_t{}
+		if err = unix.Lstat(filepath.Join(s.root, rel), stat); err != nil {
+			return err
+		}
+		if err = setattr(dirs[i], stat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotFile reflinks src to dst. If the host file system does not
+// support reflinks, the content is copied. Hard links are no option,
+// since in-place modifications of the live file would show up in the
+// snapshot.
+func snapshotFile(src, dst string, stat *unix.Stat_t) error {
+	if err := reflink(src, dst); err != nil {
+		if err = copyFile(src, dst); err != nil {
+			return err
+		}
+	}
+	return setattr(dst, stat)
+}
+
+func reflink(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err = clone(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// setattr restores ownership, permissions and timestamps of path.
+// Unprivileged snapshot managers cannot restore the ownership of files
+// owned by other users, which is not an error.
+func setattr(path string, stat *unix.Stat_t) error {
+	err := os.Lchown(path, int(stat.Uid), int(stat.Gid))
+	if err != nil && !errors.Is(err, unix.EPERM) {
+		return err
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFLNK {
+		if err := unix.Chmod(path, uint32(stat.Mode)&07777); err != nil {
+			return err
+		}
+	}
+	ts := []unix.Timespec{stat.Atim, stat.Mtim}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// FileSystem returns a FileSystem which serves fs, and all snapshots as
+// read-only trees below paths starting with /@name. Top-level names
+// starting with SnapshotPrefix which do not select a snapshot are served
+// by fs, but cannot be created. Fs must export the directory tree of
+// the snapshot manager.
+func (s *Snapshots) FileSystem(fs FileSystem) FileSystem {
+	return &snapshotFS{FileSystem: fs, s: s}
+}
+
+// lookup returns the name of the snapshot selected by the path element
+// elem, if elem starts with SnapshotPrefix and names an existing
+// snapshot.
+func (s *Snapshots) lookup(elem string) (string, bool) {
+	if !strings.HasPrefix(elem, SnapshotPrefix) {
+		return "", false
+	}
+	name := strings.TrimPrefix(elem, SnapshotPrefix)
+	if !isValidName(name) {
+		return "", false
+	}
+
+	s.mu.Lock()
+	_, found := s.trees[name]
+	s.mu.Unlock()
+	if found {
+		return name, true
+	}
+	fi, err := os.Stat(filepath.Join(s.dir, name))
+	return name, err == nil && fi.IsDir()
+}
+
+// tree returns the read-only FileSystem of snapshot name.
+func (s *Snapshots) tree(name string) (FileSystem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fs, found := s.trees[name]; found {
+		return fs, nil
+	}
+	if !isValidName(name) {
+		return nil, unix.ENOENT
+	}
+	fs, err := newPosixFS(filepath.Join(s.dir, name), -1, -1)
+	if err != nil {
+		return nil, err
+	}
+	s.trees[name] = fs
+	return fs, nil
+}
+
+type snapshotFS struct {
+	FileSystem
+	s *Snapshots
+}
+
+var _ (FileSystem) = (*snapshotFS)(nil) // snapshotFS implements FileSystem
+
+// resolve returns the snapshot FileSystem and the path within the
+// snapshot, if path selects an existing snapshot. Other paths are
+// served by the underlying FileSystem.
+func (fs *snapshotFS) resolve(path string) (FileSystem, string, bool, error) {
+	names := split(pathClean(path))
+	if len(names) == 0 {
+		return nil, path, false, nil
+	}
+	name, found := fs.s.lookup(names[0])
+	if !found {
+		return nil, path, false, nil
+	}
+
+	tree, err := fs.s.tree(name)
+	if err != nil {
+		return nil, "", true, err
+	}
+	return tree, separator + join(names[1:]...), true, nil
+}
+
+// readonly returns unix.EROFS if path selects an existing snapshot.
+func (fs *snapshotFS) readonly(path string) error {
+	names := split(pathClean(path))
+	if len(names) == 0 {
+		return nil
+	}
+	if _, found := fs.s.lookup(names[0]); found {
+		return unix.EROFS
+	}
+	return nil
+}
+
+// creatable returns unix.EROFS if path selects an existing snapshot,
+// and unix.EINVAL if path names a top-level file starting with
+// SnapshotPrefix, which would be shadowed by a snapshot.
+func (fs *snapshotFS) creatable(path string) error {
+	if err := fs.readonly(path); err != nil {
+		return err
+	}
+	names := split(pathClean(path))
+	if len(names) == 1 && strings.HasPrefix(names[0], SnapshotPrefix) {
+		return unix.EINVAL
+	}
+	return nil
+}
+
+func (fs *snapshotFS) Mknod(path string, perm os.FileMode, major, minor uint32, uid, gid int) error {
+	if err := fs.creatable(path); err != nil {
+		return err
+	}
+	return fs.FileSystem.Mknod(path, perm, major, minor, uid, gid)
+}
+
+func (fs *snapshotFS) Mkdir(path string, perm os.FileMode, uid, gid int) error {
+	if err := fs.creatable(path); err != nil {
+		return err
+	}
+	return fs.FileSystem.Mkdir(path, perm, uid, gid)
+}
+
+func (fs *snapshotFS) Create(path string, flags int, perm os.FileMode, uid, gid int) (File, error) {
+	if err := fs.creatable(path); err != nil {
+		return nil, err
+	}
+	return fs.FileSystem.Create(path, flags, perm, uid, gid)
+}
+
+const writeFlags = os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREATE | os.O_TRUNC
+
+func (fs *snapshotFS) Open(path string, flags int, uid, gid int) (File, error) {
+	tree, path, found, err := fs.resolve(path)
+	if !found {
+		return fs.FileSystem.Open(path, flags, uid, gid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if flags&writeFlags != 0 {
+		return nil, unix.EROFS
+	}
+	return tree.Open(path, flags, uid, gid)
+}
+
+func (fs *snapshotFS) Remove(path string, uid, gid int) error {
+	if err := fs.readonly(path); err != nil {
+		return err
+	}
+	return fs.FileSystem.Remove(path, uid, gid)
+}
+
+func (fs *snapshotFS) Truncate(path string, size int64, uid, gid int) error {
+	if err := fs.readonly(path); err != nil {
+		return err
+	}
+	return fs.FileSystem.Truncate(path, size, uid, gid)
+}
+
+func (fs *snapshotFS) Symlink(target, path string, uid, gid int) error {
+	if err := fs.creatable(path); err != nil {
+		return err
+	}
+	return fs.FileSystem.Symlink(target, path, uid, gid)
+}
+
+func (fs *snapshotFS) Link(oldpath, newpath string, uid, gid int) error {
+	if err := fs.readonly(oldpath); err != nil {
+		return err
+	}
+	if err := fs.creatable(newpath); err != nil {
+		return err
+	}
+	return fs.FileSystem.Link(oldpath, newpath, uid, gid)
+}
+
+func (fs *snapshotFS) Rename(oldpath, newpath string, uid, gid int) error {
+	if err := fs.readonly(oldpath); err != nil {
+		return err
+	}
+	if err := fs.creatable(newpath); err != nil {
+		return err
+	}
+	return fs.FileSystem.Rename(oldpath, newpath, uid, gid)
+}
+
+func (fs *snapshotFS) Readlink(path string) (string, error) {
+	tree, path, found, err := fs.resolve(path)
+	if !found {
+		return fs.FileSystem.Readlink(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	return tree.Readlink(path)
+}
+
+func (fs *snapshotFS) Chmod(path string, perm os.FileMode, uid, gid int) error {
+	if err := fs.readonly(path); err != nil {
+		return err
+	}
+	return fs.FileSystem.Chmod(path, perm, uid, gid)
+}
+
+func (fs *snapshotFS) Chown(path string, owner, group int, uid, gid int) error {
+	if err := fs.readonly(path); err != nil {
+		return err
+	}
+	return fs.FileSystem.Chown(path, owner, group, uid, gid)
+}
+
+func (fs *snapshotFS) Chtimes(path string, atime, mtime time.Time, uid, gid int) error {
+	if err := fs.readonly(path); err != nil {
+		return err
+	}
+	return fs.FileSystem.Chtimes(path, atime, mtime, uid, gid)
+}
+
+func (fs *snapshotFS) Getxattr(path, name string, uid, gid int) ([]byte, error) {
+	tree, path, found, err := fs.resolve(path)
+	if !found {
+		return fs.FileSystem.Getxattr(path, name, uid, gid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tree.Getxattr(path, name, uid, gid)
+}
+
+func (fs *snapshotFS) Listxattr(path string, uid, gid int) ([]string, error) {
+	tree, path, found, err := fs.resolve(path)
+	if !found {
+		return fs.FileSystem.Listxattr(path, uid, gid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tree.Listxattr(path, uid, gid)
+}
+
+func (fs *snapshotFS) Setxattr(path, name string, data []byte, flags int, uid, gid int) error {
+	if err := fs.readonly(path); err != nil {
+		return err
+	}
+	return fs.FileSystem.Setxattr(path, name, data, flags, uid, gid)
+}
+
+func (fs *snapshotFS) Removexattr(path, name string, uid, gid int) error {
+	if err := fs.readonly(path); err != nil {
+		return err
+	}
+	return fs.FileSystem.Removexattr(path, name, uid, gid)
+}
+
+func (fs *snapshotFS) Stat(path string) (*Stat, error) {
+	tree, path, found, err := fs.resolve(path)
+	if !found {
+		return fs.FileSystem.Stat(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tree.Stat(path)
+}
+
+func (fs *snapshotFS) Getattr(path string, mask uint64) (*Attr, error) {
+	tree, path, found, err := fs.resolve(path)
+	if !found {
+		return fs.FileSystem.Getattr(path, mask)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tree.Getattr(path, mask)
+}
+
+func (fs *snapshotFS) Lstat(path string) (*Stat, error) {
+	tree, path, found, err := fs.resolve(path)
+	if !found {
+		return fs.FileSystem.Lstat(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tree.Lstat(path)
+}
+
+func (fs *snapshotFS) Statfs(path string, uid, gid int) (*StatFS, error) {
+	tree, path, found, err := fs.resolve(path)
+	if !found {
+		return fs.FileSystem.Statfs(path, uid, gid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tree.Statfs(path, uid, gid)
+}
+
+func (fs *snapshotFS) OpenDir(path string, uid, gid int) (Dir, error) {
+	tree, path, found, err := fs.resolve(path)
+	if !found {
+		return fs.FileSystem.OpenDir(path, uid, gid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tree.OpenDir(path, uid, gid)
+}
+
+func (fs *snapshotFS) ReadDir(path string) ([]Record, error) {
+	tree, path, found, err := fs.resolve(path)
+	if !found {
+		return fs.FileSystem.ReadDir(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tree.ReadDir(path)
+}
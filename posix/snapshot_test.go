@@ -0,0 +1,118 @@
+package posix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSnapshot(t *testing.T) {
+	uid, gid := getTestUser(t)
+	fs := newTestPosixFS(t)
+	defer os.RemoveAll(fs.root)
+
+	dir, err := ioutil.TempDir("", "ninep-snapshot-test")
+	if err != nil {
+		t.Fatalf("snapshot: cannot create snapshot directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = fs.Mkdir("dir", 0755, uid, gid); err != nil {
+		t.Fatalf("snapshot: unexpected mkdir error: %v", err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(fs.root, "dir", "file"), []byte("data"), 0644); err != nil {
+		t.Fatalf("snapshot: unexpected write error: %v", err)
+	}
+	if err = os.Symlink("dir/file", filepath.Join(fs.root, "link")); err != nil {
+		t.Fatalf("snapshot: unexpected symlink error: %v", err)
+	}
+
+	s, err := NewSnapshots(fs.root, dir)
+	if err != nil {
+		t.Fatalf("snapshot: unexpected init error: %v", err)
+	}
+	if err = s.Snapshot("2026-10-16"); err != nil {
+		t.Fatalf("snapshot: unexpected snapshot error: %v", err)
+	}
+	if err = s.Snapshot("2026-10-16"); err != unix.EEXIST {
+		t.Fatalf("snapshot: expected error %v, got %v", unix.EEXIST, err)
+	}
+	if names, _ := s.List(); len(names) != 1 || names[0] != "2026-10-16" {
+		t.Fatalf("snapshot: unexpected snapshot list %q", names)
+	}
+
+	// snapshots do not share in-place modifications of the live tree
+	live, err := os.OpenFile(filepath.Join(fs.root, "dir", "file"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("snapshot: unexpected open error: %v", err)
+	}
+	if _, err = live.WriteAt([]byte("DATA"), 0); err != nil {
+		t.Fatalf("snapshot: unexpected write error: %v", err)
+	}
+	live.Close()
+	if stat, err := fs.Stat("dir/file"); err != nil || stat.Nlink != 1 {
+		t.Fatalf("snapshot: unexpected live file stat %v, %v", stat, err)
+	}
+
+	if err = fs.Remove("dir/file", uid, gid); err != nil {
+		t.Fatalf("snapshot: unexpected remove error: %v", err)
+	}
+
+	sfs := s.FileSystem(fs)
+	if _, err = sfs.Stat("/dir/file"); err == nil {
+		t.Fatalf("snapshot: expected stat error of removed file")
+	}
+	if _, err = sfs.Lstat("/@2026-10-16/link"); err != nil {
+		t.Fatalf("snapshot: unexpected lstat error: %v", err)
+	}
+
+	f, err := sfs.Open("/@2026-10-16/dir/file", os.O_RDONLY, uid, gid)
+	if err != nil {
+		t.Fatalf("snapshot: unexpected open error: %v", err)
+	}
+	data := make([]byte, 4)
+	if _, err = f.ReadAt(data, 0); err != nil || string(data) != "data" {
+		t.Fatalf("snapshot: unexpected read %q, %v", data, err)
+	}
+	f.Close()
+
+	if _, err = sfs.Open("/@2026-10-16/dir/file", os.O_RDWR, uid, gid); err != unix.EROFS {
+		t.Fatalf("snapshot: expected open error %v, got %v", unix.EROFS, err)
+	}
+	if _, err = sfs.Create("/@2026-10-16/new", os.O_RDWR, 0644, uid, gid); err != unix.EROFS {
+		t.Fatalf("snapshot: expected create error %v, got %v", unix.EROFS, err)
+	}
+	if err = sfs.Remove("/@2026-10-16/dir", uid, gid); err != unix.EROFS {
+		t.Fatalf("snapshot: expected remove error %v, got %v", unix.EROFS, err)
+	}
+	if _, err = sfs.Stat("/@unknown"); err == nil {
+		t.Fatalf("snapshot: expected stat error of unknown snapshot")
+	}
+	if err = sfs.Mkdir("/@2026-10-17", 0755, uid, gid); err != unix.EINVAL {
+		t.Fatalf("snapshot: expected mkdir error %v, got %v", unix.EINVAL, err)
+	}
+	if err = sfs.Rename("/dir", "/@dir", uid, gid); err != unix.EINVAL {
+		t.Fatalf("snapshot: expected rename error %v, got %v", unix.EINVAL, err)
+	}
+	if err = sfs.Mkdir("/dir/@sub", 0755, uid, gid); err != nil {
+		t.Fatalf("snapshot: unexpected mkdir error: %v", err)
+	}
+
+	// top-level names not selecting a snapshot are served by fs
+	if err = os.Mkdir(filepath.Join(fs.root, "@live"), 0755); err != nil {
+		t.Fatalf("snapshot: unexpected mkdir error: %v", err)
+	}
+	if err = sfs.Mkdir("/@live/dir", 0755, uid, gid); err != nil {
+		t.Fatalf("snapshot: unexpected mkdir error: %v", err)
+	}
+	if _, err = sfs.Stat("/@live/dir"); err != nil {
+		t.Fatalf("snapshot: unexpected stat error: %v", err)
+	}
+
+	if err = s.Remove("2026-10-16"); err != nil {
+		t.Fatalf("snapshot: unexpected remove error: %v", err)
+	}
+}
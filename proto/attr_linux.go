@@ -7,14 +7,15 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// EncodeRgetattr encodes information about a file system object. Valid
-// is a bitmask indicating which fields are valid in the response.
-func EncodeRgetattr(buf *binary.Buffer, valid uint64, st *unix.Stat_t) error {
-	buf.PutUint64(valid)
+// EncodeRgetattr encodes information about a file system object. The
+// qid replaces the inode number of the Stat_t on the wire.
+func EncodeRgetattr(buf *binary.Buffer, m *Rgetattr) error {
+	st := m.Stat_t
+	buf.PutUint64(m.Valid)
 
-	buf.PutUint8(UnixFileTypeToQidType(st.Mode)) // marshal Qid
-	buf.PutUint32(uint32(st.Mtim.Nano() ^ st.Size<<8))
-	buf.PutUint64(st.Ino)
+	buf.PutUint8(m.Qid.Type) // marshal Qid
+	buf.PutUint32(m.Qid.Version)
+	buf.PutUint64(m.Qid.Path)
 
 	mode := NewModeUnix(uint32(st.Mode))
 	buf.PutUint32(uint32(mode))
@@ -29,23 +30,23 @@ func EncodeRgetattr(buf *binary.Buffer, valid uint64, st *unix.Stat_t) error {
 	encodeTimespec(buf, st.Mtim)
 	encodeTimespec(buf, st.Ctim)
 
-	encodeTimespec(buf, btime)
-	buf.PutUint64(0)
-	buf.PutUint64(0)
+	encodeTimespec(buf, m.Btime)
+	buf.PutUint64(m.Gen)
+	buf.PutUint64(m.DataVersion)
 
 	return buf.Err()
 }
 
-var btime = unix.NsecToTimespec(0)
+// DecodeRgetattr decodes information about a file system object. The
+// qid path is stored as inode number of the Stat_t.
+func DecodeRgetattr(buf *binary.Buffer, m *Rgetattr) error {
+	st := m.Stat_t
+	m.Valid = buf.Uint64()
 
-// DecodeRgetattr decodes information about a file system object. Valid
-// is a bitmask indicating which fields are valid in the response.
-func DecodeRgetattr(buf *binary.Buffer, valid *uint64, st *unix.Stat_t) error {
-	*valid = buf.Uint64()
-
-	_ = buf.Uint8()  // qid directory type
-	_ = buf.Uint32() // qid version
-	st.Ino = buf.Uint64()
+	m.Qid.Type = buf.Uint8()
+	m.Qid.Version = buf.Uint32()
+	m.Qid.Path = buf.Uint64()
+	st.Ino = m.Qid.Path
 
 	st.Mode = NewUnixMode(Mode(buf.Uint32()))
 	st.Uid = buf.Uint32()
@@ -59,9 +60,9 @@ func DecodeRgetattr(buf *binary.Buffer, valid *uint64, st *unix.Stat_t) error {
 	st.Mtim = decodeTimespec(buf)
 	st.Ctim = decodeTimespec(buf)
 
-	_ = decodeTimespec(buf)
-	_ = buf.Uint64()
-	_ = buf.Uint64() // DataVersion
+	m.Btime = decodeTimespec(buf)
+	m.Gen = buf.Uint64()
+	m.DataVersion = buf.Uint64()
 
 	return buf.Err()
 }
@@ -82,7 +83,9 @@ func (m Rgetattr) String() string {
 		m.Mtim.Nano(),
 		m.Ctim.Nano(),
 
-		0, 0, 0,
+		m.Btime.Nano(),
+		m.Gen,
+		m.DataVersion,
 	)
 }
 
@@ -97,12 +100,31 @@ func EncodeRstatfs(buf *binary.Buffer, st *unix.Statfs_t) error {
 	buf.PutUint64(st.Bavail)
 	buf.PutUint64(st.Files)
 	buf.PutUint64(st.Ffree)
-	buf.PutUint64(uint64(st.Fsid.Val[0] | st.Fsid.Val[1]<<32))
+	buf.PutUint64(fsid(st))
 	buf.PutUint32(uint32(st.Namelen))
 
 	return buf.Err()
 }
 
+// StatfsToRstatfs converts an unix.Statfs_t.
+func StatfsToRstatfs(st *unix.Statfs_t) Rstatfs {
+	return Rstatfs{
+		Type:            uint32(st.Type),
+		BlockSize:       uint32(st.Bsize),
+		Blocks:          st.Blocks,
+		BlocksFree:      st.Bfree,
+		BlocksAvailable: st.Bavail,
+		Files:           st.Files,
+		FilesFree:       st.Ffree,
+		FsID:            fsid(st),
+		NameLength:      uint32(st.Namelen),
+	}
+}
+
+func fsid(st *unix.Statfs_t) uint64 {
+	return uint64(uint32(st.Fsid.Val[0])) | uint64(uint32(st.Fsid.Val[1]))<<32
+}
+
 // StatToQid converts an unix.Stat_t.
 func StatToQid(st *unix.Stat_t) Qid {
 	return Qid{
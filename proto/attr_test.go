@@ -32,7 +32,7 @@ func statBytesEqual(t *testing.T, st *unix.Stat_t, rx *Rgetattr) {
 	t.Helper()
 	b1, b2 := &binary.Buffer{}, &binary.Buffer{}
 
-	if err := EncodeRgetattr(b1, 0, st); err != nil {
+	if err := EncodeRgetattr(b1, &Rgetattr{Stat_t: st}); err != nil {
 		t.Fatalf("stat: unexpected marshal error: %v", err)
 	}
 
@@ -66,15 +66,29 @@ func TestEmptyStatEncoding(t *testing.T) {
 func TestStatEncoding(t *testing.T) {
 	s1, s2 := &unix.Stat_t{}, &unix.Stat_t{}
 	unix.Stat("attr_test.go", s1)
-	var valid uint64
 	b := &binary.Buffer{}
 
-	if err := EncodeRgetattr(b, GetAttrBasic, s1); err != nil {
+	rx := &Rgetattr{
+		Valid:       GetAttrBasic | GetAttrBtime | GetAttrGen,
+		Qid:         StatToQid(s1),
+		Stat_t:      s1,
+		Btime:       unix.NsecToTimespec(1234567890),
+		Gen:         42,
+		DataVersion: 7,
+	}
+	if err := EncodeRgetattr(b, rx); err != nil {
 		t.Fatalf("encode: unexpected rgetattr encode error: %v", err)
 	}
-	if err := DecodeRgetattr(b, &valid, s2); err != nil {
+	attr := &Rgetattr{Stat_t: s2}
+	if err := DecodeRgetattr(b, attr); err != nil {
 		t.Fatalf("decode: unexpected rgetattr encode error: %v", err)
 	}
+	if attr.Qid != rx.Qid || s2.Ino != s1.Ino {
+		t.Fatalf("decode: expected qid %v, got %v", rx.Qid, attr.Qid)
+	}
+	if attr.Valid != rx.Valid || attr.Btime != rx.Btime || attr.Gen != rx.Gen || attr.DataVersion != rx.DataVersion {
+		t.Fatalf("decode: expected %v, got %v", rx, attr)
+	}
 
 	//if !reflect.DeepEqual(s1, s2) {
 	//	t.Fatalf("stat: attr differ\nwant %+v\ngot  %+v", s1, s2)
@@ -94,3 +108,13 @@ func TestEmptyStatfsEncoding(t *testing.T) {
 
 	statfsBytesEqual(t, st, rx)
 }
+
+func TestStatfsToRstatfs(t *testing.T) {
+	st := &unix.Statfs_t{}
+	if err := unix.Statfs(".", st); err != nil {
+		t.Fatalf("statfs: unexpected error: %v", err)
+	}
+
+	rx := StatfsToRstatfs(st)
+	statfsBytesEqual(t, st, &rx)
+}
@@ -0,0 +1,62 @@
+package proto
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/azmodb/ninep/binary"
+)
+
+// Dirent represents a directory entry as returned in the data of a
+// Rreaddir message.
+type Dirent struct {
+	Qid
+
+	// Offset is the offset of the next directory entry. It is passed
+	// in a subsequent Treaddir message to continue reading the
+	// directory.
+	Offset uint64
+
+	Type uint8 // type of the file (DT_DIR etc.)
+	Name string
+}
+
+// Len returns the length of the directory entry in bytes.
+func (d Dirent) Len() int { return FixedDirentSize + len(d.Name) }
+
+// String implements fmt.Stringer.
+func (d Dirent) String() string {
+	return fmt.Sprintf("qid:(%s) offset:%d type:%d name:%q",
+		d.Qid, d.Offset, d.Type, d.Name)
+}
+
+// Marshal implements binary.Marshaler.
+func (d Dirent) Marshal(data []byte) ([]byte, int, error) {
+	if len(d.Name) > MaxNameSize {
+		return data, 0, ErrNameTooLarge
+	}
+
+	data, _, _ = d.Qid.Marshal(data)
+	data = binary.PutUint64(data, d.Offset)
+	data = binary.PutUint8(data, d.Type)
+	data = binary.PutString(data, d.Name)
+	return data, d.Len(), nil
+}
+
+// Unmarshal implements binary.Unmarshaler.
+func (d *Dirent) Unmarshal(data []byte) ([]byte, error) {
+	if len(data) < FixedDirentSize {
+		return data, io.ErrUnexpectedEOF
+	}
+
+	data, err := d.Qid.Unmarshal(data)
+	if err != nil {
+		return data, err
+	}
+	d.Offset = binary.Uint64(data[:8])
+	d.Type = binary.Uint8(data[8:9])
+	if data, err = binary.Unmarshal(data[9:], &d.Name); err != nil {
+		return data, err
+	}
+	return data, nil
+}
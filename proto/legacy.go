@@ -161,7 +161,7 @@ func (m Rwalk) String() string {
 }
 
 // Len returns the length of the message in bytes.
-func (m Rwalk) Len() int { return 13 * len(m) }
+func (m Rwalk) Len() int { return 2 + 13*len(m) }
 
 // Reset resets all state.
 func (m *Rwalk) Reset() { *m = Rwalk{} }
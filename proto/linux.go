@@ -226,7 +226,15 @@ type Rgetattr struct {
 	// response.
 	Valid uint64
 
+	// Qid identifies the file system object on the server. It is sent
+	// in place of the inode number.
+	Qid Qid
+
 	*unix.Stat_t
+
+	Btime       unix.Timespec // time of file creation
+	Gen         uint64        // inode generation number
+	DataVersion uint64        // data version number
 }
 
 // MessageType returns the message type.
@@ -240,12 +248,12 @@ func (m *Rgetattr) Reset() { *m = Rgetattr{} }
 
 // Encode encodes to the given binary.Buffer.
 func (m Rgetattr) Encode(buf *binary.Buffer) {
-	EncodeRgetattr(buf, m.Valid, m.Stat_t)
+	EncodeRgetattr(buf, &m)
 }
 
 // Decode decodes from the given binary.Buffer.
 func (m *Rgetattr) Decode(buf *binary.Buffer) {
-	DecodeRgetattr(buf, &m.Valid, m.Stat_t)
+	DecodeRgetattr(buf, m)
 }
 
 // IsDir reports whether m describes a directory. That is, it tests for
@@ -403,6 +411,27 @@ type Rlock struct {
 	Status uint8
 }
 
+// Represents lock types of Tlock and Tgetlock messages.
+const (
+	LockTypeRead   = 0
+	LockTypeWrite  = 1
+	LockTypeUnlock = 2
+)
+
+// Represents lock flags of Tlock messages.
+const (
+	LockFlagBlock   = 1
+	LockFlagReclaim = 2
+)
+
+// Represents lock status values of Rlock messages.
+const (
+	LockStatusSuccess = 0
+	LockStatusBlocked = 1
+	LockStatusError   = 2
+	LockStatusGrace   = 3
+)
+
 // Tgetlock tests for the existence of a POSIX record lock and has
 // semantics similar to Linux fcntl(F_GETLK).
 type Tgetlock struct {
@@ -21,6 +21,14 @@ const (
 	//
 	FixedReadWriteSize = HeaderSize + 4 + 8 + 4 // 23
 
+	// FixedDirentSize is the length of all fixed-width fields of a
+	// directory entry in a Rreaddir message. Directory entries are
+	// defined as
+	//
+	//     qid[13] offset[8] type[1] name[s]
+	//
+	FixedDirentSize = 13 + 8 + 1 + 2 // 24
+
 	// MaxDataSize is the maximum data size of a Twrite or Rread message.
 	MaxDataSize = math.MaxInt32 - (FixedReadWriteSize + 1) // ~ 2GB
 
@@ -82,6 +90,9 @@ const (
 	// ErrMessageTooSmall is returned during the parsing process if a
 	// message is too small.
 	ErrMessageTooSmall = Error("message too small")
+
+	// ErrNameTooLarge is returned if a file name exceeds MaxNameSize.
+	ErrNameTooLarge = Error("name too large")
 )
 
 // Message represents a 9P message and is used to access fields common to
@@ -22,7 +22,9 @@ type Qid struct {
 	// Path is an integer unique among all files in the hierarchy. If
 	// a file is deleted and recreated with the same name in the same
 	// directory, the old and new path components of the qids should
-	// be different.
+	// be different. A server may assign a new path to a file it
+	// cannot map to a path permanently, clients must not rely on the
+	// path of such a file being stable.
 	Path uint64
 }
 
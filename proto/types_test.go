@@ -64,6 +64,10 @@ func TestCodec(t *testing.T) {
 			t.Errorf("encode(%d): unexpected error: %v", n, err)
 			continue
 		}
+		if size := buf.Len() + payloadLen(test.in); size != test.in.Len() {
+			t.Errorf("encode(%d): expected encoded size %d, got %d",
+				n, test.in.Len(), size)
+		}
 
 		test.out.Decode(buf)
 		if err := buf.Err(); err != nil {
@@ -84,6 +88,14 @@ func TestCodec(t *testing.T) {
 	}
 }
 
+// payloadLen returns the encoded length of the inline payload of m.
+func payloadLen(m Message) int {
+	if p, ok := m.(Payloader); ok {
+		return 4 + len(p.Payload())
+	}
+	return 0
+}
+
 func TestQidCodec(t *testing.T) {
 	buf := make([]byte, 0, 13)
 	for n, test := range []struct {
@@ -113,3 +125,43 @@ func TestQidCodec(t *testing.T) {
 		}
 	}
 }
+
+func TestDirentCodec(t *testing.T) {
+	var buf []byte
+	ents := []Dirent{
+		{testQid, math.MaxUint64, math.MaxUint8, string8.String()},
+		{Qid{}, 0, 0, ""},
+		{Qid{Type: TypeDirectory, Path: 42}, 3, 4, "dir"},
+	}
+	for n, in := range ents {
+		var m int
+		var err error
+		if buf, m, err = in.Marshal(buf); err != nil {
+			t.Fatalf("dirent(%d): marshal error: %v", n, err)
+		}
+		if m != in.Len() {
+			t.Fatalf("dirent(%d): expected marshal length %d, got %d", n, in.Len(), m)
+		}
+	}
+
+	for n, in := range ents {
+		out := Dirent{}
+		var err error
+		if buf, err = out.Unmarshal(buf); err != nil {
+			t.Fatalf("dirent(%d): unmarshal error: %v", n, err)
+		}
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("dirent(%d): dirent differ\n%v\n%v", n, in, out)
+		}
+	}
+	if len(buf) != 0 {
+		t.Fatalf("dirent: unexpected %d trailing bytes", len(buf))
+	}
+
+	if _, err := (&Dirent{}).Unmarshal(make([]byte, FixedDirentSize-1)); err == nil {
+		t.Fatalf("dirent: expected short buffer error")
+	}
+	if _, _, err := (Dirent{Name: string16.String()}).Marshal(nil); err != ErrNameTooLarge {
+		t.Fatalf("dirent: expected error %v, got %v", ErrNameTooLarge, err)
+	}
+}
@@ -265,6 +265,10 @@ const (
 	// FlagSync is indicating to open for synchronous I/O.
 	FlagSync Flag = 0x101000
 
+	// FlagRemoveDir is passed to Tunlinkat to remove a directory, see
+	// AT_REMOVEDIR in unlinkat(2).
+	FlagRemoveDir Flag = 0x200
+
 	// internal used flags
 	flagCreate    Flag = 0x40
 	flagExclusive Flag = 0x80
@@ -350,7 +354,6 @@ func decodeTimespec(buf *binary.Buffer) unix.Timespec {
 // UnixDirTypeToQidType converts an unix directory type.
 func UnixDirTypeToQidType(typ uint8) uint8 {
 	switch typ {
-	//case unix.DT_BLK: ???
 	case unix.DT_CHR, unix.DT_FIFO, unix.DT_SOCK:
 		return TypeAppendOnly
 	case unix.DT_DIR:
@@ -364,7 +367,6 @@ func UnixDirTypeToQidType(typ uint8) uint8 {
 // UnixFileTypeToQidType converts an unix file type.
 func UnixFileTypeToQidType(mode uint32) uint8 {
 	switch mode & unix.S_IFMT {
-	//case unix.S_IFBLK: ???
 	case unix.S_IFCHR, unix.S_IFIFO, unix.S_IFSOCK:
 		return TypeAppendOnly
 	case unix.S_IFDIR:
@@ -78,6 +78,30 @@ func TestConvertFileModeUnix(t *testing.T) {
 	}
 }
 
+func TestUnixTypeToQidType(t *testing.T) {
+	for i, test := range []struct {
+		mode uint32
+		typ  uint8
+		want uint8
+	}{
+		// Block devices are addressable, hence regular files.
+		{unix.S_IFBLK, unix.DT_BLK, TypeRegular},
+		{unix.S_IFCHR, unix.DT_CHR, TypeAppendOnly},
+		{unix.S_IFIFO, unix.DT_FIFO, TypeAppendOnly},
+		{unix.S_IFSOCK, unix.DT_SOCK, TypeAppendOnly},
+		{unix.S_IFDIR, unix.DT_DIR, TypeDirectory},
+		{unix.S_IFLNK, unix.DT_LNK, TypeSymlink},
+		{unix.S_IFREG, unix.DT_REG, TypeRegular},
+	} {
+		if typ := UnixFileTypeToQidType(test.mode | 0644); typ != test.want {
+			t.Fatalf("type converter (#%.4d): expected file type %d, got %d", i, test.want, typ)
+		}
+		if typ := UnixDirTypeToQidType(test.typ); typ != test.want {
+			t.Fatalf("type converter (#%.4d): expected dir type %d, got %d", i, test.want, typ)
+		}
+	}
+}
+
 func TestConvertFlag(t *testing.T) {
 	for i, flags := range []int{
 		os.O_APPEND | os.O_WRONLY,
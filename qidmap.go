@@ -0,0 +1,120 @@
+package ninep
+
+import (
+	"container/list"
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+// Qid paths of files on the first devices seen carry the device index
+// in the upper qidDevBits bits and the inode number in the lower bits.
+// Paths of files on further devices or with larger inode numbers are
+// allocated from a counter below the overflow device index. At most
+// qidMaxOverflow allocated paths are remembered, the least recently
+// used are evicted. Allocated paths are never reused, hence an evicted
+// file gets a new path, which does not collide with any other, but the
+// path of a file in the overflow range is not stable. See stablePath.
+const (
+	qidDevBits     = 16
+	qidInoBits     = 64 - qidDevBits
+	qidMaxIno      = 1<<qidInoBits - 1
+	qidOverflow    = 1<<qidDevBits - 1
+	qidMaxOverflow = 1 << 20
+)
+
+type qidKey struct {
+	dev uint64
+	ino uint64
+}
+
+// qidmap allocates collision-free Qids for files identified by device
+// and inode number. A qidmap is owned by the server and shared by all
+// sessions, hence Qids are unique across exports.
+type qidmap struct {
+	mu       sync.Mutex // protects following
+	devices  map[uint64]uint64
+	overflow map[qidKey]*list.Element
+	lru      *list.List // of overflowPath, most recently used first
+	max      int        // maximal number of overflow paths
+	next     uint64
+}
+
+type overflowPath struct {
+	key  qidKey
+	path uint64
+}
+
+func newQidmap() *qidmap {
+	return &qidmap{
+		devices:  make(map[uint64]uint64),
+		overflow: make(map[qidKey]*list.Element),
+		lru:      list.New(),
+		max:      qidMaxOverflow,
+	}
+}
+
+func (m *qidmap) path(dev, ino uint64) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	idx, found := m.devices[dev]
+	if !found && len(m.devices) < qidOverflow {
+		idx, found = uint64(len(m.devices)), true
+		m.devices[dev] = idx
+	}
+	if found && ino <= qidMaxIno {
+		return idx<<qidInoBits | ino
+	}
+
+	key := qidKey{dev: dev, ino: ino}
+	if e, found := m.overflow[key]; found {
+		m.lru.MoveToFront(e)
+		return e.Value.(overflowPath).path
+	}
+	if m.lru.Len() >= m.max {
+		e := m.lru.Back()
+		delete(m.overflow, e.Value.(overflowPath).key)
+		m.lru.Remove(e)
+	}
+	m.next++
+	path := uint64(qidOverflow)<<qidInoBits | m.next
+	m.overflow[key] = m.lru.PushFront(overflowPath{key: key, path: path})
+	return path
+}
+
+// stablePath reports whether the Qid path qpath identifies a file
+// permanently. Paths allocated from the overflow range may change when
+// the file is evicted and must not be used as a cache key.
+func stablePath(qpath uint64) bool {
+	return qpath>>qidInoBits != qidOverflow
+}
+
+// Qid returns the Qid of the file described by st. The path of the Qid
+// is not stable for files in the overflow range.
+func (m *qidmap) Qid(st *unix.Stat_t) proto.Qid {
+	return proto.Qid{
+		Type:    proto.UnixFileTypeToQidType(uint32(st.Mode)),
+		Version: qidVersion(st),
+		Path:    m.path(uint64(st.Dev), st.Ino),
+	}
+}
+
+// qidVersion derives the Qid version from the modification and change
+// times and the size of a file. The version changes whenever the
+// content or the attributes of the file change.
+func qidVersion(st *unix.Stat_t) uint32 {
+	var buf [40]byte
+	binary.LittleEndian.PutUint64(buf[0:], uint64(st.Mtim.Sec))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(st.Mtim.Nsec))
+	binary.LittleEndian.PutUint64(buf[16:], uint64(st.Ctim.Sec))
+	binary.LittleEndian.PutUint64(buf[24:], uint64(st.Ctim.Nsec))
+	binary.LittleEndian.PutUint64(buf[32:], uint64(st.Size))
+
+	h := fnv.New32a()
+	h.Write(buf[:])
+	return h.Sum32()
+}
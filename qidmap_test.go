@@ -0,0 +1,83 @@
+package ninep
+
+import (
+	"testing"
+
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+func TestQidmapPath(t *testing.T) {
+	m := newQidmap()
+
+	a, b := m.path(1, 42), m.path(2, 42)
+	if a == b {
+		t.Fatalf("qidmap: expected distinct paths across devices, got %d", a)
+	}
+	if p := m.path(1, 42); p != a {
+		t.Fatalf("qidmap: expected stable path %d, got %d", a, p)
+	}
+
+	big1, big2 := m.path(1, 1<<60), m.path(1, 1<<60|1)
+	if big1 == big2 || big1>>qidInoBits != qidOverflow {
+		t.Fatalf("qidmap: unexpected overflow paths %x, %x", big1, big2)
+	}
+	if p := m.path(1, 1<<60); p != big1 {
+		t.Fatalf("qidmap: expected stable overflow path %x, got %x", big1, p)
+	}
+
+	seen := map[uint64]bool{a: true, b: true, big1: true, big2: true}
+	for dev := uint64(3); dev < qidOverflow+10; dev++ {
+		p := m.path(dev, 42)
+		if seen[p] {
+			t.Fatalf("qidmap: path %x of device %d collides", p, dev)
+		}
+		seen[p] = true
+	}
+}
+
+func TestQidmapOverflowEviction(t *testing.T) {
+	m := newQidmap()
+	m.max = 2
+
+	a, b := m.path(1, 1<<60), m.path(1, 1<<60|1)
+	if p := m.path(1, 1<<60); p != a {
+		t.Fatalf("qidmap: expected stable overflow path %x, got %x", a, p)
+	}
+	c := m.path(1, 1<<60|2) // evicts b
+	if n := len(m.overflow); n != 2 {
+		t.Fatalf("qidmap: expected 2 overflow paths, got %d", n)
+	}
+	if p := m.path(1, 1<<60); p != a {
+		t.Fatalf("qidmap: expected recently used path %x, got %x", a, p)
+	}
+	if p := m.path(1, 1<<60|1); p == b || p == a || p == c {
+		t.Fatalf("qidmap: expected new path for evicted file, got %x", p)
+	}
+}
+
+func TestQidmapQid(t *testing.T) {
+	m := newQidmap()
+	st := &unix.Stat_t{Dev: 1, Ino: 2, Mode: unix.S_IFDIR, Size: 10}
+	st.Mtim.Sec = 1000
+
+	q1 := m.Qid(st)
+	if q1.Type != proto.TypeDirectory {
+		t.Fatalf("qidmap: expected directory qid type %d, got %d", proto.TypeDirectory, q1.Type)
+	}
+	if q2 := m.Qid(st); q2 != q1 {
+		t.Fatalf("qidmap: expected equal qids, got %v and %v", q1, q2)
+	}
+
+	for _, modify := range []func(*unix.Stat_t){
+		func(st *unix.Stat_t) { st.Size++ },
+		func(st *unix.Stat_t) { st.Mtim.Nsec++ },
+		func(st *unix.Stat_t) { st.Ctim.Sec++ },
+	} {
+		version := m.Qid(st).Version
+		modify(st)
+		if q := m.Qid(st); q.Version == version || q.Path != q1.Path {
+			t.Fatalf("qidmap: expected new version of path %d, got %v", q1.Path, q)
+		}
+	}
+}
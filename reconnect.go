@@ -0,0 +1,473 @@
+package ninep
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	minReconnectBackoff = 100 * time.Millisecond
+	maxReconnectBackoff = 30 * time.Second
+)
+
+// Dialer establishes a new connection to a 9P2000.L server.
+type Dialer func(ctx context.Context) (io.ReadWriteCloser, error)
+
+// WithReconnect makes a Client re-establish a broken connection using
+// dial. The client redials with exponential backoff until it succeeds
+// or is closed, negotiates the protocol version and recovers all fids
+// by attaching and walking them again. Fids opened for I/O are opened
+// again with their original flags (except os.O_CREATE, os.O_EXCL and
+// os.O_TRUNC).
+//
+// Requests issued while the client reconnects are sent once the fids
+// are recovered. Requests lost with the broken connection are resent
+// if they are safe to repeat, others fail with io.ErrUnexpectedEOF.
+// Fids which cannot be recovered fail with the error of the server.
+// POSIX record locks are not recovered, the next lock request on a fid
+// which held locks fails with unix.ENOLCK.
+//
+// Clients created by Dial redial the network address if dial is nil.
+func WithReconnect(dial Dialer) Option {
+	return func(v interface{}) error {
+		c, ok := v.(*Client)
+		if !ok {
+			return fmt.Errorf("unknown ninep option type: %T", v)
+		}
+		c.reconnect = true
+		c.dial = dial
+		return nil
+	}
+}
+
+func withDefaultDialer(dial Dialer) Option {
+	return func(v interface{}) error {
+		if c := v.(*Client); (c.reconnect || c.conns > 1) && c.dial == nil {
+			c.dial = dial
+		}
+		return nil
+	}
+}
+
+// tracking returns whether the client records the state of its fids,
+// which is required to reconnect and to stripe I/O across connections.
+func (c *Client) tracking() bool { return c.reconnect || c.pool != nil }
+
+// attachInfo records the arguments of an attach request.
+type attachInfo struct {
+	export   string
+	username string
+	uid      uint32
+}
+
+// fidState records how to recover a fid after reconnecting. The path
+// is relative to the root of the attach.
+type fidState struct {
+	attach *attachInfo
+	path   string
+	opened bool
+	flags  int
+
+	locked   bool // holds POSIX record locks
+	lockLost bool // locks were lost with a broken connection
+}
+
+func (c *Client) track(num uint32, attach *attachInfo) {
+	if !c.tracking() {
+		return
+	}
+	c.mu.Lock()
+	c.fids[num] = &fidState{attach: attach}
+	c.mu.Unlock()
+}
+
+func (c *Client) trackWalk(parent, num uint32, names []string) {
+	if !c.tracking() {
+		return
+	}
+	c.mu.Lock()
+	if st, found := c.fids[parent]; found {
+		elems := append([]string{st.path}, names...)
+		c.fids[num] = &fidState{attach: st.attach, path: path.Join(elems...)}
+	}
+	c.mu.Unlock()
+}
+
+func (c *Client) trackOpen(num uint32, name string, flags int) {
+	if !c.tracking() {
+		return
+	}
+	c.mu.Lock()
+	if st, found := c.fids[num]; found {
+		st.path = path.Join(st.path, name)
+		st.opened = true
+		st.flags = flags &^ (os.O_CREATE | os.O_EXCL | os.O_TRUNC)
+	}
+	c.mu.Unlock()
+}
+
+// trackRename updates the paths of all fids below the renamed file.
+func (c *Client) trackRename(olddir uint32, oldname string, newdir uint32, newname string) {
+	if !c.tracking() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	oldst, newst := c.fids[olddir], c.fids[newdir]
+	if oldst == nil || newst == nil || oldst.attach != newst.attach {
+		return
+	}
+	oldpath := path.Join(oldst.path, oldname)
+	newpath := path.Join(newst.path, newname)
+	for _, st := range c.fids {
+		if st.attach != oldst.attach {
+			continue
+		}
+		if st.path == oldpath || strings.HasPrefix(st.path, oldpath+separator) {
+			st.path = newpath + st.path[len(oldpath):]
+		}
+	}
+}
+
+// trackLock records whether fid holds POSIX record locks.
+func (c *Client) trackLock(num uint32, locked bool) {
+	if !c.tracking() {
+		return
+	}
+	c.mu.Lock()
+	if st, found := c.fids[num]; found {
+		st.locked = locked
+	}
+	c.mu.Unlock()
+}
+
+// lostLocks returns whether the locks of fid were lost since the last
+// call.
+func (c *Client) lostLocks(num uint32) bool {
+	if !c.tracking() {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st, found := c.fids[num]
+	if !found || !st.lockLost {
+		return false
+	}
+	st.lockLost = false
+	return true
+}
+
+func (c *Client) untrack(num uint32) {
+	if !c.tracking() {
+		return
+	}
+	c.mu.Lock()
+	delete(c.fids, num)
+	c.mu.Unlock()
+}
+
+// retryable returns whether the request f may be sent again if it was
+// lost with a broken connection. The caller must hold c.mu.
+func (c *Client) retryable(f *proto.Fcall) bool {
+	switch tx := f.Tx.(type) {
+	case *proto.Twrite:
+		// a write to a file opened with O_APPEND is not idempotent
+		st, found := c.fids[tx.Fid]
+		return found && st.flags&os.O_APPEND == 0
+	case *proto.Tlattach, *proto.Twalk, *proto.Tgetattr, *proto.Tsetattr,
+		*proto.Tlopen, *proto.Tread, *proto.Treaddir, *proto.Tstatfs,
+		*proto.Treadlink, *proto.Tgetlock, *proto.Tfsync, *proto.Tclunk,
+		*proto.Tflush, *proto.Txattrwalk:
+		return true
+	}
+	return false
+}
+
+// broke handles a broken connection of a reconnecting client. Pending
+// requests which are safe to retry are kept, the others fail with
+// err. The caller must hold c.writer and c.mu.
+func (c *Client) broke(err error) {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	for tag, f := range c.pending {
+		if f == nil {
+			continue // released by flush
+		}
+		delete(c.pending, tag)
+		if !c.broken && c.retryable(f) {
+			c.retry[tag] = f
+			continue
+		}
+		c.tag.Put(int64(tag))
+		done(f, err)
+	}
+
+	if !c.broken {
+		c.broken = true
+		c.ready = make(chan struct{})
+		go c.redial()
+	}
+}
+
+// redial re-establishes the connection with exponential backoff until
+// it succeeds or the client is closed.
+func (c *Client) redial() {
+	backoff := minReconnectBackoff
+	for {
+		c.mu.Lock()
+		closing := c.closing
+		c.mu.Unlock()
+		if closing {
+			break
+		}
+
+		rwc, err := c.dialContext()
+		if err == nil {
+			if err = c.recover(rwc); err == nil {
+				return
+			}
+			rwc.Close()
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-c.closed:
+		}
+		if backoff *= 2; backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+
+	c.writer.Lock()
+	c.mu.Lock()
+	c.fail(errConnectionShutdown)
+	c.mu.Unlock()
+	c.writer.Unlock()
+}
+
+// dialContext dials a new connection, giving up after
+// maxReconnectBackoff or once the client is closed.
+func (c *Client) dialContext() (io.ReadWriteCloser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), maxReconnectBackoff)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return c.dial(ctx)
+}
+
+// recover switches the client to the connection rwc, recovers all
+// fids and resends lost requests.
+func (c *Client) recover(rwc io.ReadWriteCloser) error {
+	c.writer.Lock()
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		c.writer.Unlock()
+		return errConnectionShutdown
+	}
+	c.c = rwc
+	c.enc = proto.NewEncoder(rwc, c.maxMessageSize)
+	c.gen++
+	gen := c.gen
+	c.mu.Unlock()
+	c.writer.Unlock()
+	go c.recv(proto.NewDecoder(rwc, c.maxMessageSize), gen)
+
+	ctx := context.Background()
+	if err := c.version(ctx); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	fids := make(map[*attachInfo]map[uint32]fidState)
+	for num, st := range c.fids {
+		if st.locked {
+			// the server released the locks with the connection
+			st.locked, st.lockLost = false, true
+		}
+		if fids[st.attach] == nil {
+			fids[st.attach] = make(map[uint32]fidState)
+		}
+		fids[st.attach][num] = *st
+	}
+	c.mu.Unlock()
+
+	for attach, states := range fids {
+		if err := c.recoverFids(ctx, attach, states); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	if c.closing {
+		c.mu.Unlock()
+		return errConnectionShutdown
+	}
+	resend := make(map[uint16]*proto.Fcall, len(c.retry))
+	for tag, f := range c.retry {
+		delete(c.retry, tag)
+		c.pending[tag] = f
+		resend[tag] = f
+	}
+	c.broken = false
+	close(c.ready)
+	c.mu.Unlock()
+
+	for tag, f := range resend {
+		c.send(tag, f)
+	}
+	return nil
+}
+
+// version negotiates the protocol version on a new connection. The
+// message size must not shrink, as requests may be in flight.
+func (c *Client) version(ctx context.Context) error {
+	f := mustAlloc(proto.MessageTversion)
+	defer proto.Release(f)
+
+	tx := f.Tx.(*proto.Tversion)
+	tx.MessageSize = c.maxMessageSize
+	tx.Version = proto.Version
+	if err := c.call(ctx, f, true); err != nil {
+		return err
+	}
+	rx := f.Rx.(*proto.Rversion)
+	if rx.Version != tx.Version || rx.MessageSize < c.maxMessageSize {
+		return errVersionNotSupported
+	}
+	return nil
+}
+
+// recoverFids attaches the file tree described by attach and walks
+// and opens the fids again. Fids which cannot be recovered are no
+// longer tracked. Only connection errors are returned.
+func (c *Client) recoverFids(ctx context.Context, attach *attachInfo, states map[uint32]fidState) error {
+	v, ok := c.fid.Get()
+	if !ok {
+		return errFidOverflow
+	}
+	root := uint32(v)
+
+	if err := c.attach(ctx, root, attach); err != nil {
+		if !isErrno(err) {
+			return err
+		}
+		for num := range states {
+			c.untrack(num)
+		}
+		return nil
+	}
+	for num, st := range states {
+		err := c.recoverFid(ctx, root, num, st)
+		if isErrno(err) {
+			c.untrack(num)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := c.clunk(ctx, root); !isErrno(err) {
+		return err
+	}
+	return nil
+}
+
+// isErrno returns whether err was returned by the server.
+func isErrno(err error) bool {
+	_, ok := err.(unix.Errno)
+	return ok
+}
+
+// recoverFid walks num to the file described by st and opens it
+// again. If the recovery fails once num exists on the server, num is
+// clunked, so that resent requests do not reach another file.
+func (c *Client) recoverFid(ctx context.Context, root, num uint32, st fidState) error {
+	names := splitPath(st.path)
+	from := root
+	for {
+		batch := names
+		if len(batch) > proto.MaxNames {
+			batch = batch[:proto.MaxNames]
+		}
+		if err := c.walkTo(ctx, from, num, batch); err != nil {
+			if from == num {
+				c.clunk(ctx, num)
+			}
+			return err
+		}
+		if from, names = num, names[len(batch):]; len(names) == 0 {
+			break
+		}
+	}
+	if !st.opened {
+		return nil
+	}
+
+	f := mustAlloc(proto.MessageTlopen)
+	defer proto.Release(f)
+
+	tx := f.Tx.(*proto.Tlopen)
+	tx.Fid = num
+	tx.Flags = proto.NewFlag(st.flags)
+	if err := c.call(ctx, f, true); err != nil {
+		c.clunk(ctx, num)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) attach(ctx context.Context, num uint32, attach *attachInfo) error {
+	f := mustAlloc(proto.MessageTattach)
+	defer proto.Release(f)
+
+	tx := f.Tx.(*proto.Tlattach)
+	tx.AuthFid = proto.NoFid
+	tx.Fid = num
+	tx.Path = attach.export
+	tx.UserName = attach.username
+	tx.Uid = attach.uid
+	return c.call(ctx, f, true)
+}
+
+// walkTo walks names relative to fid to newfid, which may equal fid.
+func (c *Client) walkTo(ctx context.Context, fid, newfid uint32, names []string) error {
+	f := mustAlloc(proto.MessageTwalk)
+	defer proto.Release(f)
+
+	tx := f.Tx.(*proto.Twalk)
+	tx.Fid = fid
+	tx.NewFid = newfid
+	tx.Names = names
+	if err := c.call(ctx, f, true); err != nil {
+		return err
+	}
+	if rx := f.Rx.(*proto.Rwalk); len(*rx) != len(names) {
+		return unix.ENOENT
+	}
+	return nil
+}
+
+func (c *Client) clunk(ctx context.Context, num uint32) error {
+	f := mustAlloc(proto.MessageTclunk)
+	defer proto.Release(f)
+
+	f.Tx.(*proto.Tclunk).Fid = num
+	return c.call(ctx, f, true)
+}
@@ -0,0 +1,336 @@
+package ninep
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+// mockServer serves a mockTree on connections created by dial. Each
+// connection starts a new session. If breakOn is set, the connection
+// breaks instead of answering the next request of that type.
+type mockServer struct {
+	*mockTree
+
+	mu      sync.Mutex
+	conn    net.Conn
+	dials   int // including refused ones
+	down    bool
+	breakOn proto.MessageType
+}
+
+func (s *mockServer) dial(ctx context.Context) (io.ReadWriteCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dials++
+	if s.down {
+		return nil, unix.ECONNREFUSED
+	}
+	s.mockTree.mu.Lock()
+	s.fids = make(map[uint32]string)
+	s.mockTree.mu.Unlock()
+
+	server, client := net.Pipe()
+	s.conn = server
+	go serveMock(server, s.handle)
+	return client, nil
+}
+
+func (s *mockServer) handle(tx, rx proto.Message) error {
+	s.mu.Lock()
+	if s.breakOn != 0 && tx.MessageType() == s.breakOn {
+		s.breakOn = 0
+		s.conn.Close()
+		s.mu.Unlock()
+		return errMockNoReply
+	}
+	s.mu.Unlock()
+	return s.mockTree.handle(tx, rx)
+}
+
+// breakConn breaks the connection and waits until the client is
+// connected again.
+func (s *mockServer) breakConn(t *testing.T, c *Client) {
+	t.Helper()
+
+	s.mu.Lock()
+	s.conn.Close()
+	s.mu.Unlock()
+	waitClient(t, c, func() bool { return c.gen > 0 && !c.broken })
+}
+
+// waitClient waits until cond, which is called with c.mu held, holds.
+func waitClient(t *testing.T, c *Client, cond func() bool) {
+	t.Helper()
+
+	for i := 0; ; i++ {
+		c.mu.Lock()
+		ok := cond()
+		c.mu.Unlock()
+		if ok {
+			return
+		}
+		if i > 5000 {
+			t.Fatalf("client: condition not reached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newReconnectClient(t *testing.T, s *mockServer) *Client {
+	t.Helper()
+
+	conn, err := s.dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial: unexpected error: %v", err)
+	}
+	c, err := NewClient(conn, WithReconnect(s.dial))
+	if err != nil {
+		t.Fatalf("client: cannot initialize connection: %v", err)
+	}
+	return c
+}
+
+func TestClientReconnect(t *testing.T) {
+	s := &mockServer{mockTree: newMockTree(false, map[string]bool{
+		"dir": true, "dir/file": false,
+	})}
+	s.data["dir/file"] = []byte("hello world")
+	c := newReconnectClient(t, s)
+	defer c.Close()
+
+	r, err := c.AttachRoot("/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	f, err := r.OpenFile("dir/file", os.O_RDWR|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	if _, err = f.Write([]byte("hello gopher")); err != nil {
+		t.Fatalf("write: unexpected error: %v", err)
+	}
+	if err = r.Rename("dir", "moved"); err != nil {
+		t.Fatalf("rename: unexpected error: %v", err)
+	}
+
+	s.breakConn(t, c)
+	s.mockTree.mu.Lock()
+	if len(s.fids) != 2 || s.fids[f.fid.num] != "moved/file" {
+		t.Fatalf("reconnect: unexpected recovered fids %v", s.fids)
+	}
+	s.mockTree.mu.Unlock()
+	buf := make([]byte, 5)
+	if _, err = f.ReadAt(buf, 6); err != nil || string(buf) != "gophe" {
+		t.Fatalf("read: unexpected result %q, %v", buf, err)
+	}
+	if data := s.data["moved/file"]; string(data) != "hello gopher" {
+		t.Fatalf("reconnect: file truncated again, got %q", data)
+	}
+
+	// in flight requests are resent if it is safe
+	s.mu.Lock()
+	s.breakOn = proto.MessageTread
+	s.mu.Unlock()
+	if _, err = f.ReadAt(buf, 0); err != nil || string(buf) != "hello" {
+		t.Fatalf("read: unexpected result %q, %v", buf, err)
+	}
+	s.mu.Lock()
+	s.breakOn = proto.MessageTmkdir
+	s.mu.Unlock()
+	if err = r.Mkdir("new", 0755); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("mkdir: expected error %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	waitClient(t, c, func() bool { return c.gen == 3 && !c.broken })
+	if _, err = r.Stat("moved/file"); err != nil {
+		t.Fatalf("stat: unexpected error: %v", err)
+	}
+
+	f.Close()
+	r.Close()
+	if len(c.fids) != 0 || len(s.fids) != 0 {
+		t.Fatalf("close: fids not clunked, client %v, server %v", c.fids, s.fids)
+	}
+}
+
+func TestClientReconnectClose(t *testing.T) {
+	s := &mockServer{mockTree: newMockTree(false, map[string]bool{})}
+	c := newReconnectClient(t, s)
+	r, err := c.AttachRoot("/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+
+	s.mu.Lock()
+	s.down = true
+	s.conn.Close()
+	s.mu.Unlock()
+	waitClient(t, c, func() bool { return c.broken })
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.Stat("")
+		errc <- err
+	}()
+	c.Close()
+	if err = <-errc; !errors.Is(err, errConnectionShutdown) {
+		t.Fatalf("stat: expected error %v, got %v", errConnectionShutdown, err)
+	}
+}
+
+func TestClientReconnectStale(t *testing.T) {
+	files := map[string]bool{"stale": false}
+	deep := ""
+	for i := 0; i < proto.MaxNames+4; i++ {
+		deep = path.Join(deep, "d")
+		files[deep] = true
+	}
+	good := []string{"a", "b", "c", "d/e"}
+	for _, name := range good {
+		files[name] = false
+	}
+	s := &mockServer{mockTree: newMockTree(false, files)}
+	c := newReconnectClient(t, s)
+	defer c.Close()
+
+	root, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	var fids []*Fid
+	for _, name := range append([]string{"stale", deep}, good...) {
+		fid, err := root.Walk(splitPath(name)...)
+		if err != nil {
+			t.Fatalf("walk: unexpected error: %v", err)
+		}
+		fids = append(fids, fid)
+	}
+
+	// the stale file and the end of the deep path are removed while
+	// the client is disconnected
+	s.mockTree.mu.Lock()
+	delete(s.files, "stale")
+	for name := range s.files {
+		if strings.Count(name, "/") >= proto.MaxNames+2 {
+			delete(s.files, name)
+		}
+	}
+	s.mockTree.mu.Unlock()
+	s.breakConn(t, c)
+
+	s.mockTree.mu.Lock()
+	defer s.mockTree.mu.Unlock()
+	for _, fid := range fids[:2] {
+		if name, found := s.fids[fid.num]; found {
+			t.Fatalf("reconnect: stale fid %d attached to %q", fid.num, name)
+		}
+		if _, found := c.fids[fid.num]; found {
+			t.Fatalf("reconnect: stale fid %d still tracked", fid.num)
+		}
+	}
+	for i, fid := range fids[2:] {
+		if name := s.fids[fid.num]; name != good[i] {
+			t.Fatalf("reconnect: fid %d of %q attached to %q", fid.num, good[i], name)
+		}
+	}
+}
+
+func TestClientReconnectCloseRetry(t *testing.T) {
+	s := &mockServer{mockTree: newMockTree(false, map[string]bool{"file": false})}
+	c := newReconnectClient(t, s)
+	root, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	f, err := root.OpenFile("file", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+
+	s.mu.Lock()
+	s.down = true
+	s.breakOn = proto.MessageTread
+	dials := s.dials
+	s.mu.Unlock()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := f.ReadAt(make([]byte, 1), 0)
+		errc <- err
+	}()
+
+	// wait until the client backs off for a while
+	for i := 0; ; i++ {
+		s.mu.Lock()
+		n := s.dials - dials
+		s.mu.Unlock()
+		if n >= 3 {
+			break
+		}
+		if i > 5000 {
+			t.Fatalf("client: not redialing")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c.Close()
+	select {
+	case err = <-errc:
+		if !errors.Is(err, errConnectionShutdown) {
+			t.Fatalf("read: expected error %v, got %v", errConnectionShutdown, err)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("read: lost request not failed by close")
+	}
+}
+
+func TestClientReconnectLocks(t *testing.T) {
+	s := &mockServer{mockTree: newMockTree(false, map[string]bool{"file": false})}
+	c := newReconnectClient(t, s)
+	defer c.Close()
+
+	root, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	f, err := root.Walk("file")
+	if err != nil {
+		t.Fatalf("walk: unexpected error: %v", err)
+	}
+	if err = f.Open(os.O_RDWR); err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	if err = f.Lock(proto.LockTypeWrite, 0, 0); err != nil {
+		t.Fatalf("lock: unexpected error: %v", err)
+	}
+
+	s.breakConn(t, c)
+	if err = f.Unlock(0, 0); err != unix.ENOLCK {
+		t.Fatalf("unlock: expected error %v, got %v", unix.ENOLCK, err)
+	}
+	if err = f.Lock(proto.LockTypeWrite, 0, 0); err != nil {
+		t.Fatalf("lock: unexpected error: %v", err)
+	}
+	if err = f.Unlock(0, 0); err != nil {
+		t.Fatalf("unlock: unexpected error: %v", err)
+	}
+
+	// fids without locks are not affected
+	s.mu.Lock()
+	s.conn.Close()
+	s.mu.Unlock()
+	waitClient(t, c, func() bool { return c.gen == 2 && !c.broken })
+	if err = f.TryLock(proto.LockTypeRead, 0, 0); err != nil {
+		t.Fatalf("trylock: unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package ninep
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinks is the maximal number of symbolic links followed by
+// Stat, as on Linux.
+const maxSymlinks = 40
+
+// Root is an attached file tree whose files are addressed by
+// slash-separated paths. Paths are relative to the root of the tree,
+// a leading slash is ignored and ".." elements never leave the tree.
+// Paths are walked in batches of proto.MaxNames elements.
+//
+// The methods of Root mirror the functions of package os and return
+// errors of type *os.PathError or *os.LinkError.
+type Root struct {
+	fid *Fid // only its immutable number and attributes are used
+}
+
+// AttachRoot attaches the file tree selected by export like Attach and
+// returns it as Root.
+func (c *Client) AttachRoot(export, username string, uid int) (*Root, error) {
+	fid, err := c.Attach(nil, export, username, uid)
+	if err != nil {
+		return nil, err
+	}
+	return NewRoot(fid), nil
+}
+
+// NewRoot returns a Root representing the file tree below the
+// directory represented by fid. Closing the Root closes fid.
+func NewRoot(fid *Fid) *Root { return &Root{fid: fid} }
+
+// Fid returns the fid representing the root of the file tree.
+func (r *Root) Fid() *Fid { return r.fid }
+
+// Close closes the root fid.
+func (r *Root) Close() error { return r.fid.Close() }
+
+// relPath returns name relative to the root.
+func relPath(name string) string {
+	return strings.TrimPrefix(path.Clean(separator+name), separator)
+}
+
+// OpenFile opens the named file with specified flags (os.O_RDONLY
+// etc.). If the file does not exist and the os.O_CREATE flag is
+// passed, it is created with mode perm.
+func (r *Root) OpenFile(name string, flags int, perm os.FileMode) (*File, error) {
+	fid, err := r.fid.openFile(context.Background(), relPath(name), flags, perm)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return newFile(fid, name, flags), nil
+}
+
+// Open opens the named file for reading.
+func (r *Root) Open(name string) (*File, error) {
+	return r.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates the named file. If the file does not
+// exist, it is created with mode 0666.
+func (r *Root) Create(name string) (*File, error) {
+	return r.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Lstat returns an os.FileInfo describing the named file. If the file
+// is a symbolic link, the returned os.FileInfo describes the symbolic
+// link.
+func (r *Root) Lstat(name string) (os.FileInfo, error) {
+	fi, err := r.lstat(relPath(name))
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return fi, nil
+}
+
+func (r *Root) lstat(name string) (os.FileInfo, error) {
+	names := splitPath(name)
+	if fi, ok, err := r.fid.cachedLstat(names); ok {
+		if err != nil {
+			return nil, err
+		}
+		return *fi, nil
+	}
+	fidnum, fi, err := r.fid.walk(context.Background(), names...)
+	if err != nil {
+		return nil, err
+	}
+	(&Fid{c: r.fid.c, num: fidnum}).clunk(context.Background())
+	return *fi, nil
+}
+
+// Stat returns an os.FileInfo describing the named file. If the file
+// is a symbolic link, the link is followed. Symbolic links in the
+// directory elements of name are not followed.
+func (r *Root) Stat(name string) (os.FileInfo, error) {
+	rel := relPath(name)
+	for i := 0; i <= maxSymlinks; i++ {
+		fi, err := r.lstat(rel)
+		if err != nil {
+			return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return fi, nil
+		}
+
+		target, err := r.fid.readLink(context.Background(), rel)
+		if err != nil {
+			return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(rel), target)
+		}
+		rel = relPath(target)
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: unix.ELOOP}
+}
+
+// Mkdir creates a new directory with the specified name and
+// permission bits.
+func (r *Root) Mkdir(name string, perm os.FileMode) error {
+	dir, base := path.Split(relPath(name))
+
+	parent, err := r.fid.walkDir(context.Background(), dir)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	defer parent.release(r.fid)
+
+	if err = parent.mkdir(context.Background(), base, perm); err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+// MkdirAll creates a directory named name, along with any necessary
+// parents. The permission bits perm are used for all directories that
+// MkdirAll creates. If name is already a directory, MkdirAll does
+// nothing and returns nil.
+func (r *Root) MkdirAll(name string, perm os.FileMode) error {
+	fi, err := r.Stat(name)
+	if err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: name, Err: unix.ENOTDIR}
+	}
+
+	if parent := path.Dir(relPath(name)); parent != "." {
+		if err = r.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+
+	if err = r.Mkdir(name, perm); err != nil {
+		// created by someone else meanwhile
+		if fi, lerr := r.Lstat(name); lerr == nil && fi.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Remove removes the named file or (empty) directory.
+func (r *Root) Remove(name string) error {
+	dir, base := path.Split(relPath(name))
+	if base == "" {
+		return &os.PathError{Op: "remove", Path: name, Err: unix.EBUSY}
+	}
+
+	parent, err := r.fid.walkDir(context.Background(), dir)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	defer parent.release(r.fid)
+
+	err = parent.unlinkat(context.Background(), base, false)
+	if err == nil {
+		return nil
+	}
+	derr := parent.unlinkat(context.Background(), base, true)
+	if derr == nil {
+		return nil
+	}
+
+	// Both failed: figure out which error to return, as os.Remove
+	// does.
+	if derr != unix.ENOTDIR {
+		err = derr
+	}
+	return &os.PathError{Op: "remove", Path: name, Err: err}
+}
+
+// RemoveAll removes name and any children it contains. It removes
+// everything it can but returns the first error it encounters. If name
+// does not exist, RemoveAll returns nil.
+func (r *Root) RemoveAll(name string) error {
+	if relPath(name) == "" {
+		return &os.PathError{Op: "RemoveAll", Path: name, Err: unix.EINVAL}
+	}
+
+	err := r.Remove(name)
+	if err == nil || os.IsNotExist(err) {
+		return nil
+	}
+	fi, serr := r.Lstat(name)
+	if serr != nil {
+		if os.IsNotExist(serr) {
+			return nil
+		}
+		return serr
+	}
+	if !fi.IsDir() {
+		return err
+	}
+
+	dir, err := r.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	info, first := dir.Readdir(-1)
+	for _, fi := range info {
+		if err := r.RemoveAll(path.Join(name, fi.Name())); err != nil && first == nil {
+			first = err
+		}
+	}
+	dir.Close()
+
+	if err = r.Remove(name); err != nil && !os.IsNotExist(err) && first == nil {
+		first = err
+	}
+	return first
+}
+
+// Rename renames (moves) oldpath to newpath.
+func (r *Root) Rename(oldpath, newpath string) error {
+	olddir, oldname := path.Split(relPath(oldpath))
+	newdir, newname := path.Split(relPath(newpath))
+	if isReserved(oldname) || isReserved(newname) {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errInvalildName}
+	}
+	err := r.fid.rename(context.Background(), olddir, oldname, newdir, newname)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
+// ReadFile reads the named file and returns the contents. A successful
+// call returns err == nil, not err == io.EOF.
+func (r *Root) ReadFile(name string) ([]byte, error) {
+	f, err := r.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size := 0
+	if fi, err := f.Stat(); err == nil {
+		size = int(fi.Size())
+	}
+	data := make([]byte, 0, size+1)
+	for {
+		if len(data) == cap(data) {
+			data = append(data, 0)[:len(data)]
+		}
+		n, err := f.Read(data[len(data):cap(data)])
+		data = data[:len(data)+n]
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return data, err
+		}
+	}
+}
+
+// WriteFile writes data to the named file, creating it if necessary.
+// If the file does not exist, WriteFile creates it with permissions
+// perm, otherwise WriteFile truncates it before writing.
+func (r *Root) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f, err := r.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package ninep
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func attachMockRoot(t *testing.T, m *mockTree) (*Client, *Root) {
+	t.Helper()
+
+	c := newMockClient(t, m.handle)
+	r, err := c.AttachRoot("/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	return c, r
+}
+
+func TestRootDeepPath(t *testing.T) {
+	m := newMockTree(false, map[string]bool{})
+	c, r := attachMockRoot(t, m)
+	defer c.Close()
+
+	dir := "/" + strings.Repeat("d/", 40)
+	if err := r.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("mkdirall: unexpected error: %v", err)
+	}
+	if err := r.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("mkdirall: unexpected error: %v", err)
+	}
+
+	name := path.Join(dir, "file")
+	if err := r.WriteFile(name, []byte("hello"), 0644); err != nil {
+		t.Fatalf("writefile: unexpected error: %v", err)
+	}
+	data, err := r.ReadFile(name)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("readfile: unexpected result %q, %v", data, err)
+	}
+	err = r.MkdirAll(name, 0755)
+	checkPathError(t, "mkdirall", err, unix.ENOTDIR)
+
+	if len(m.fids) != 1 {
+		t.Fatalf("walk: %d intermediate fids not clunked", len(m.fids)-1)
+	}
+
+	err = r.Remove("d")
+	checkPathError(t, "remove", err, unix.ENOTEMPTY)
+	if err = r.RemoveAll("d"); err != nil {
+		t.Fatalf("removeall: unexpected error: %v", err)
+	}
+	if err = r.RemoveAll("d"); err != nil {
+		t.Fatalf("removeall: unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(m.files, map[string]bool{"": true}) {
+		t.Fatalf("removeall: unexpected files %v", m.files)
+	}
+	if len(m.fids) != 1 {
+		t.Fatalf("removeall: %d fids not clunked", len(m.fids)-1)
+	}
+	r.Close()
+}
+
+func TestRootStatRename(t *testing.T) {
+	m := newMockTree(false, map[string]bool{"dir": true, "dir/file": false})
+	m.data["dir/file"] = []byte("data")
+	c, r := attachMockRoot(t, m)
+	defer c.Close()
+	defer r.Close()
+
+	dir, err := r.fid.Walk("dir")
+	if err != nil {
+		t.Fatalf("walk: unexpected error: %v", err)
+	}
+	for name, target := range map[string]string{
+		"link": "file", "abs": "/dir/link", "loop": "loop", "dangling": "none",
+	} {
+		if _, err = dir.Symlink(name, target); err != nil {
+			t.Fatalf("symlink: unexpected error: %v", err)
+		}
+	}
+	dir.Close()
+
+	fi, err := r.Lstat("dir/abs")
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("lstat: unexpected result %v, %v", fi, err)
+	}
+	fi, err = r.Stat("/dir/abs")
+	if err != nil || fi.Name() != "file" || fi.Size() != 4 {
+		t.Fatalf("stat: unexpected result %v, %v", fi, err)
+	}
+	_, err = r.Stat("dir/loop")
+	checkPathError(t, "stat", err, unix.ELOOP)
+	if _, err = r.Stat("dir/dangling"); !os.IsNotExist(err) {
+		t.Fatalf("stat: expected not exist error, got %v", err)
+	}
+
+	if err = r.Rename("dir/file", "/moved"); err != nil {
+		t.Fatalf("rename: unexpected error: %v", err)
+	}
+	if err = r.Rename("dir/file", "/moved"); !os.IsNotExist(err) {
+		t.Fatalf("rename: expected not exist error, got %v", err)
+	}
+	if _, ok := err.(*os.LinkError); !ok {
+		t.Fatalf("rename: unexpected error type %T", err)
+	}
+	if data, err := r.ReadFile("moved"); err != nil || string(data) != "data" {
+		t.Fatalf("readfile: unexpected result %q, %v", data, err)
+	}
+
+	f, err := r.Create("dir/new")
+	if err != nil {
+		t.Fatalf("create: unexpected error: %v", err)
+	}
+	f.Close()
+	if err = r.Remove("dir/new"); err != nil {
+		t.Fatalf("remove: unexpected error: %v", err)
+	}
+	if _, err = r.Open("dir/new"); !os.IsNotExist(err) {
+		t.Fatalf("open: expected not exist error, got %v", err)
+	}
+}
+
+func TestRootUnlocked(t *testing.T) {
+	m := newMockTree(false, map[string]bool{"dir": true, "dir/file": false})
+	c, r := attachMockRoot(t, m)
+	defer c.Close()
+	defer r.Close()
+
+	// Requests on the root must not wait for each other, hence must
+	// not need the lock of the root fid.
+	r.fid.mu.Lock()
+	defer r.fid.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		if err := r.Mkdir("dir/sub", 0755); err != nil {
+			done <- err
+			return
+		}
+		if _, err := r.Stat("dir/sub"); err != nil {
+			done <- err
+			return
+		}
+		if err := r.Rename("dir/file", "moved"); err != nil {
+			done <- err
+			return
+		}
+		f, err := r.Open("moved")
+		if err != nil {
+			done <- err
+			return
+		}
+		f.Close()
+		done <- r.Remove("dir/sub")
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("root: unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("root: requests wait for the root fid lock")
+	}
+}
@@ -0,0 +1,245 @@
+package ninep
+
+import (
+	"context"
+	"io"
+)
+
+const (
+	// defaultWindow is the number of bytes kept in flight by a File
+	// in sequential mode if no window is given.
+	defaultWindow = 4 << 20
+
+	// maxWindowRequests is the maximal number of requests kept in
+	// flight by a File in sequential mode.
+	maxWindowRequests = 256
+)
+
+// request is a read or write request issued in the background.
+type request struct {
+	off  int64
+	buf  []byte
+	n    int
+	err  error
+	done chan struct{}
+}
+
+// startRequest transfers buf at offset off in the background.
+func startRequest(ctx context.Context, fid *Fid, buf []byte, off int64,
+	transfer func(*Fid, context.Context, []byte, int64) (int, error)) *request {
+	r := &request{off: off, buf: buf, done: make(chan struct{})}
+	go func() {
+		r.n, r.err = transfer(fid, ctx, buf, off)
+		close(r.done)
+	}()
+	return r
+}
+
+// sequential holds the state of a File in sequential mode. Read keeps
+// reading ahead of the offset of the file, Write queues the data and
+// sends it in the background.
+type sequential struct {
+	fid    *Fid
+	window int // maximal number of requests in flight
+	size   int // data size of a request
+
+	// read-ahead, reads[0] is consumed up to pos
+	ctx    context.Context
+	cancel context.CancelFunc
+	reads  []*request
+	next   int64
+	pos    int
+
+	// write-behind, buf is written at off once full
+	writes  []*request
+	buf     []byte
+	off     int64
+	pending error // first error of a completed write
+}
+
+// SetSequential switches the File to sequential mode, or back to
+// normal mode if window is negative. In sequential mode, Read keeps up
+// to window bytes of read requests outstanding ahead of the offset of
+// the file, and Write queues data and sends up to window bytes in the
+// background. Requests are of the maximal data size negotiated with
+// the server. If window is 0, a window of 4 MiB is used.
+//
+// Errors of queued writes are returned by the next call of a File
+// method, or by Sync or Close. Writes to files opened with os.O_APPEND
+// are not queued.
+func (f *File) SetSequential(window int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.checkValid("sequential"); err != nil {
+		return err
+	}
+	err := f.leaveSequential()
+	if window < 0 || err != nil {
+		return f.wrapErr("sequential", err)
+	}
+
+	size, err := f.fid.iosize()
+	if err != nil {
+		return f.wrapErr("sequential", err)
+	}
+	if window == 0 {
+		window = defaultWindow
+	}
+	n := (window + size - 1) / size
+	if n > maxWindowRequests {
+		n = maxWindowRequests
+	}
+	f.seq = &sequential{fid: f.fid, window: n, size: size}
+	return nil
+}
+
+// leaveSequential waits for queued writes, discards read-ahead data and
+// switches the file back to normal mode. The caller must hold f.mu.
+func (f *File) leaveSequential() error {
+	if f.seq == nil {
+		return nil
+	}
+	err := f.seq.sync()
+	f.seq.discard()
+	f.seq = nil
+	return err
+}
+
+// read reads from the read-ahead requests at offset. It starts new
+// requests as they are consumed.
+func (s *sequential) read(p []byte, offset int64) (int, error) {
+	if err := s.sync(); err != nil {
+		return 0, err
+	}
+	if len(s.reads) > 0 && s.reads[0].off+int64(s.pos) != offset {
+		s.discard() // seeked or read short
+	}
+	if len(s.reads) == 0 {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+		s.next, s.pos = offset, 0
+	}
+	for len(s.reads) < s.window {
+		buf := make([]byte, s.size)
+		s.reads = append(s.reads, startRequest(s.ctx, s.fid, buf, s.next, (*Fid).read))
+		s.next += int64(s.size)
+	}
+
+	r := s.reads[0]
+	<-r.done
+	if r.err != nil {
+		s.discard()
+		return 0, r.err
+	}
+	n := copy(p, r.buf[s.pos:r.n])
+	if n == 0 {
+		s.discard()
+		return 0, io.EOF
+	}
+	if s.pos += n; s.pos == r.n {
+		s.reads, s.pos = s.reads[1:], 0
+	}
+	return n, nil
+}
+
+// discard cancels the read-ahead requests.
+func (s *sequential) discard() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.reads, s.pos = nil, 0
+}
+
+// write queues p to be written at offset. It returns the error of a
+// previously queued write, if any.
+func (s *sequential) write(p []byte, offset int64) (int, error) {
+	if err := s.err(); err != nil {
+		return 0, err
+	}
+	s.discard()
+	if len(s.buf) > 0 && s.off+int64(len(s.buf)) != offset {
+		s.flush()
+	}
+	if len(s.buf) == 0 {
+		s.off = offset
+	}
+
+	n := 0
+	for n < len(p) {
+		m := s.size - len(s.buf)
+		if m > len(p)-n {
+			m = len(p) - n
+		}
+		s.buf = append(s.buf, p[n:n+m]...)
+		if n += m; len(s.buf) == s.size {
+			s.flush()
+		}
+	}
+	return n, nil
+}
+
+// flush sends the queued data in the background. If the window is
+// full, it waits for the oldest write.
+func (s *sequential) flush() {
+	if len(s.buf) == 0 {
+		return
+	}
+	for len(s.writes) >= s.window {
+		s.wait()
+	}
+	r := startRequest(context.Background(), s.fid, s.buf, s.off, (*Fid).write)
+	s.writes = append(s.writes, r)
+	s.off += int64(len(s.buf))
+	s.buf = make([]byte, 0, s.size)
+}
+
+// wait waits for the oldest write and records its error.
+func (s *sequential) wait() {
+	r := s.writes[0]
+	<-r.done
+	if r.err == nil && r.n < len(r.buf) {
+		r.err = io.ErrShortWrite
+	}
+	if r.err != nil && s.pending == nil {
+		s.pending = r.err
+	}
+	s.writes = s.writes[1:]
+}
+
+// err returns and clears the error of a completed write.
+func (s *sequential) err() error {
+	for done := true; done && len(s.writes) > 0; {
+		select {
+		case <-s.writes[0].done:
+			s.wait()
+		default:
+			done = false
+		}
+	}
+	err := s.pending
+	s.pending = nil
+	return err
+}
+
+// sync sends the queued data, waits for all writes and returns the
+// first error.
+func (s *sequential) sync() error {
+	s.flush()
+	for len(s.writes) > 0 {
+		s.wait()
+	}
+	return s.err()
+}
+
+// syncSequential waits for queued writes and returns the first error.
+// If discard is set, read-ahead data is discarded. The caller must hold
+// f.mu.
+func (f *File) syncSequential(discard bool) error {
+	if f.seq == nil {
+		return nil
+	}
+	if discard {
+		f.seq.discard()
+	}
+	return f.seq.sync()
+}
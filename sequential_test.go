@@ -0,0 +1,115 @@
+package ninep
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/azmodb/ninep/proto"
+	"golang.org/x/sys/unix"
+)
+
+func TestFileSequential(t *testing.T) {
+	m := newMockTree(false, map[string]bool{"file": false})
+	c := newMockClient(t, m.handle, WithMaxMessageSize(1024))
+	defer c.Close()
+	root, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	defer root.Close()
+
+	f, err := root.OpenFile("file", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	if err = f.SetSequential(4096); err != nil {
+		t.Fatalf("sequential: unexpected error: %v", err)
+	}
+	if f.seq.window != 5 {
+		t.Fatalf("sequential: unexpected window %d", f.seq.window)
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	for i := 0; i < len(data); i += 100 {
+		if n, err := f.Write(data[i : i+100]); n != 100 || err != nil {
+			t.Fatalf("write: unexpected result %d, %v", n, err)
+		}
+	}
+	if err = f.Sync(); err != nil {
+		t.Fatalf("sync: unexpected error: %v", err)
+	}
+	if !bytes.Equal(m.data["file"], data) {
+		t.Fatalf("write: unexpected data")
+	}
+	if n := m.calls[proto.MessageTwrite]; n > 11 {
+		t.Fatalf("write: writes not coalesced, got %d requests", n)
+	}
+
+	f.Seek(0, io.SeekStart)
+	got, err := ioutil.ReadAll(f)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read: unexpected result %d bytes, %v", len(got), err)
+	}
+	f.Seek(4995, io.SeekStart)
+	buf := make([]byte, 10)
+	if _, err = io.ReadFull(f, buf); err != nil || string(buf) != "5678901234" {
+		t.Fatalf("read: unexpected result %q, %v", buf, err)
+	}
+
+	if err = f.SetSequential(-1); err != nil || f.seq != nil {
+		t.Fatalf("sequential: unexpected error: %v", err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatalf("close: unexpected error: %v", err)
+	}
+}
+
+func TestFileSequentialError(t *testing.T) {
+	m := newMockTree(false, map[string]bool{"file": false})
+	var mu sync.Mutex
+	fail := true
+	handle := func(tx, rx proto.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := tx.(*proto.Twrite); ok && fail {
+			return unix.ENOSPC
+		}
+		return m.handle(tx, rx)
+	}
+	c := newMockClient(t, handle)
+	defer c.Close()
+	root, err := c.Attach(nil, "/", "root", 0)
+	if err != nil {
+		t.Fatalf("attach: unexpected error: %v", err)
+	}
+	defer root.Close()
+
+	f, err := root.OpenFile("file", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open: unexpected error: %v", err)
+	}
+	if err = f.SetSequential(0); err != nil {
+		t.Fatalf("sequential: unexpected error: %v", err)
+	}
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Fatalf("write: unexpected error: %v", err)
+	}
+	checkPathError(t, "sync", f.Sync(), unix.ENOSPC)
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	if _, err = f.Write([]byte("world")); err != nil {
+		t.Fatalf("write: unexpected error: %v", err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatalf("close: unexpected error: %v", err)
+	}
+	if string(m.data["file"]) != "\x00\x00\x00\x00\x00world" {
+		t.Fatalf("write: unexpected data %q", m.data["file"])
+	}
+}
@@ -21,20 +21,34 @@ type Server struct {
 	maxMessageSize uint32
 	maxDataSize    uint32
 
-	fs posix.FileSystem
+	exports map[string]Export
+	qids    *qidmap
 }
 
-func NewServer(fs posix.FileSystem, opts ...Option) *Server {
-	return &Server{
+// NewServer returns a Server serving fs as the default export, if fs
+// is not nil, and the exports added by WithExport options. An error is
+// returned if an option is invalid.
+func NewServer(fs posix.FileSystem, opts ...Option) (*Server, error) {
+	s := &Server{
 		// TODO: max concurrent sessions
 		sid:      pool.NewGenerator(1, math.MaxUint16),
 		sessions: make(map[int64]io.Closer),
 
-		fs: fs,
+		exports: make(map[string]Export),
+		qids:    newQidmap(),
 
 		maxMessageSize: proto.MaxMessageSize,
 		maxDataSize:    proto.MaxDataSize,
 	}
+	if fs != nil {
+		s.exports[""] = Export{FileSystem: fs}
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 func (s *Server) Listen(listener net.Listener) (err error) {
@@ -57,7 +71,7 @@ func (s *Server) Listen(listener net.Listener) (err error) {
 
 		wg.Add(1)
 		go func(conn net.Conn, id int64) {
-			sess := newSession(s.fs, conn, s.maxMessageSize, s.maxDataSize)
+			sess := newSession(s.exports, s.qids, conn, s.maxMessageSize, s.maxDataSize)
 
 			err := sess.serve()
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
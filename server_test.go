@@ -66,7 +66,10 @@ func TestSessionHandling(t *testing.T) {
 	num := 8
 
 	l := newMockListener()
-	s := NewServer(nil)
+	s, err := NewServer(nil)
+	if err != nil {
+		t.Fatalf("server: unexpected error: %v", err)
+	}
 
 	done := make(chan error, 1)
 	go func() { done <- s.Listen(l) }()
@@ -12,13 +12,20 @@ import (
 // function must return a unix.Errno which will be sent back to the
 // client.
 type service struct {
-	fs     posix.FileSystem
-	fidmap *fidmap
-	valid  uint64
+	exports map[string]Export
+	qids    *qidmap
+	fidmap  *fidmap
 }
 
-func newService(fs posix.FileSystem) *service {
-	return &service{fs: fs, fidmap: newFidmap(), valid: proto.GetAttrAll /* TODO */}
+func newService(exports map[string]Export, qids *qidmap) *service {
+	if qids == nil {
+		qids = newQidmap()
+	}
+	return &service{
+		exports: exports,
+		qids:    qids,
+		fidmap:  newFidmap(),
+	}
 }
 
 func (s *service) attach(ctx context.Context, tx *proto.Tlattach, rx *proto.Rlattach) unix.Errno {
@@ -26,7 +33,16 @@ func (s *service) attach(ctx context.Context, tx *proto.Tlattach, rx *proto.Rlat
 		return unix.EINVAL
 	}
 
-	f, err := posix.Attach(s.fs, nil, tx.Path, tx.UserName, int(tx.Uid))
+	export, path, err := lookup(s.exports, tx.Path)
+	if err != nil {
+		return newErrno(err)
+	}
+	uid, err := export.identify(tx.UserName, int(tx.Uid))
+	if err != nil {
+		return newErrno(err)
+	}
+
+	f, err := posix.Attach(export.FileSystem, nil, path, tx.UserName, uid)
 	if err != nil {
 		return newErrno(err)
 	}
@@ -42,7 +58,7 @@ func (s *service) attach(ctx context.Context, tx *proto.Tlattach, rx *proto.Rlat
 		return unix.EBUSY
 	}
 
-	rx.Qid = proto.StatToQid(stat)
+	rx.Qid = s.qids.Qid(stat)
 	return 0
 }
 
@@ -61,12 +77,16 @@ func (s *service) getattr(ctx context.Context, tx *proto.Tgetattr, rx *proto.Rge
 	}
 	defer f.DecRef()
 
-	stat, err := f.Stat()
+	attr, err := f.Getattr(tx.RequestMask)
 	if err != nil {
 		return newErrno(err)
 	}
-	rx.Valid = s.valid
-	rx.Stat_t = stat
+	rx.Valid = attr.Valid
+	rx.Qid = s.qids.Qid(&attr.Stat)
+	rx.Stat_t = &attr.Stat
+	rx.Btime = attr.Btime
+	rx.Gen = attr.Gen
+	rx.DataVersion = attr.DataVersion
 	return 0
 }
 
@@ -91,7 +111,18 @@ func (s *service) clunk(ctx context.Context, tx *proto.Tclunk, rx *proto.Rclunk)
 }
 
 func (s *service) statfs(ctx context.Context, tx *proto.Tstatfs, rx *proto.Rstatfs) unix.Errno {
-	return unix.ENOTSUP
+	f, found := s.fidmap.Load(tx.Fid)
+	if !found {
+		return unix.EBADF
+	}
+	defer f.DecRef()
+
+	stat, err := f.Statfs()
+	if err != nil {
+		return newErrno(err)
+	}
+	*rx = proto.StatfsToRstatfs(stat)
+	return 0
 }
 
 func (s *service) create(ctx context.Context, tx *proto.Tlcreate, rx *proto.Rlcreate) unix.Errno {
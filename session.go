@@ -8,7 +8,6 @@ import (
 	"os"
 	"sync"
 
-	"github.com/azmodb/ninep/posix"
 	"github.com/azmodb/ninep/proto"
 	"github.com/azmodb/pkg/log"
 	"golang.org/x/sys/unix"
@@ -32,7 +31,7 @@ type session struct {
 	donec    chan struct{}
 }
 
-func newSession(fs posix.FileSystem, conn net.Conn, msize, dsize uint32) *session {
+func newSession(exports map[string]Export, qids *qidmap, conn net.Conn, msize, dsize uint32) *session {
 	return &session{
 		enc:         proto.NewEncoder(conn, msize),
 		dec:         proto.NewDecoder(conn, msize),
@@ -40,7 +39,7 @@ func newSession(fs posix.FileSystem, conn net.Conn, msize, dsize uint32) *sessio
 		maxDataSize: dsize,
 
 		addr:  conn.RemoteAddr().String(),
-		srv:   newService(fs),
+		srv:   newService(exports, qids),
 		donec: make(chan struct{}),
 	}
 }